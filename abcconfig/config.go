@@ -44,8 +44,9 @@ type AppConfig struct {
 	// The active environment section
 	Env string `toml:"env" mapstructure:"env" env:"ENV"`
 
-	Server ServerConfig `toml:"server" mapstructure:"server"`
-	DB     DBConfig     `toml:"db" mapstructure:"db"`
+	Server   ServerConfig   `toml:"server" mapstructure:"server"`
+	DB       DBConfig       `toml:"db" mapstructure:"db"`
+	Sessions SessionsConfig `toml:"sessions" mapstructure:"sessions"`
 }
 
 // ServerConfig is config for the app loaded through environment variables,
@@ -81,6 +82,9 @@ type ServerConfig struct {
 	// Use the development mode sessions storer opposed to production mode storer
 	// defined in app/sessions.go -- Usually a cookie storer for dev
 	// and disk storer for prod.
+	//
+	// Deprecated: new apps choose their storer in the SessionsConfig of
+	// each environment.
 	SessionsDevStorer bool `toml:"sessions-dev-storer" mapstructure:"sessions-dev-storer" env:"SERVER_SESSIONS_DEV_STORER"`
 	// PublicPath defaults to "public" but can be set to something else
 	// by the {{.AppEnvName}}_SERVER_PUBLIC_PATH environment variable.
@@ -105,6 +109,34 @@ type DBConfig struct {
 	EnforceMigration bool `toml:"enforce-migration" mapstructure:"enforce-migration" env:"DB_ENFORCE_MIGRATION"`
 }
 
+// SessionsConfig holds the sessions storer config for the app loaded through
+// environment variables, command line, or the config.toml file. It is used by
+// the app to create its sessions storer and by the "abcweb sessions" command
+// to manage the stored sessions, see NewSessionsStorer.
+type SessionsConfig struct {
+	// The sessions storer: cookie, memory, disk, log, redis or sql
+	Storer string `toml:"storer" mapstructure:"storer" env:"SESSIONS_STORER"`
+	// How long sessions live in the storer, zero keeps them forever
+	MaxAge time.Duration `toml:"max-age" mapstructure:"max-age" env:"SESSIONS_MAX_AGE"`
+	// How often the disk, log, memory and sql storers remove expired sessions
+	CleanInterval time.Duration `toml:"clean-interval" mapstructure:"clean-interval" env:"SESSIONS_CLEAN_INTERVAL"`
+	// The folder of the disk storer. Relative paths are inside the
+	// temp directory of the OS.
+	DiskFolder string `toml:"disk-folder" mapstructure:"disk-folder" env:"SESSIONS_DISK_FOLDER"`
+	// The file of the log storer. Relative paths are inside the temp
+	// directory of the OS. The file is locked by the app using it, so
+	// every app needs its own.
+	LogFile string `toml:"log-file" mapstructure:"log-file" env:"SESSIONS_LOG_FILE"`
+	// The Redis server address, defaults to localhost:6379
+	RedisAddr     string `toml:"redis-addr" mapstructure:"redis-addr" env:"SESSIONS_REDIS_ADDR"`
+	RedisPassword string `toml:"redis-password" mapstructure:"redis-password" env:"SESSIONS_REDIS_PASSWORD"`
+	RedisDB       int    `toml:"redis-db" mapstructure:"redis-db" env:"SESSIONS_REDIS_DB"`
+	// The prefix of the session keys in Redis
+	RedisPrefix string `toml:"redis-prefix" mapstructure:"redis-prefix" env:"SESSIONS_REDIS_PREFIX"`
+	// The name of the sessions table of the sql storer
+	SQLTable string `toml:"sql-table" mapstructure:"sql-table" env:"SESSIONS_SQL_TABLE"`
+}
+
 // Bind your passed in config flags to a new viper
 // instance, retrieves the active environment section of your config file using
 // that viper instance, and then loads your server and db config into
@@ -354,6 +386,7 @@ func NewFlagSet() *pflag.FlagSet {
 	flags.AddFlagSet(NewRootFlagSet())
 	flags.AddFlagSet(NewServerFlagSet())
 	flags.AddFlagSet(NewDBFlagSet())
+	flags.AddFlagSet(NewSessionsFlagSet())
 
 	return flags
 }
@@ -402,6 +435,26 @@ func NewServerFlagSet() *pflag.FlagSet {
 	return flags
 }
 
+// NewSessionsFlagSet returns a list of flags contained within the [sessions]
+// section of a config
+func NewSessionsFlagSet() *pflag.FlagSet {
+	flags := &pflag.FlagSet{}
+
+	// sessions subsection flags
+	flags.StringP("sessions.storer", "", "cookie", "The sessions storer (cookie|memory|disk|log|redis), or sql when the app passes its database handle")
+	flags.DurationP("sessions.max-age", "", time.Hour*24*2, "How long sessions live in the storer, 0 keeps them forever")
+	flags.DurationP("sessions.clean-interval", "", time.Hour, "How often expired sessions are removed by the disk, log, memory and sql storers")
+	flags.StringP("sessions.disk-folder", "", "sessions", "The disk storer folder, relative to the OS temp directory")
+	flags.StringP("sessions.log-file", "", "sessions.log", "The log storer file, relative to the OS temp directory")
+	flags.StringP("sessions.redis-addr", "", "localhost:6379", "The Redis server address")
+	flags.StringP("sessions.redis-password", "", "", "The Redis server password")
+	flags.IntP("sessions.redis-db", "", 0, "The Redis database index")
+	flags.StringP("sessions.redis-prefix", "", "", "The prefix of the session keys in Redis")
+	flags.StringP("sessions.sql-table", "", "sessions", "The sessions table of the sql storer")
+
+	return flags
+}
+
 // NewDBFlagSet returns a list of flags contained within the [db] section
 // of a config
 func NewDBFlagSet() *pflag.FlagSet {
@@ -625,6 +625,16 @@ func TestGetTagMappings(t *testing.T) {
 		{chain: "db.pass", env: "DB_PASS"},
 		{chain: "db.sslmode", env: "DB_SSLMODE"},
 		{chain: "db.enforce-migration", env: "DB_ENFORCE_MIGRATION"},
+		{chain: "sessions.storer", env: "SESSIONS_STORER"},
+		{chain: "sessions.max-age", env: "SESSIONS_MAX_AGE"},
+		{chain: "sessions.clean-interval", env: "SESSIONS_CLEAN_INTERVAL"},
+		{chain: "sessions.disk-folder", env: "SESSIONS_DISK_FOLDER"},
+		{chain: "sessions.log-file", env: "SESSIONS_LOG_FILE"},
+		{chain: "sessions.redis-addr", env: "SESSIONS_REDIS_ADDR"},
+		{chain: "sessions.redis-password", env: "SESSIONS_REDIS_PASSWORD"},
+		{chain: "sessions.redis-db", env: "SESSIONS_REDIS_DB"},
+		{chain: "sessions.redis-prefix", env: "SESSIONS_REDIS_PREFIX"},
+		{chain: "sessions.sql-table", env: "SESSIONS_SQL_TABLE"},
 	}
 
 	if len(mappings) != len(expected) {
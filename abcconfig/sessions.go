@@ -0,0 +1,72 @@
+package abcconfig
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/friendsofgo/errors"
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+	redis "gopkg.in/redis.v5"
+)
+
+// NewSessionsStorer creates the sessions storer configured by cfg. The
+// database handle is only used by the sql storer, which expects a Postgres
+// database, and can be nil otherwise.
+//
+// The cookie storer keeps the sessions in the client and has no Storer,
+// use abcsessions.NewCookieOverseer for it. The cleaners of the returned
+// storer are not started.
+func NewSessionsStorer(cfg SessionsConfig, db *sql.DB) (abcsessions.Storer, error) {
+	maxAge, cleanInterval := cfg.MaxAge, cfg.CleanInterval
+	if maxAge == 0 {
+		cleanInterval = 0
+	} else if cleanInterval == 0 {
+		cleanInterval = time.Hour
+	}
+
+	switch cfg.Storer {
+	case "memory":
+		return abcsessions.NewMemoryStorer(maxAge, cleanInterval)
+	case "disk":
+		if len(cfg.DiskFolder) == 0 {
+			return nil, errors.New("sessions disk-folder must be provided for the disk storer")
+		}
+		folder := cfg.DiskFolder
+		if !filepath.IsAbs(folder) {
+			folder = filepath.Join(os.TempDir(), folder)
+		}
+		return abcsessions.NewDiskStorer(folder, maxAge, cleanInterval)
+	case "log":
+		if len(cfg.LogFile) == 0 {
+			return nil, errors.New("sessions log-file must be provided for the log storer")
+		}
+		file := cfg.LogFile
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(os.TempDir(), file)
+		}
+		return abcsessions.NewLogStorer(file, maxAge, cleanInterval)
+	case "redis":
+		addr := cfg.RedisAddr
+		if len(addr) == 0 {
+			addr = "localhost:6379"
+		}
+		client := redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: cfg.RedisPassword,
+			DB:       cfg.RedisDB,
+		})
+		return abcsessions.NewRedisStorerClient(client, cfg.RedisPrefix, maxAge)
+	case "sql":
+		table := cfg.SQLTable
+		if len(table) == 0 {
+			table = "sessions"
+		}
+		return abcsessions.NewSQLStorer(db, abcsessions.SQLPlaceholderDollar, table, maxAge, cleanInterval)
+	case "cookie":
+		return nil, errors.New("the cookie storer keeps sessions in the client and has no server-side storer")
+	default:
+		return nil, errors.Errorf("unknown sessions storer %q, must be one of: cookie, memory, disk, log, redis, sql", cfg.Storer)
+	}
+}
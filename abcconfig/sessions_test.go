@@ -0,0 +1,69 @@
+package abcconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+)
+
+func TestNewSessionsStorer(t *testing.T) {
+	t.Parallel()
+
+	folder, err := ioutil.TempDir("", "abcconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	storer, err := NewSessionsStorer(SessionsConfig{Storer: "disk", DiskFolder: folder, MaxAge: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := storer.(*abcsessions.DiskStorer); !ok {
+		t.Errorf("expected a disk storer, got %T", storer)
+	}
+
+	storer, err = NewSessionsStorer(SessionsConfig{Storer: "log", LogFile: filepath.Join(folder, "sessions.log"), MaxAge: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, ok := storer.(*abcsessions.LogStorer); !ok {
+		t.Errorf("expected a log storer, got %T", storer)
+	} else {
+		l.Close()
+	}
+
+	storer, err = NewSessionsStorer(SessionsConfig{Storer: "memory"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := storer.(*abcsessions.MemoryStorer); !ok {
+		t.Errorf("expected a memory storer, got %T", storer)
+	}
+
+	storer, err = NewSessionsStorer(SessionsConfig{Storer: "redis", RedisPrefix: "session:"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := storer.(*abcsessions.RedisStorer); !ok {
+		t.Errorf("expected a redis storer, got %T", storer)
+	}
+
+	tests := []SessionsConfig{
+		{Storer: "cookie"},
+		{Storer: "mongo"},
+		{Storer: "disk"},
+		{Storer: "log"},
+		{Storer: "sql"},
+	}
+
+	for i, test := range tests {
+		if _, err := NewSessionsStorer(test, nil); err == nil {
+			t.Errorf("%d) expected an error for %#v", i, test)
+		}
+	}
+}
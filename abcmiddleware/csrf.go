@@ -0,0 +1,247 @@
+package abcmiddleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/friendsofgo/errors"
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+)
+
+const (
+	// CSRFHeader is the request header checked for the CSRF token
+	CSRFHeader = "X-CSRF-Token"
+	// CSRFField is the form field checked for the CSRF token when
+	// the CSRFHeader is not set
+	CSRFField = "csrf_token"
+
+	// csrfSecretLen is the length in bytes of the per-session secret
+	csrfSecretLen = 32
+)
+
+// ErrCSRF is returned through the ErrorManager when a request with an unsafe
+// method has a missing or invalid CSRF token. The CSRF middleware maps it to a
+// 403 rendering "errors/403" unless the ErrorManager already handles it.
+var ErrCSRF = errors.New("invalid csrf token")
+
+// csrfSecret is where the per-session CSRF secret is kept in the session
+var csrfSecret = abcsessions.NewValue[string]("csrf_secret")
+
+// CSRF returns a middleware protecting against cross-site request forgery.
+//
+// Each session gets a random secret stored through the sessions overseer,
+// created the first time a token is generated for it.
+// Requests with an unsafe method (anything but GET, HEAD, OPTIONS and TRACE)
+// must send a token derived from that secret in the X-CSRF-Token header or
+// the csrf_token form field, otherwise ErrCSRF is sent through errMgr.
+// Use CSRFToken to get a token for the current request, or the csrfField and
+// csrfToken template helpers from CSRFHelpers.
+//
+// Tokens are masked with a new random pad every time they are generated, so
+// they can be embedded in compressed responses without leaking the secret
+// (BREACH). Every generated token stays valid for the lifetime of the session.
+//
+// This middleware must be used after the abcsessions middleware.
+func CSRF(sessions abcsessions.Overseer, errMgr *ErrorManager) MW {
+	handled := false
+	for _, e := range errMgr.errors {
+		if errors.Is(ErrCSRF, e.Err) {
+			handled = true
+			break
+		}
+	}
+	if !handled {
+		errMgr.Add(NewError(ErrCSRF, http.StatusForbidden, errMgr.errLayout, "errors/403", nil))
+	}
+
+	return csrfMiddleware{
+		sessions: sessions,
+		errMgr:   errMgr,
+	}
+}
+
+type csrfMiddleware struct {
+	sessions abcsessions.Overseer
+	errMgr   *ErrorManager
+}
+
+func (c csrfMiddleware) Wrap(next http.Handler) http.Handler {
+	return csrfChecker{cm: c, next: next}
+}
+
+type csrfChecker struct {
+	cm   csrfMiddleware
+	next http.Handler
+}
+
+func (c csrfChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Only unsafe requests are checked, so that safe requests do not touch
+	// the session unless they generate a token
+	var secret []byte
+	if !csrfSafeMethod(r.Method) {
+		var err error
+		secret, err = c.cm.loadSecret(w, r)
+		if err != nil {
+			c.cm.fail(w, r, err)
+			return
+		}
+
+		token := r.Header.Get(CSRFHeader)
+		if len(token) == 0 {
+			token = r.PostFormValue(CSRFField)
+		}
+
+		if len(secret) == 0 || !csrfValid(secret, token) {
+			c.cm.fail(w, r, ErrCSRF)
+			return
+		}
+	}
+
+	state := &csrfState{cm: c.cm, w: w, secret: secret}
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeyCSRF, state))
+	c.next.ServeHTTP(w, r)
+}
+
+// csrfState is placed in the request context by the CSRF middleware. The
+// secret is only loaded, or created, once a token is asked for, so that
+// requests that never render a form do not create a session.
+type csrfState struct {
+	cm     csrfMiddleware
+	w      http.ResponseWriter
+	secret []byte
+}
+
+// loadSecret returns the CSRF secret of the session, or nil if it has none
+func (c csrfMiddleware) loadSecret(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	encoded, err := csrfSecret.Get(c.sessions, w, r)
+	if abcsessions.IsNoSessionError(err) || abcsessions.IsNoMapKeyError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "unable to get csrf secret")
+	}
+
+	secret, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(secret) != csrfSecretLen {
+		return nil, nil
+	}
+
+	return secret, nil
+}
+
+// secret returns the CSRF secret of the session, creating it if the
+// session has none
+func (c csrfMiddleware) secret(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	secret, err := c.loadSecret(w, r)
+	if err != nil || secret != nil {
+		return secret, err
+	}
+
+	secret = make([]byte, csrfSecretLen)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, errors.Wrap(err, "unable to generate csrf secret")
+	}
+
+	if err = csrfSecret.Set(c.sessions, w, r, base64.RawURLEncoding.EncodeToString(secret)); err != nil {
+		return nil, errors.Wrap(err, "unable to set csrf secret")
+	}
+
+	return secret, nil
+}
+
+// fail sends err through the error manager
+func (c csrfMiddleware) fail(w http.ResponseWriter, r *http.Request, err error) {
+	c.errMgr.Errors(func(w http.ResponseWriter, r *http.Request) error {
+		return err
+	})(w, r)
+}
+
+// CSRFToken returns a CSRF token for the current request, to be sent back in
+// the csrf_token form field or the X-CSRF-Token header. The CSRF secret of the
+// session is created on first use, along with the session if there is none.
+// It panics if the CSRF middleware is not in use.
+func CSRFToken(r *http.Request) (string, error) {
+	state, ok := r.Context().Value(ctxKeyCSRF).(*csrfState)
+	if !ok {
+		panic("cannot get csrf state from context object, is the CSRF middleware in use?")
+	}
+
+	if state.secret == nil {
+		secret, err := state.cm.secret(state.w, r)
+		if err != nil {
+			return "", err
+		}
+		state.secret = secret
+	}
+
+	return csrfMask(state.secret), nil
+}
+
+// CSRFHelpers returns the csrfToken and csrfField template helpers. Add them
+// to the renderer funcs next to abcrender.AppHelpers. Both take the request
+// as argument, for example in a form:
+//
+//	{{csrfField .Request}}
+//
+// or for javascript clients, which send it back in the X-CSRF-Token header:
+//
+//	<meta name="csrf-token" content="{{csrfToken .Request}}">
+func CSRFHelpers() template.FuncMap {
+	return template.FuncMap{
+		"csrfToken": CSRFToken,
+		"csrfField": func(r *http.Request) (template.HTML, error) {
+			token, err := CSRFToken(r)
+			if err != nil {
+				return "", err
+			}
+
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+				CSRFField, template.HTMLEscapeString(token))), nil
+		},
+	}
+}
+
+// csrfMask returns a token for secret: a random pad followed by the
+// secret xored with the pad, base64 encoded
+func csrfMask(secret []byte) string {
+	token := make([]byte, len(secret)*2)
+	if _, err := rand.Read(token[:len(secret)]); err != nil {
+		panic(fmt.Sprintf("unable to generate csrf token pad: %v", err))
+	}
+
+	for i := range secret {
+		token[len(secret)+i] = token[i] ^ secret[i]
+	}
+
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// csrfValid returns true if token was generated by csrfMask for secret
+func csrfValid(secret []byte, token string) bool {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(decoded) != len(secret)*2 {
+		return false
+	}
+
+	unmasked := make([]byte, len(secret))
+	for i := range unmasked {
+		unmasked[i] = decoded[i] ^ decoded[len(secret)+i]
+	}
+
+	return subtle.ConstantTimeCompare(unmasked, secret) == 1
+}
+
+// csrfSafeMethod returns true for the methods that must not change state
+// and are therefore not checked
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,170 @@
+package abcmiddleware
+
+import (
+	"context"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+	"go.uber.org/zap"
+)
+
+// csrfRender records the error pages rendered by the ErrorManager
+type csrfRender struct {
+	status int
+	name   string
+}
+
+func (csrfRender) Data(w io.Writer, status int, v []byte) error      { return nil }
+func (csrfRender) JSON(w io.Writer, status int, v interface{}) error { return nil }
+func (csrfRender) Text(w io.Writer, status int, v string) error      { return nil }
+func (c *csrfRender) HTML(w io.Writer, status int, name string, binding interface{}) error {
+	c.status = status
+	c.name = name
+	return nil
+}
+func (c *csrfRender) HTMLWithLayout(w io.Writer, status int, name string, binding interface{}, layout string) error {
+	c.status = status
+	c.name = name
+	return nil
+}
+
+func TestCSRF(t *testing.T) {
+	t.Parallel()
+
+	storer, err := abcsessions.NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	overseer := abcsessions.NewStorageOverseer(abcsessions.NewCookieOptions(), storer)
+
+	rndr := &csrfRender{}
+	m := NewErrorManager(rndr, "layouts/errors")
+
+	var token string
+	called, wantToken := false, true
+	handler := abcsessions.Middleware(CSRF(overseer, m).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if !wantToken {
+			return
+		}
+
+		var err error
+		if token, err = CSRFToken(r); err != nil {
+			t.Error(err)
+		}
+	})))
+
+	serve := func(r *http.Request, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), CTXKeyLogger, zap.NewNop()))
+
+		called = false
+		rndr.status = 0
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// A safe request that generates no token creates no session
+	wantToken = false
+	w := serve(httptest.NewRequest("GET", "/", nil), nil)
+	if !called {
+		t.Fatal("expected handler to be called")
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("expected no session cookie")
+	}
+	if keys, _ := storer.All(); len(keys) != 0 {
+		t.Errorf("expected no sessions, got %d", len(keys))
+	}
+
+	// Generating a token creates the secret
+	wantToken = true
+	w = serve(httptest.NewRequest("GET", "/", nil), nil)
+	if !called || len(token) == 0 {
+		t.Fatal("expected handler to be called with a token")
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("expected a session cookie")
+	}
+
+	// Tokens are masked differently every time
+	first := token
+	serve(httptest.NewRequest("GET", "/", nil), cookies)
+	if token == first {
+		t.Error("expected a differently masked token")
+	}
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set(CSRFHeader, first)
+	serve(r, cookies)
+	if !called {
+		t.Errorf("expected header token to be accepted, got status %d", rndr.status)
+	}
+
+	form := url.Values{CSRFField: {token}}
+	r = httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	serve(r, cookies)
+	if !called {
+		t.Errorf("expected form token to be accepted, got status %d", rndr.status)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		cookies []*http.Cookie
+	}{
+		{name: "missing token", cookies: cookies},
+		{name: "invalid token", token: "garbage", cookies: cookies},
+		{name: "secret as token", token: strings.Repeat("A", 43), cookies: cookies},
+		{name: "no session", token: first},
+	}
+
+	for _, test := range tests {
+		r = httptest.NewRequest("POST", "/", nil)
+		if len(test.token) != 0 {
+			r.Header.Set(CSRFHeader, test.token)
+		}
+		serve(r, test.cookies)
+		if called {
+			t.Errorf("%s: expected handler not to be called", test.name)
+		}
+		if rndr.status != http.StatusForbidden || rndr.name != "errors/403" {
+			t.Errorf("%s: expected errors/403 with status 403, got %q %d", test.name, rndr.name, rndr.status)
+		}
+	}
+}
+
+func TestCSRFHelpers(t *testing.T) {
+	t.Parallel()
+
+	secret := make([]byte, csrfSecretLen)
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeyCSRF, &csrfState{secret: secret}))
+
+	field, err := CSRFHelpers()["csrfField"].(func(*http.Request) (template.HTML, error))(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(field), `<input type="hidden" name="csrf_token" value="`) {
+		t.Errorf("unexpected field: %s", field)
+	}
+
+	token, err := CSRFHelpers()["csrfToken"].(func(*http.Request) (string, error))(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !csrfValid(secret, token) {
+		t.Error("expected token to be valid")
+	}
+}
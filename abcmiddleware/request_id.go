@@ -13,6 +13,9 @@ type ctxKey int
 const (
 	// CTXKeyLogger is the key under which the request scoped logger is placed
 	CTXKeyLogger ctxKey = iota
+	// ctxKeyCSRF is the key under which the CSRF middleware places the
+	// state it needs to generate CSRF tokens
+	ctxKeyCSRF
 )
 
 // RequestIDHeader sets the X-Request-ID header to the chi request id
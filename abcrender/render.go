@@ -7,6 +7,7 @@ import (
 	"html/template"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"path/filepath"
 	"strings"
 
@@ -54,6 +55,23 @@ func (r *Render) HTMLWithLayout(w io.Writer, status int, name string, binding in
 	return r.Render.HTML(w, status, name, binding, render.HTMLOptions{Layout: layout})
 }
 
+// Data is the render data of a page. Templates find the request of the page
+// under "Request", for the helpers that need it in layouts and partials such
+// as csrfField and flashes:
+//
+//	data := abcrender.NewData(r)
+//	data["User"] = user
+//	return m.Render.HTML(w, http.StatusOK, "main/home", data)
+//
+// The main layout of new apps uses it to render the flash messages, pages
+// rendered with a struct instead need a Request field.
+type Data map[string]interface{}
+
+// NewData returns the render data of a page rendered for r
+func NewData(r *http.Request) Data {
+	return Data{"Request": r}
+}
+
 // New returns a new Render with AssetsManifest and Render set
 func New(opts render.Options, manifest map[string]string) Renderer {
 	return &Render{
@@ -2,6 +2,7 @@ package abcrender
 
 import (
 	"io/ioutil"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
@@ -22,6 +23,16 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestNewData(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	data := NewData(r)
+	if data["Request"] != r {
+		t.Errorf("expected the request in the data, got: %#v", data)
+	}
+}
+
 func TestGetManifest(t *testing.T) {
 	t.Parallel()
 
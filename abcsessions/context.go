@@ -0,0 +1,146 @@
+package abcsessions
+
+import (
+	"context"
+	"net/http"
+)
+
+// NewContextStorer returns storer as a ContextStorer. If storer already
+// implements ContextStorer it is returned as is, otherwise it is wrapped
+// in an adapter that checks the context before every call but cannot
+// interrupt a call that is already in progress.
+func NewContextStorer(storer Storer) ContextStorer {
+	if cs, ok := storer.(ContextStorer); ok {
+		return cs
+	}
+
+	return contextStorer{storer: storer}
+}
+
+// NewBackgroundStorer returns storer as a Storer. If storer already
+// implements Storer it is returned as is, otherwise it is wrapped in an
+// adapter that calls the context methods with context.Background().
+func NewBackgroundStorer(storer ContextStorer) Storer {
+	if s, ok := storer.(Storer); ok {
+		return s
+	}
+
+	return backgroundStorer{storer: storer}
+}
+
+// NewContextOverseer returns overseer as a ContextOverseer. If overseer
+// already implements ContextOverseer it is returned as is, otherwise it
+// is wrapped in an adapter that checks the context before every call but
+// otherwise ignores it.
+func NewContextOverseer(overseer Overseer) ContextOverseer {
+	if co, ok := overseer.(ContextOverseer); ok {
+		return co
+	}
+
+	return contextOverseer{Overseer: overseer}
+}
+
+// contextStorer adapts a Storer to the ContextStorer interface
+type contextStorer struct {
+	storer Storer
+}
+
+func (c contextStorer) AllContext(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.storer.All()
+}
+
+func (c contextStorer) GetContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return c.storer.Get(key)
+}
+
+func (c contextStorer) SetContext(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.storer.Set(key, value)
+}
+
+func (c contextStorer) DelContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.storer.Del(key)
+}
+
+func (c contextStorer) ResetExpiryContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.storer.ResetExpiry(key)
+}
+
+// backgroundStorer adapts a ContextStorer to the Storer interface
+type backgroundStorer struct {
+	storer ContextStorer
+}
+
+func (b backgroundStorer) All() ([]string, error) {
+	return b.storer.AllContext(context.Background())
+}
+
+func (b backgroundStorer) Get(key string) (string, error) {
+	return b.storer.GetContext(context.Background(), key)
+}
+
+func (b backgroundStorer) Set(key, value string) error {
+	return b.storer.SetContext(context.Background(), key, value)
+}
+
+func (b backgroundStorer) Del(key string) error {
+	return b.storer.DelContext(context.Background(), key)
+}
+
+func (b backgroundStorer) ResetExpiry(key string) error {
+	return b.storer.ResetExpiryContext(context.Background(), key)
+}
+
+// contextOverseer adapts an Overseer to the ContextOverseer interface
+type contextOverseer struct {
+	Overseer
+}
+
+func (c contextOverseer) GetContext(ctx context.Context, w http.ResponseWriter, r *http.Request) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return c.Overseer.Get(w, r)
+}
+
+func (c contextOverseer) SetContext(ctx context.Context, w http.ResponseWriter, r *http.Request, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Overseer.Set(w, r, value)
+}
+
+func (c contextOverseer) DelContext(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Overseer.Del(w, r)
+}
+
+func (c contextOverseer) RegenerateContext(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Overseer.Regenerate(w, r)
+}
+
+func (c contextOverseer) ResetExpiryContext(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Overseer.ResetExpiry(w, r)
+}
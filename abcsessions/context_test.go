@@ -0,0 +1,232 @@
+package abcsessions
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/friendsofgo/errors"
+)
+
+// legacyStorer only implements the Storer interface
+type legacyStorer struct {
+	Storer
+}
+
+// ctxOnlyStorer only implements the ContextStorer interface
+type ctxOnlyStorer struct {
+	ContextStorer
+}
+
+// legacyOverseer only implements the Overseer interface
+type legacyOverseer struct {
+	Overseer
+}
+
+func TestContextImplements(t *testing.T) {
+	t.Parallel()
+
+	var _ ContextStorer = &MemoryStorer{}
+	var _ ContextStorer = &DiskStorer{}
+	var _ ContextStorer = &RedisStorer{}
+	var _ ContextStorer = &SQLStorer{}
+	var _ ContextOverseer = &StorageOverseer{}
+}
+
+func TestNewContextStorer(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	if cs := NewContextStorer(m); cs != ContextStorer(m) {
+		t.Error("expected context storers to be returned as is")
+	}
+
+	cs := NewContextStorer(legacyStorer{Storer: m})
+	if _, ok := cs.(contextStorer); !ok {
+		t.Fatalf("expected an adapter, got: %T", cs)
+	}
+
+	ctx := context.Background()
+	if err := cs.SetContext(ctx, "hi", "hello"); err != nil {
+		t.Error(err)
+	}
+	val, err := cs.GetContext(ctx, "hi")
+	if err != nil {
+		t.Error(err)
+	}
+	if val != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", val)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err = cs.GetContext(ctx, "hi"); err != context.Canceled {
+		t.Errorf("expected context canceled, got: %v", err)
+	}
+	if err = cs.SetContext(ctx, "hi", "bye"); err != context.Canceled {
+		t.Errorf("expected context canceled, got: %v", err)
+	}
+	if val, _ := m.Get("hi"); val != "hello" {
+		t.Errorf("expected canceled set to not be applied, got: %q", val)
+	}
+}
+
+func TestNewBackgroundStorer(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	if s := NewBackgroundStorer(m); s != Storer(m) {
+		t.Error("expected storers to be returned as is")
+	}
+
+	s := NewBackgroundStorer(ctxOnlyStorer{ContextStorer: m})
+	if _, ok := s.(backgroundStorer); !ok {
+		t.Fatalf("expected an adapter, got: %T", s)
+	}
+
+	if err := s.Set("hi", "hello"); err != nil {
+		t.Error(err)
+	}
+	val, err := s.Get("hi")
+	if err != nil {
+		t.Error(err)
+	}
+	if val != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", val)
+	}
+
+	if err = s.Del("hi"); err != nil {
+		t.Error(err)
+	}
+	if _, err = s.Get("hi"); !IsNoSessionError(err) {
+		t.Errorf("Expected ErrNoSession, got: %v", err)
+	}
+}
+
+func TestNewContextOverseer(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), m)
+	if co := NewContextOverseer(s); co != ContextOverseer(s) {
+		t.Error("expected context overseers to be returned as is")
+	}
+
+	co := NewContextOverseer(legacyOverseer{Overseer: s})
+	if _, ok := co.(contextOverseer); !ok {
+		t.Fatalf("expected an adapter, got: %T", co)
+	}
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := co.SetContext(ctx, w, r, "hello"); err != nil {
+		t.Error(err)
+	}
+	val, err := co.GetContext(ctx, w, r)
+	if err != nil {
+		t.Error(err)
+	}
+	if val != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", val)
+	}
+
+	cancel()
+	if _, err = co.GetContext(ctx, w, r); err != context.Canceled {
+		t.Errorf("expected context canceled, got: %v", err)
+	}
+}
+
+func TestStorageOverseerRequestContext(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), m)
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	if err := s.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	cancel()
+	r = r.WithContext(ctx)
+
+	_, err := s.Get(w, r)
+	if errors.Cause(err) != context.Canceled {
+		t.Errorf("expected the request context to be passed to the storer, got: %v", err)
+	}
+	if err = s.ResetExpiry(w, r); err == nil {
+		t.Error("expected reset expiry to fail with a canceled request")
+	}
+	if err = s.Set(w, r, "bye"); err == nil {
+		t.Error("expected set to fail with a canceled request")
+	}
+
+	r = r.WithContext(context.Background())
+	if err = s.Regenerate(w, r); err != nil {
+		t.Error(err)
+	}
+	if len(w.cookies) != 1 {
+		t.Errorf("expected one cookie, got %d", len(w.cookies))
+	}
+	for _, c := range w.cookies {
+		if _, err = m.Get(c.Value); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRedisWrite(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// A write is waited for even if ctx is done while it runs
+	err := redisWrite(ctx, func() error {
+		cancel()
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected the write to finish, got: %v", err)
+	}
+
+	called := false
+	err = redisWrite(ctx, func() error {
+		called = true
+		return nil
+	})
+	if err != context.Canceled || called {
+		t.Errorf("expected the write not to start, called: %t, err: %v", called, err)
+	}
+}
+
+func TestRedisDo(t *testing.T) {
+	t.Parallel()
+
+	called := false
+	err := redisDo(context.Background(), func() error {
+		called = true
+		return nil
+	})
+	if err != nil || !called {
+		t.Errorf("expected fn to run, err: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	block := make(chan struct{})
+	defer close(block)
+
+	go cancel()
+	err = redisDo(ctx, func() error {
+		<-block
+		return nil
+	})
+	if err != context.Canceled {
+		t.Errorf("expected context canceled, got: %v", err)
+	}
+}
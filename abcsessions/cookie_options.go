@@ -2,7 +2,31 @@ package abcsessions
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/friendsofgo/errors"
+)
+
+const (
+	// defaultCookieChunkSize leaves room for the cookie name and attributes
+	// within the 4096 bytes browsers allow per cookie
+	defaultCookieChunkSize = 3800
+	// defaultCookieMaxSize is the default limit for the total length of
+	// a chunked cookie value
+	defaultCookieMaxSize = defaultCookieChunkSize * 4
+
+	// cookiePrefixSecure is the name prefix browsers only accept on
+	// Secure cookies
+	cookiePrefixSecure = "__Secure-"
+	// cookiePrefixHost is the name prefix browsers only accept on Secure
+	// cookies with Path=/ and no Domain
+	cookiePrefixHost = "__Host-"
+	// cookieAttrPartitioned is the Partitioned cookie attribute. It is kept
+	// in http.Cookie.Unparsed because http.Cookie only has a Partitioned
+	// field from Go 1.23 onwards.
+	cookieAttrPartitioned = "Partitioned"
 )
 
 // CookieOptions for the session cookies themselves.
@@ -21,32 +45,104 @@ type CookieOptions struct {
 	Secure bool
 	// HTTPOnly means the browser will never allow JS to touch this cookie
 	HTTPOnly bool
+	// SameSite controls whether the cookie is sent with cross-site requests.
+	// http.SameSiteNoneMode requires Secure.
+	SameSite http.SameSite
+	// Partitioned stores the cookie separately for each top-level site it
+	// is embedded in (CHIPS), for sessions used in third-party iframes.
+	// Requires Secure.
+	Partitioned bool
+	// ChunkSize is the maximum length of a single cookie value. Longer values
+	// are split across numbered cookies (Name, Name_1, Name_2, ...).
+	// Only used by the CookieOverseer, defaults to 3800 when zero.
+	ChunkSize int
+	// MaxSize is the maximum total length of a value across all of its
+	// chunks. Only used by the CookieOverseer, defaults to 15200 when zero.
+	MaxSize int
 }
 
 // NewCookieOptions gives healthy defaults for session cookies
 func NewCookieOptions() CookieOptions {
 	return CookieOptions{
-		Name:     "id",
-		Path:     "/",
-		MaxAge:   0,
-		Secure:   true,
-		HTTPOnly: true,
+		Name:      "id",
+		Path:      "/",
+		MaxAge:    0,
+		Secure:    true,
+		HTTPOnly:  true,
+		SameSite:  http.SameSiteLaxMode,
+		ChunkSize: defaultCookieChunkSize,
+		MaxSize:   defaultCookieMaxSize,
+	}
+}
+
+// Validate checks the options against the rules browsers enforce, so that
+// a misconfiguration is caught at startup instead of the browser silently
+// dropping the session cookie:
+//
+// a name with the __Secure- prefix must be Secure, a name with the __Host-
+// prefix must also have Path=/ and no Domain, and SameSite=None and
+// Partitioned cookies must be Secure.
+func (c CookieOptions) Validate() error {
+	if len(c.Name) == 0 {
+		return errors.New("cookie name must be provided")
+	}
+
+	if strings.HasPrefix(c.Name, cookiePrefixSecure) && !c.Secure {
+		return errors.Errorf("cookie %q must be Secure because of its %s prefix", c.Name, cookiePrefixSecure)
+	}
+	if strings.HasPrefix(c.Name, cookiePrefixHost) {
+		if !c.Secure {
+			return errors.Errorf("cookie %q must be Secure because of its %s prefix", c.Name, cookiePrefixHost)
+		}
+		if c.Path != "/" {
+			return errors.Errorf("cookie %q must have Path \"/\" because of its %s prefix", c.Name, cookiePrefixHost)
+		}
+		if len(c.Domain) != 0 {
+			return errors.Errorf("cookie %q must not have a Domain because of its %s prefix", c.Name, cookiePrefixHost)
+		}
+	}
+
+	if c.SameSite == http.SameSiteNoneMode && !c.Secure {
+		return errors.Errorf("cookie %q must be Secure to use SameSite=None", c.Name)
+	}
+	if c.Partitioned && !c.Secure {
+		return errors.Errorf("cookie %q must be Secure to be Partitioned", c.Name)
 	}
+
+	return nil
 }
 
 func (c CookieOptions) makeCookie(value string) *http.Cookie {
+	return c.makeNamedCookie(c.Name, value)
+}
+
+func (c CookieOptions) makeNamedCookie(name, value string) *http.Cookie {
+	cookie := c.baseCookie(name)
+	cookie.Value = value
+	cookie.MaxAge = int(c.MaxAge.Seconds())
+
+	if c.MaxAge != 0 {
+		cookie.Expires = time.Now().UTC().Add(c.MaxAge)
+	}
+
+	return cookie
+}
+
+// baseCookie returns a cookie named name with the attributes of the options.
+// Cookies are only replaced or deleted by a cookie with the same attributes,
+// so both set and deleted cookies are built from it.
+func (c CookieOptions) baseCookie(name string) *http.Cookie {
 	cookie := &http.Cookie{
 		Domain:   c.Domain,
 		Path:     c.Path,
-		Name:     c.Name,
-		Value:    value,
-		MaxAge:   int(c.MaxAge.Seconds()),
+		Name:     name,
 		HttpOnly: c.HTTPOnly,
 		Secure:   c.Secure,
+		SameSite: c.SameSite,
 	}
 
-	if c.MaxAge != 0 {
-		cookie.Expires = time.Now().UTC().Add(c.MaxAge)
+	if c.Partitioned {
+		cookie.Unparsed = []string{cookieAttrPartitioned}
 	}
 
 	return cookie
@@ -54,18 +150,16 @@ func (c CookieOptions) makeCookie(value string) *http.Cookie {
 
 // deleteCookie sets the cookie to a deleted value to force the client to delete
 func (c CookieOptions) deleteCookie(w http.ResponseWriter) {
-	cookie := &http.Cookie{
-		// If the browser refuses to delete it, set value to "" so subsequent
-		// requests replace it when it does not point to a valid session id.
-		Path:     c.Path,
-		Domain:   c.Domain,
-		Value:    "",
-		Name:     c.Name,
-		MaxAge:   -1,
-		Expires:  time.Now().UTC().AddDate(-1, 0, 0),
-		HttpOnly: c.HTTPOnly,
-		Secure:   c.Secure,
-	}
+	c.deleteNamedCookie(w, c.Name)
+}
+
+func (c CookieOptions) deleteNamedCookie(w http.ResponseWriter, name string) {
+	cookie := c.baseCookie(name)
+	// If the browser refuses to delete it, set value to "" so subsequent
+	// requests replace it when it does not point to a valid session id.
+	cookie.Value = ""
+	cookie.MaxAge = -1
+	cookie.Expires = time.Now().UTC().AddDate(-1, 0, 0)
 
 	w.(cookieWriter).SetCookie(cookie)
 }
@@ -87,3 +181,139 @@ func (c CookieOptions) getCookieValue(w http.ResponseWriter, r *http.Request) (s
 
 	return reqCookie.Value, nil
 }
+
+// getID returns the session ID in the session cookie
+func (c CookieOptions) getID(w http.ResponseWriter, r *http.Request) (string, error) {
+	return c.getCookieValue(w, r)
+}
+
+// setID sets the session cookie to id
+func (c CookieOptions) setID(w http.ResponseWriter, id string) {
+	w.(cookieWriter).SetCookie(c.makeCookie(id))
+}
+
+// refreshID sets the session cookie again to renew its expiry, if it has one
+func (c CookieOptions) refreshID(w http.ResponseWriter, id string) {
+	if c.MaxAge != 0 {
+		c.setID(w, id)
+	}
+}
+
+// deleteID deletes the session cookie
+func (c CookieOptions) deleteID(w http.ResponseWriter) {
+	c.deleteCookie(w)
+}
+
+// chunkName returns the name of the i'th chunk of a chunked cookie.
+// The first chunk uses the plain cookie name.
+func (c CookieOptions) chunkName(i int) string {
+	if i == 0 {
+		return c.Name
+	}
+
+	return c.Name + "_" + strconv.Itoa(i)
+}
+
+// chunkSize returns the configured chunk size or the default
+func (c CookieOptions) chunkSize() int {
+	if c.ChunkSize <= 0 {
+		return defaultCookieChunkSize
+	}
+
+	return c.ChunkSize
+}
+
+// maxSize returns the configured max size or the default
+func (c CookieOptions) maxSize() int {
+	if c.MaxSize <= 0 {
+		return defaultCookieMaxSize
+	}
+
+	return c.MaxSize
+}
+
+// getChunk returns the value of the i'th chunk of a chunked cookie from
+// the cookies cache or the request. Chunks deleted in the cookies cache
+// are reported as missing.
+func (c CookieOptions) getChunk(w http.ResponseWriter, r *http.Request, i int) (string, bool) {
+	name := c.chunkName(i)
+
+	if cookie := w.(cookieWriter).GetCookie(name); cookie != nil {
+		return cookie.Value, cookie.MaxAge >= 0
+	}
+
+	reqCookie, err := r.Cookie(name)
+	if err != nil {
+		return "", false
+	}
+
+	return reqCookie.Value, true
+}
+
+// getChunkedValue joins the values of all chunks of a chunked cookie.
+// It returns an errNoSession error if the first chunk does not exist.
+func (c CookieOptions) getChunkedValue(w http.ResponseWriter, r *http.Request) (string, error) {
+	first, err := c.getCookieValue(w, r)
+	if err != nil {
+		return "", err
+	}
+
+	maxChunks := c.maxSize()/c.chunkSize() + 1
+	value := first
+	for i := 1; i < maxChunks; i++ {
+		chunk, ok := c.getChunk(w, r, i)
+		if !ok {
+			break
+		}
+		value += chunk
+	}
+
+	return value, nil
+}
+
+// setChunkedValue splits value into chunks and sets one cookie per chunk,
+// deleting the chunks of a previous, longer value.
+func (c CookieOptions) setChunkedValue(w http.ResponseWriter, r *http.Request, value string) error {
+	if err := c.checkSize(value); err != nil {
+		return err
+	}
+
+	size := c.chunkSize()
+	i := 0
+	for ; i == 0 || len(value) > 0; i++ {
+		n := size
+		if n > len(value) {
+			n = len(value)
+		}
+		w.(cookieWriter).SetCookie(c.makeNamedCookie(c.chunkName(i), value[:n]))
+		value = value[n:]
+	}
+
+	c.deleteChunks(w, r, i)
+	return nil
+}
+
+// checkSize returns an error if value is larger than the MaxSize
+func (c CookieOptions) checkSize(value string) error {
+	if len(value) > c.maxSize() {
+		return errors.Errorf("session cookie value is %d bytes, which is over the limit of %d bytes", len(value), c.maxSize())
+	}
+
+	return nil
+}
+
+// deleteChunks deletes all existing chunks of a chunked cookie
+// starting at the from'th chunk
+func (c CookieOptions) deleteChunks(w http.ResponseWriter, r *http.Request, from int) {
+	if from == 0 {
+		c.deleteCookie(w)
+		from = 1
+	}
+
+	for i := from; ; i++ {
+		if _, ok := c.getChunk(w, r, i); !ok {
+			return
+		}
+		c.deleteNamedCookie(w, c.chunkName(i))
+	}
+}
@@ -3,6 +3,7 @@ package abcsessions
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -23,6 +24,18 @@ func TestNewCookieOptions(t *testing.T) {
 	if o.HTTPOnly != true {
 		t.Error("expected httponly to be true")
 	}
+	if o.SameSite != http.SameSiteLaxMode {
+		t.Error("expected samesite to be lax")
+	}
+	if err := o.Validate(); err != nil {
+		t.Errorf("expected default options to be valid, got: %v", err)
+	}
+	if o.ChunkSize != defaultCookieChunkSize {
+		t.Errorf("expected chunk size to be %d", defaultCookieChunkSize)
+	}
+	if o.MaxSize != defaultCookieMaxSize {
+		t.Errorf("expected max size to be %d", defaultCookieMaxSize)
+	}
 }
 
 func TestMakeCookie(t *testing.T) {
@@ -96,3 +109,82 @@ func TestGetCookieValue(t *testing.T) {
 		t.Errorf("Expected %q, got %q", "idvalue", val)
 	}
 }
+
+func TestCookieOptionsValidate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		opts  func(o *CookieOptions)
+		valid bool
+	}{
+		{name: "defaults", opts: func(o *CookieOptions) {}, valid: true},
+		{name: "no name", opts: func(o *CookieOptions) { o.Name = "" }},
+		{name: "secure prefix", opts: func(o *CookieOptions) { o.Name = "__Secure-id"; o.Domain = "example.com" }, valid: true},
+		{name: "secure prefix insecure", opts: func(o *CookieOptions) { o.Name = "__Secure-id"; o.Secure = false }},
+		{name: "host prefix", opts: func(o *CookieOptions) { o.Name = "__Host-id" }, valid: true},
+		{name: "host prefix insecure", opts: func(o *CookieOptions) { o.Name = "__Host-id"; o.Secure = false }},
+		{name: "host prefix path", opts: func(o *CookieOptions) { o.Name = "__Host-id"; o.Path = "/app" }},
+		{name: "host prefix domain", opts: func(o *CookieOptions) { o.Name = "__Host-id"; o.Domain = "example.com" }},
+		{name: "samesite none", opts: func(o *CookieOptions) { o.SameSite = http.SameSiteNoneMode }, valid: true},
+		{name: "samesite none insecure", opts: func(o *CookieOptions) { o.SameSite = http.SameSiteNoneMode; o.Secure = false }},
+		{name: "partitioned insecure", opts: func(o *CookieOptions) { o.Partitioned = true; o.Secure = false }},
+	}
+
+	for _, test := range tests {
+		o := NewCookieOptions()
+		test.opts(&o)
+
+		err := o.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: expected options to be valid, got: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected options to be invalid", test.name)
+		}
+	}
+
+	o := NewCookieOptions()
+	o.Name = "__Host-id"
+	o.Path = "/app"
+
+	for name, fn := range map[string]func(){
+		"storage": func() { NewStorageOverseer(o, nil) },
+		"cookie":  func() { NewCookieOverseer(o, testCookieKey) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected the %s overseer to panic on invalid options", name)
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+func TestCookieAttributes(t *testing.T) {
+	t.Parallel()
+
+	o := NewCookieOptions()
+	o.Name = "__Host-id"
+	o.SameSite = http.SameSiteNoneMode
+	o.Partitioned = true
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	w.SetCookie(o.makeNamedCookie("__Host-id", "test"))
+	o.deleteNamedCookie(w, "__Host-id_1")
+	w.WriteHeader(http.StatusOK)
+
+	headers := w.Header()["Set-Cookie"]
+	if len(headers) != 2 {
+		t.Fatalf("expected 2 cookies, got %v", headers)
+	}
+	for _, h := range headers {
+		for _, attr := range []string{"Path=/", "Secure", "SameSite=None", "; Partitioned"} {
+			if !strings.Contains(h, attr) {
+				t.Errorf("expected %q in %q", attr, h)
+			}
+		}
+	}
+}
@@ -1,47 +1,98 @@
 package abcsessions
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/friendsofgo/errors"
 )
 
+// cookiePayloadPrefix marks cookie values that carry a session ID, values
+// without it were sealed before cookie sessions had IDs.
+const cookiePayloadPrefix = "abcsc1:"
+
 // CookieOverseer oversees cookie operations that are encrypted and verified
 // but does store all data client side which means it is a possible attack
 // vector. Uses GCM to verify and encrypt data.
+//
+// Each cookie session carries a random session ID and the time the ID was
+// issued at, sealed with the value, so that cookie sessions can be
+// regenerated and revoked, see Revocations.
 type CookieOverseer struct {
+	// Policy limits the lifetime of sessions and binds them to clients.
+	// The zero value enforces nothing.
+	Policy Policy
+	// Hooks are called with the lifecycle events of the sessions, see Event.
+	// Cookie sessions expire in the browser, so EventExpire is never raised.
+	Hooks []Hook
+	// Revocations is an optional denylist of revoked session IDs, checked
+	// by every Get. Sessions are revoked when they are deleted or
+	// regenerated and by Revoke, so that a copy of the cookie can not be
+	// replayed after a logout. Any Storer can be used, its max age must be
+	// at least the lifetime of the cookies, the cookie MaxAge or the Policy
+	// AbsoluteTimeout. Nil means sessions are not revoked.
+	Revocations Storer
+
 	options CookieOptions
 
-	secretKey    []byte
-	gcmBlockMode cipher.AEAD
+	keyring *Keyring
 
 	resetExpiryMiddleware
 }
 
+// cookiePayload is the sealed content of the session cookie
+type cookiePayload struct {
+	ID string `json:"id"`
+	// IssuedAt is the unix time the session ID was issued at
+	IssuedAt int64 `json:"iat"`
+	// Value is the session value, wrapped by the Policy
+	Value string `json:"v"`
+	// WrittenAt is the unix time the cookie was last written at, which is
+	// when its MaxAge started
+	WrittenAt int64 `json:"wat,omitempty"`
+
+	// legacy is true for cookies sealed before cookie sessions had IDs,
+	// their ID is derived from the cookie value, see legacyCookieID, and
+	// must be written back to be kept once the cookie changes
+	legacy bool
+}
+
 // NewCookieOverseer creates an overseer from cookie options and a secret key
-// for use in encryption. Panic's on any errors that deal with cryptography.
+// for use in encryption. Panic's on any errors that deal with cryptography,
+// and if the cookie options break the rules checked by CookieOptions.Validate.
+//
+// The secret key is given the key ID DefaultKeyID, use
+// NewCookieOverseerKeyring instead to be able to rotate keys.
 func NewCookieOverseer(opts CookieOptions, secretKey []byte) *CookieOverseer {
-	if len(opts.Name) == 0 {
-		panic("cookie name must be provided")
-	}
-
-	block, err := aes.NewCipher(secretKey)
+	keyring, err := NewKeyring(DefaultKeyID, map[string][]byte{DefaultKeyID: secretKey})
 	if err != nil {
 		panic(err)
 	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
+
+	return NewCookieOverseerKeyring(opts, keyring)
+}
+
+// NewCookieOverseerKeyring creates an overseer from cookie options and a
+// keyring. Cookies are always sealed with the keyring's active key, cookies
+// sealed with an older key are sealed again with the active key the next
+// time they are written (on Set or ResetExpiry).
+func NewCookieOverseerKeyring(opts CookieOptions, keyring *Keyring) *CookieOverseer {
+	if err := opts.Validate(); err != nil {
 		panic(err)
 	}
+	if keyring == nil {
+		panic("keyring must be provided")
+	}
 
 	o := &CookieOverseer{
-		options:      opts,
-		secretKey:    secretKey,
-		gcmBlockMode: gcm,
+		options: opts,
+		keyring: keyring,
 	}
 
 	o.resetExpiryMiddleware.resetter = o
@@ -51,93 +102,398 @@ func NewCookieOverseer(opts CookieOptions, secretKey []byte) *CookieOverseer {
 
 // Get a value from the cookie overseer
 func (c *CookieOverseer) Get(w http.ResponseWriter, r *http.Request) (string, error) {
-	val, err := c.options.getCookieValue(w, r)
+	_, env, err := c.get(w, r)
 	if err != nil {
-		return "", errors.Wrap(err, "unable to get session value from cookie")
+		return "", err
 	}
 
-	return c.decode(val)
+	return env.Value, nil
 }
 
-// Set a value into the cookie overseer
+// Set a value into the cookie overseer. Values that are too large for a
+// single cookie are split across numbered cookies, see CookieOptions.ChunkSize.
+// Returns an error if the encoded value is larger than CookieOptions.MaxSize.
 func (c *CookieOverseer) Set(w http.ResponseWriter, r *http.Request, value string) error {
-	ev, err := c.encode(value)
-	if err != nil {
-		return errors.Wrap(err, "unable to encode session value into cookie")
+	resetRequestSession(r)
+
+	env := policyEnvelope{Value: value}
+
+	// Keep the ID and creation time of the existing session so that Set
+	// does not extend its absolute timeout. A cookie that can't be read,
+	// was revoked or violates the policy is simply replaced with a new
+	// session.
+	payload, prev, err := c.get(w, r)
+	created := err != nil
+	if created {
+		if payload, err = newCookiePayload(); err != nil {
+			return err
+		}
+	} else {
+		env.Created = prev.Created
 	}
 
-	w.(cookieWriter).SetCookie(c.options.makeCookie(ev))
+	if payload.Value, err = c.Policy.seal(r, env); err != nil {
+		return err
+	}
+
+	if err = c.write(w, r, payload); err != nil {
+		return err
+	}
+
+	if created {
+		fireHooks(c.Hooks, Event{Type: EventCreate, SessionID: payload.ID, Request: r})
+	}
 
 	return nil
 }
 
-// Del a value from the cookie overseer
+// Del a value from the cookie overseer. The session is revoked if the
+// overseer has Revocations.
 func (c *CookieOverseer) Del(w http.ResponseWriter, r *http.Request) error {
-	c.options.deleteCookie(w)
+	resetRequestSession(r)
+
+	payload, err := c.read(w, r)
+	c.options.deleteChunks(w, r, 0)
+
+	if err != nil {
+		return nil
+	}
+
+	if err := c.revoke(r.Context(), payload.ID); err != nil {
+		return err
+	}
+
+	fireHooks(c.Hooks, Event{Type: EventDelete, SessionID: payload.ID, Request: r})
+
 	return nil
 }
 
-// Regenerate for the cookie overseer will panic because cookie sessions
-// do not have session IDs, only values.
+// Regenerate issues a new ID for the session, keeping its value. The old
+// ID is revoked if the overseer has Revocations.
 func (c *CookieOverseer) Regenerate(w http.ResponseWriter, r *http.Request) error {
-	panic("cookie sessions do not use session ids")
+	payload, _, err := c.get(w, r)
+	if err != nil {
+		return err
+	}
+
+	next, err := newCookiePayload()
+	if err != nil {
+		return err
+	}
+	next.Value = payload.Value
+	if err = c.write(w, r, next); err != nil {
+		return err
+	}
+
+	if err := c.revoke(r.Context(), payload.ID); err != nil {
+		return err
+	}
+
+	fireHooks(c.Hooks, Event{Type: EventRegenerate, SessionID: next.ID, PreviousID: payload.ID, Request: r})
+
+	return nil
 }
 
-// SessionID for the cookie overseer will panic because cookie sessions
-// do not have session IDs, only values.
+// SessionID returns the ID of the session sealed in the cookie
 func (c *CookieOverseer) SessionID(w http.ResponseWriter, r *http.Request) (string, error) {
-	panic("cookie sessions do not use session ids")
+	payload, _, err := c.get(w, r)
+	if err != nil {
+		return "", err
+	}
+
+	// Keep the ID issued to an old cookie
+	if payload.legacy {
+		if err = c.write(w, r, payload); err != nil {
+			return "", err
+		}
+	}
+
+	return payload.ID, nil
+}
+
+// Revoke adds the session ID to the Revocations of the overseer, so that
+// the session is deleted the next time its cookie is used. It is used to
+// log out a session other than the one of the current request, for example
+// with an ID passed to a Hook. Panics if the overseer has no Revocations.
+func (c *CookieOverseer) Revoke(ctx context.Context, id string) error {
+	if c.Revocations == nil {
+		panic("cookie overseer has no revocations storer")
+	}
+
+	return c.revoke(ctx, id)
 }
 
 // ResetExpiry resets the age of the session to time.Now(), so that
 // MaxAge calculations are renewed
 func (c *CookieOverseer) ResetExpiry(w http.ResponseWriter, r *http.Request) error {
+	if c.Policy.enabled() {
+		return c.touch(w, r)
+	}
+
 	if c.options.MaxAge == 0 {
 		return nil
 	}
 
-	val, err := c.options.getCookieValue(w, r)
+	val, err := c.options.getChunkedValue(w, r)
 	if err != nil {
 		return errors.Wrap(err, "unable to get session value from cookie")
 	}
 
-	w.(cookieWriter).SetCookie(c.options.makeCookie(val))
+	// Re-seal cookies that were sealed with an old key while we're
+	// writing the cookie anyway, and cookies that must record when they
+	// were written for the ResetThreshold
+	if c.ResetThreshold != 0 {
+		payload, err := c.unseal(val)
+		if err != nil {
+			return err
+		}
+		return c.write(w, r, payload)
+	} else if c.keyring.isStale(val) {
+		pt, err := c.decode(val)
+		if err != nil {
+			return errors.Wrap(err, "unable to decode session value")
+		}
+		if val, err = c.encode(pt); err != nil {
+			return errors.Wrap(err, "unable to encode session value into cookie")
+		}
+	}
 
-	return nil
+	return c.options.setChunkedValue(w, r, val)
 }
 
-// encode into base64'd aes-gcm
-func (c *CookieOverseer) encode(plaintext string) (string, error) {
-	nonce := make([]byte, c.gcmBlockMode.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
-		return "", errors.Wrap(err, "failed to encode session cookie value")
+// resetDue returns true if the session cookie has used at least threshold
+// of its lifetime, the shortest of the cookie MaxAge and the Policy
+// IdleTimeout
+func (c *CookieOverseer) resetDue(w http.ResponseWriter, r *http.Request, threshold float64) (bool, error) {
+	payload, err := c.read(w, r)
+	if err != nil || payload.legacy {
+		return true, err
 	}
 
-	// Append ciphertext to the end of nonce so we have the nonce for decrypt
-	ciphertext := c.gcmBlockMode.Seal(nonce, nonce, []byte(plaintext), nil)
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	writtenAt := payload.WrittenAt
+	if writtenAt < payload.IssuedAt {
+		writtenAt = payload.IssuedAt
+	}
+
+	elapsed := time.Since(time.Unix(writtenAt, 0))
+	lifetime := shortestLifetime(c.options.MaxAge, c.Policy.IdleTimeout)
+	return resetIsDue(elapsed, lifetime, threshold), nil
 }
 
-// decode base64'd aes-gcm
-func (c *CookieOverseer) decode(ciphertext string) (string, error) {
-	ct, err := base64.StdEncoding.DecodeString(ciphertext)
+// touch checks the session against the Policy and resets the expiry of the
+// cookie. If the policy has an idle timeout the session is also marked as
+// used now, which means the cookie is sealed again.
+func (c *CookieOverseer) touch(w http.ResponseWriter, r *http.Request) error {
+	val, err := c.options.getChunkedValue(w, r)
 	if err != nil {
-		return "", nil
+		return errors.Wrap(err, "unable to get session value from cookie")
+	}
+
+	payload, env, err := c.open(w, r, val)
+	if err != nil {
+		return err
+	}
+
+	if c.Policy.IdleTimeout == 0 && c.ResetThreshold == 0 && !payload.legacy && !c.keyring.isStale(val) {
+		if c.options.MaxAge == 0 {
+			return nil
+		}
+		return c.options.setChunkedValue(w, r, val)
+	}
+
+	if payload.Value, err = c.Policy.seal(r, env); err != nil {
+		return err
 	}
 
-	if len(ct) <= c.gcmBlockMode.NonceSize() {
-		return "", errors.New("failed to decode session cookie value")
+	return c.write(w, r, payload)
+}
+
+// get reads the session from the cookies and checks it against the
+// Revocations and the Policy
+func (c *CookieOverseer) get(w http.ResponseWriter, r *http.Request) (cookiePayload, policyEnvelope, error) {
+	val, err := c.options.getChunkedValue(w, r)
+	if err != nil {
+		return cookiePayload{}, policyEnvelope{}, errors.Wrap(err, "unable to get session value from cookie")
 	}
 
-	// Nonce comes from the first n bytes (n = NonceSize)
-	plaintext, err := c.gcmBlockMode.Open(nil,
-		ct[:c.gcmBlockMode.NonceSize()],
-		ct[c.gcmBlockMode.NonceSize():],
-		nil)
+	return c.open(w, r, val)
+}
 
+// open decodes the cookie value and checks it against the Revocations and
+// the Policy. Sessions that are revoked or violate the policy are deleted.
+func (c *CookieOverseer) open(w http.ResponseWriter, r *http.Request, val string) (cookiePayload, policyEnvelope, error) {
+	payload, err := c.unseal(val)
+	if err != nil {
+		return payload, policyEnvelope{}, err
+	}
+
+	if err = c.checkRevoked(r.Context(), payload); err == nil {
+		var env policyEnvelope
+		if env, err = c.Policy.open(r, payload.Value); err == nil {
+			return payload, env, nil
+		}
+	}
+
+	if IsNoSessionError(err) {
+		c.options.deleteChunks(w, r, 0)
+		fireHooks(c.Hooks, Event{Type: EventInvalidate, SessionID: payload.ID, Request: r, Err: err})
+	}
+
+	return payload, policyEnvelope{}, err
+}
+
+// read decodes the session cookie without checking it
+func (c *CookieOverseer) read(w http.ResponseWriter, r *http.Request) (cookiePayload, error) {
+	val, err := c.options.getChunkedValue(w, r)
+	if err != nil {
+		return cookiePayload{}, errors.Wrap(err, "unable to get session value from cookie")
+	}
+
+	return c.unseal(val)
+}
+
+// write seals the payload into the session cookie
+func (c *CookieOverseer) write(w http.ResponseWriter, r *http.Request, payload cookiePayload) error {
+	val, err := c.seal(payload)
+	if err != nil {
+		return err
+	}
+
+	return c.options.setChunkedValue(w, r, val)
+}
+
+// seal encodes the payload into the value of the session cookie
+func (c *CookieOverseer) seal(payload cookiePayload) (string, error) {
+	payload.WrittenAt = time.Now().Unix()
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to marshal session cookie payload")
+	}
+
+	val, err := c.encode(cookiePayloadPrefix + string(b))
+	if err != nil {
+		return "", errors.Wrap(err, "unable to encode session value into cookie")
+	}
+
+	return val, nil
+}
+
+// checkValue returns an error if value is too large to be stored in the
+// session cookies, see CookieOptions.MaxSize. The payload of a new session
+// is sealed as large as the one of an existing session.
+func (c *CookieOverseer) checkValue(r *http.Request, value string) error {
+	payload, err := newCookiePayload()
+	if err != nil {
+		return err
+	}
+
+	if payload.Value, err = c.Policy.seal(r, policyEnvelope{Value: value}); err != nil {
+		return err
+	}
+
+	val, err := c.seal(payload)
+	if err != nil {
+		return err
+	}
+
+	return c.options.checkSize(val)
+}
+
+// unseal decodes the cookie value into its payload. Cookies sealed before
+// cookie sessions had IDs are given the ID derived from their value, so that
+// they can be revoked like the others.
+func (c *CookieOverseer) unseal(val string) (cookiePayload, error) {
+	pt, err := c.decode(val)
+	if err != nil {
+		return cookiePayload{}, err
+	}
+
+	if !strings.HasPrefix(pt, cookiePayloadPrefix) {
+		payload := cookiePayload{
+			ID:       legacyCookieID(val),
+			IssuedAt: time.Now().Unix(),
+			Value:    pt,
+			legacy:   true,
+		}
+		return payload, nil
+	}
+
+	var payload cookiePayload
+	if err := json.Unmarshal([]byte(pt[len(cookiePayloadPrefix):]), &payload); err != nil {
+		return payload, errors.Wrap(err, "unable to unmarshal session cookie payload")
+	}
+
+	return payload, nil
+}
+
+// checkRevoked returns a wrapped errNoSession error if the session
+// is in the Revocations
+func (c *CookieOverseer) checkRevoked(ctx context.Context, payload cookiePayload) error {
+	if c.Revocations == nil {
+		return nil
+	}
+
+	_, err := NewContextStorer(c.Revocations).GetContext(ctx, payload.ID)
+	if IsNoSessionError(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "unable to check session revocation")
+	}
+
+	return errors.Wrap(errNoSession{}, "session was revoked")
+}
+
+// revoke adds the session ID to the Revocations, if the overseer has them
+func (c *CookieOverseer) revoke(ctx context.Context, id string) error {
+	if c.Revocations == nil {
+		return nil
+	}
+
+	revokedAt := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := NewContextStorer(c.Revocations).SetContext(ctx, id, revokedAt); err != nil {
+		return errors.Wrap(err, "unable to revoke session")
+	}
+
+	return nil
+}
+
+// legacyCookieID returns the session ID of a cookie sealed before cookie
+// sessions had IDs: the hash of the cookie value, in the format of the
+// RandomIDGenerator. Every copy of the cookie has the same ID, so revoking it
+// revokes all of them, and the ID is kept once the cookie is written back.
+func legacyCookieID(val string) string {
+	sum := sha256.Sum256([]byte(val))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// newCookiePayload returns an empty payload with a new session ID
+func newCookiePayload() (cookiePayload, error) {
+	id, err := RandomIDGenerator{}.NewID()
+	payload := cookiePayload{
+		ID:       id,
+		IssuedAt: time.Now().Unix(),
+	}
+
+	return payload, err
+}
+
+// encode seals the plaintext with the active key of the keyring
+func (c *CookieOverseer) encode(plaintext string) (string, error) {
+	ct, err := c.keyring.seal(plaintext, []byte(c.options.Name))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode session cookie value")
+	}
+
+	return ct, nil
+}
+
+// decode opens a value sealed by any key of the keyring
+func (c *CookieOverseer) decode(ciphertext string) (string, error) {
+	pt, _, err := c.keyring.open(ciphertext, []byte(c.options.Name))
 	if err != nil {
-		return "", errors.Wrap(err, "unable to open gcm block mode")
+		return "", errors.Wrap(err, "failed to decode session cookie value")
 	}
 
-	return string(plaintext), nil
+	return pt, nil
 }
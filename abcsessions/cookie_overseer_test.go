@@ -1,10 +1,16 @@
 package abcsessions
 
 import (
-	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 )
@@ -28,12 +34,12 @@ func TestCookieOverseerNew(t *testing.T) {
 		t.Error("c should not be nil")
 	}
 
-	if c.gcmBlockMode == nil {
-		t.Error("block mode should be instantiated")
+	if c.keyring == nil {
+		t.Fatal("keyring should be instantiated")
 	}
 
-	if bytes.Compare(c.secretKey, testCookieKey) != 0 {
-		t.Error("key was not copied")
+	if c.keyring.ActiveKeyID() != DefaultKeyID {
+		t.Errorf("expected active key %q, got %q", DefaultKeyID, c.keyring.ActiveKeyID())
 	}
 }
 
@@ -231,3 +237,453 @@ func TestCookieOverseerResetExpiry(t *testing.T) {
 		t.Errorf("expected paths to match, got %v and %v", newCookie.Path, oldCookie.Path)
 	}
 }
+
+func TestCookieOverseerKeyRotation(t *testing.T) {
+	t.Parallel()
+
+	opts := NewCookieOptions()
+	opts.MaxAge = time.Hour
+
+	old := NewCookieOverseer(opts, testCookieKey)
+	ct, err := old.encode("hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring, err := NewKeyring("new", map[string][]byte{
+		DefaultKeyID: testCookieKey,
+		"new":        []byte("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCookieOverseerKeyring(opts, keyring)
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: opts.Name, Value: ct})
+
+	val, err := c.Get(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "hello world" {
+		t.Error("value was wrong:", val)
+	}
+
+	// Writing the cookie again re-seals it with the active key
+	if err = c.ResetExpiry(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	resealed := w.cookies[opts.Name].Value
+	if id, _ := sealedKeyID(resealed); id != "new" {
+		t.Errorf("expected cookie to be sealed with key %q, got %q", "new", id)
+	}
+	if val, err = c.Get(w, r); err != nil {
+		t.Error(err)
+	} else if val != "hello world" {
+		t.Error("value was wrong:", val)
+	}
+
+	// Cookies sealed with the active key are left alone
+	if err = c.ResetExpiry(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if w.cookies[opts.Name].Value != resealed {
+		t.Error("did not expect an up to date cookie to be sealed again")
+	}
+}
+
+func TestCookieOverseerLegacyCookie(t *testing.T) {
+	t.Parallel()
+
+	// Seal a cookie the way single key overseers did before key ids existed
+	block, err := aes.NewCipher(testCookieKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	legacy := base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte("hello world"), nil))
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: c.options.Name, Value: legacy})
+
+	val, err := c.Get(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "hello world" {
+		t.Error("value was wrong:", val)
+	}
+}
+
+func TestCookieOverseerChunking(t *testing.T) {
+	t.Parallel()
+
+	opts := NewCookieOptions()
+	opts.ChunkSize = 200
+	opts.MaxSize = 2000
+
+	c := NewCookieOverseer(opts, testCookieKey)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+
+	big := strings.Repeat("a", 800)
+	if err := c.Set(w, r, big); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(w.cookies) < 5 {
+		t.Fatalf("expected the value to be split across at least 5 cookies, got %d", len(w.cookies))
+	}
+	for name, cookie := range w.cookies {
+		if len(cookie.Value) > opts.ChunkSize {
+			t.Errorf("cookie %s is %d bytes, over the chunk size", name, len(cookie.Value))
+		}
+	}
+	if _, ok := w.cookies["id_1"]; !ok {
+		t.Error("expected a cookie named id_1")
+	}
+
+	val, err := c.Get(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != big {
+		t.Error("value was wrong:", val)
+	}
+
+	// Send the chunks back in a new request and shrink the value
+	r = httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range w.cookies {
+		r.AddCookie(cookie)
+	}
+	chunks := len(w.cookies)
+	w = newSessionsResponseWriter(httptest.NewRecorder())
+
+	val, err = c.Get(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != big {
+		t.Error("value was wrong:", val)
+	}
+
+	if err = c.Set(w, r, "small"); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.cookies) != chunks {
+		t.Errorf("expected stale chunks to be deleted, got %d cookies", len(w.cookies))
+	}
+	for name, cookie := range w.cookies {
+		if name == opts.Name {
+			if cookie.MaxAge < 0 {
+				t.Error("expected the first chunk to be set")
+			}
+		} else if cookie.MaxAge != -1 {
+			t.Errorf("expected stale chunk %s to be deleted", name)
+		}
+	}
+
+	if val, err = c.Get(w, r); err != nil {
+		t.Error(err)
+	} else if val != "small" {
+		t.Error("value was wrong:", val)
+	}
+
+	// Del deletes every chunk that was sent in the request
+	w = newSessionsResponseWriter(httptest.NewRecorder())
+	if err = c.Del(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.cookies) != chunks {
+		t.Errorf("expected %d deleted cookies, got %d", chunks, len(w.cookies))
+	}
+	for name, cookie := range w.cookies {
+		if cookie.MaxAge != -1 {
+			t.Errorf("expected chunk %s to be deleted", name)
+		}
+	}
+}
+
+func TestCookieOverseerMaxSize(t *testing.T) {
+	t.Parallel()
+
+	opts := NewCookieOptions()
+	opts.ChunkSize = 100
+	opts.MaxSize = 300
+
+	c := NewCookieOverseer(opts, testCookieKey)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+
+	if err := c.Set(w, r, strings.Repeat("a", 300)); err == nil {
+		t.Error("expected an error when going over the max size")
+	}
+	if len(w.cookies) != 0 {
+		t.Errorf("expected no cookies to be set, got %d", len(w.cookies))
+	}
+}
+
+func TestCookieOverseerSessionID(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+
+	if _, err := c.SessionID(w, r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+
+	if err := c.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := c.SessionID(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(RandomIDGenerator{}).ValidID(id) {
+		t.Errorf("expected a session id, got %q", id)
+	}
+
+	// Set keeps the id of the session
+	if err := c.Set(w, r, "world"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.SessionID(w, r); got != id {
+		t.Errorf("expected id %q, got %q", id, got)
+	}
+
+	if err := c.Regenerate(w, r); err != nil {
+		t.Fatal(err)
+	}
+	newID, err := c.SessionID(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newID == id || !(RandomIDGenerator{}).ValidID(newID) {
+		t.Errorf("expected a new session id, got %q", newID)
+	}
+	if val, err := c.Get(w, r); err != nil || val != "world" {
+		t.Errorf("expected the value to be kept, got %q: %v", val, err)
+	}
+}
+
+func TestCookieOverseerSessionIDLegacy(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+
+	ct, err := c.encode("hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: c.options.Name, Value: ct})
+
+	id, err := c.SessionID(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.SessionID(w, r); got != id {
+		t.Errorf("expected the issued id %q to be kept, got %q", id, got)
+	}
+	if val, err := c.Get(w, r); err != nil || val != "hello world" {
+		t.Errorf("expected %q, got %q: %v", "hello world", val, err)
+	}
+}
+
+func TestCookieOverseerRevocations(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	c.Revocations, _ = NewDefaultMemoryStorer()
+
+	var events []Event
+	c.Hooks = recordHooks(&events)
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+
+	if err := c.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := c.SessionID(w, r)
+	stolen := w.cookies[c.options.Name]
+
+	// Regenerating revokes the old id
+	if err := c.Regenerate(w, r); err != nil {
+		t.Fatal(err)
+	}
+	replay := httptest.NewRequest("GET", "/", nil)
+	replay.AddCookie(stolen)
+	if _, err := c.Get(newSessionsResponseWriter(httptest.NewRecorder()), replay); !IsNoSessionError(err) {
+		t.Errorf("expected no session error for the old cookie, got: %v", err)
+	}
+
+	// Deleting revokes the session
+	newID, _ := c.SessionID(w, r)
+	deleted := w.cookies[c.options.Name]
+	if err := c.Del(w, r); err != nil {
+		t.Fatal(err)
+	}
+	replay = httptest.NewRequest("GET", "/", nil)
+	replay.AddCookie(deleted)
+	if _, err := c.Get(newSessionsResponseWriter(httptest.NewRecorder()), replay); !IsNoSessionError(err) {
+		t.Errorf("expected no session error for the deleted cookie, got: %v", err)
+	}
+
+	// Any session can be revoked by id
+	if err := c.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	lastID, _ := c.SessionID(w, r)
+	if err := c.Revoke(r.Context(), lastID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(w, r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error for the revoked session, got: %v", err)
+	}
+	if cookie := w.GetCookie(c.options.Name); cookie == nil || cookie.MaxAge >= 0 {
+		t.Error("expected the revoked session cookie to be deleted")
+	}
+
+	for _, key := range []string{id, newID, lastID} {
+		if _, err := c.Revocations.Get(key); err != nil {
+			t.Errorf("expected %s to be revoked: %v", key, err)
+		}
+	}
+
+	want := []EventType{EventCreate, EventRegenerate, EventInvalidate, EventDelete, EventInvalidate, EventCreate, EventInvalidate}
+	if got := eventTypes(events); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected events %v, got %v", want, got)
+	}
+	if events[1].PreviousID != id || events[1].SessionID != newID {
+		t.Errorf("unexpected regenerate event: %#v", events[1])
+	}
+}
+
+func TestCookieOverseerRevocationsLegacy(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	c.Revocations, _ = NewDefaultMemoryStorer()
+
+	ct, err := c.encode("hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := &http.Cookie{Name: c.options.Name, Value: ct}
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(legacy)
+
+	// Every read of the cookie has the same id
+	id, err := c.SessionID(newSessionsResponseWriter(httptest.NewRecorder()), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.SessionID(newSessionsResponseWriter(httptest.NewRecorder()), r); got != id {
+		t.Errorf("expected the id %q of the old cookie to be stable, got %q", id, got)
+	}
+
+	if err = c.Del(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Revocations.Get(id); err != nil {
+		t.Errorf("expected %s to be revoked: %v", id, err)
+	}
+
+	// A copy of the old cookie can't be replayed after the logout
+	replay := httptest.NewRequest("GET", "/", nil)
+	replay.AddCookie(legacy)
+	if _, err = c.Get(newSessionsResponseWriter(httptest.NewRecorder()), replay); !IsNoSessionError(err) {
+		t.Errorf("expected no session error for the old cookie, got: %v", err)
+	}
+}
+
+func TestCookieOverseerResetThreshold(t *testing.T) {
+	t.Parallel()
+
+	opts := NewCookieOptions()
+	opts.MaxAge = time.Hour
+	c := NewCookieOverseer(opts, testCookieKey)
+	c.ResetThreshold = 0.5
+
+	hf := c.MiddlewareWithReset(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// serve returns the session cookie set by the middleware, if any
+	serve := func(cookie *http.Cookie) *http.Cookie {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		hf.ServeHTTP(rec, r)
+
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == opts.Name {
+				return c
+			}
+		}
+		return nil
+	}
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	if err := c.Set(w, httptest.NewRequest("GET", "/", nil), "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh cookie is not written again
+	if got := serve(w.cookies[opts.Name]); got != nil {
+		t.Errorf("expected no cookie, got %#v", got)
+	}
+
+	// A cookie written more than half an hour ago is
+	payload, err := newCookiePayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload.Value = "hello"
+	payload.IssuedAt = time.Now().Add(-2 * time.Hour).Unix()
+	payload.WrittenAt = time.Now().Add(-40 * time.Minute).Unix()
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := c.encode(cookiePayloadPrefix + string(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := serve(&http.Cookie{Name: opts.Name, Value: val})
+	if got == nil {
+		t.Fatal("expected the cookie to be written")
+	}
+
+	refreshed, err := c.unseal(got.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.ID != payload.ID || refreshed.Value != "hello" {
+		t.Errorf("expected the session to be kept, got %#v", refreshed)
+	}
+	if time.Since(time.Unix(refreshed.WrittenAt, 0)) > time.Minute {
+		t.Errorf("expected the written time to be reset, got %d", refreshed.WrittenAt)
+	}
+}
@@ -1,9 +1,13 @@
 package abcsessions
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,8 +15,35 @@ import (
 	"github.com/friendsofgo/errors"
 )
 
+const (
+	// diskOwnersFolder holds a file for each owner listing its session ids
+	diskOwnersFolder = "owners"
+	// diskSessionOwnersFolder holds a file for each owned session
+	// containing its owner
+	diskSessionOwnersFolder = "session-owners"
+	// diskLockFile is the file locked by every process using the folder
+	diskLockFile = ".lock"
+	// diskTempPrefix is the prefix of files that are being written
+	diskTempPrefix = ".tmp-"
+	// diskShardLen is the number of characters of the session id
+	// used as the name of its shard folder
+	diskShardLen = 2
+	// diskMaxKeyLen is the length of the longest session id
+	diskMaxKeyLen = 128
+)
+
 // DiskStorer is a session storer implementation for saving sessions
 // to disk.
+//
+// Sessions are stored in shard folders named after the first two
+// characters of the session id, so that no single folder grows too large.
+// Session ids are used as file names, so the folder should be on a case
+// sensitive file system: ids that only differ in case share a file otherwise.
+// Files are written to a temporary file first and renamed over the session
+// file, so a crash never leaves a partially written session behind.
+// Several processes can share the same folder: on unix systems every
+// operation takes an advisory lock (flock) on a lock file in the folder.
+// On other systems the storer is only safe within a single process.
 type DiskStorer struct {
 	// Path to the session files folder
 	folderPath string
@@ -21,8 +52,10 @@ type DiskStorer struct {
 	maxAge time.Duration
 	// How often the disk should be polled for maxAge expired sessions
 	cleanInterval time.Duration
-	// Disk storage mutex
+	// Disk storage mutex, the file lock only protects against other processes
 	mut sync.RWMutex
+	// expired are called with the ids of cleaned sessions
+	expired []*expiryListener
 	// wg is used to manage the cleaner loop
 	wg sync.WaitGroup
 	// quit channel for exiting the cleaner loop
@@ -70,15 +103,18 @@ func NewDiskStorer(folderPath string, maxAge, cleanInterval time.Duration) (*Dis
 
 // All keys in the disk store
 func (d *DiskStorer) All() ([]string, error) {
-	files, err := ioutil.ReadDir(d.folderPath)
+	unlock, err := d.rlock()
 	if err != nil {
-		return []string{}, errors.Wrapf(err, "unable to read directory: %s", d.folderPath)
+		return nil, err
 	}
+	defer unlock()
 
-	sessions := make([]string, len(files))
-
-	for i := 0; i < len(files); i++ {
-		sessions[i] = files[i].Name()
+	var sessions []string
+	err = d.walk(func(key, filePath string, file os.FileInfo) {
+		sessions = append(sessions, key)
+	})
+	if err != nil {
+		return []string{}, err
 	}
 
 	return sessions, nil
@@ -87,22 +123,31 @@ func (d *DiskStorer) All() ([]string, error) {
 // Get returns the value string saved in the session pointed to by the
 // session id key.
 func (d *DiskStorer) Get(key string) (value string, err error) {
-	if !validKey(key) {
+	if !validDiskKey(key) {
 		return "", errNoSession{}
 	}
 
-	filePath := path.Join(d.folderPath, key)
+	unlock, err := d.rlock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
 
-	d.mut.RLock()
-	defer d.mut.RUnlock()
+	return d.read(key)
+}
 
-	_, err = os.Stat(filePath)
+// read returns the value of the session id key. The caller must hold
+// the lock.
+func (d *DiskStorer) read(key string) (string, error) {
+	filePath, err := d.findSession(key)
 	if err != nil {
-		return "", errors.Wrapf(err, "unable to stat session file: %s", filePath)
+		return "", err
 	}
 
 	contents, err := ioutil.ReadFile(filePath)
-	if err != nil {
+	if os.IsNotExist(err) {
+		return "", errNoSession{}
+	} else if err != nil {
 		return "", errors.Wrapf(err, "unable to read file: %s", filePath)
 	}
 
@@ -111,37 +156,404 @@ func (d *DiskStorer) Get(key string) (value string, err error) {
 
 // Set saves the value string to the session pointed to by the session id key.
 func (d *DiskStorer) Set(key, value string) error {
-	if !validKey(key) {
+	if !validDiskKey(key) {
 		return errNoSession{}
 	}
 
-	filePath := path.Join(d.folderPath, key)
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	d.mut.Lock()
-	defer d.mut.Unlock()
+	return d.write(key, value)
+}
+
+// write saves the value of the session id key. The caller must hold the
+// write lock.
+func (d *DiskStorer) write(key, value string) error {
+	filePath := d.sessionPath(key)
+	if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+		return errors.Wrapf(err, "unable to make directory: %s", path.Dir(filePath))
+	}
+
+	if err := writeFileAtomic(filePath, []byte(value)); err != nil {
+		return err
+	}
+
+	// Sessions written before the folder was sharded are moved
+	return removeIfExists(d.legacySessionPath(key))
+}
+
+// GetVersioned returns the value of the session pointed to by the session
+// id key along with its version
+func (d *DiskStorer) GetVersioned(ctx context.Context, key string) (string, string, error) {
+	value, err := d.GetContext(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	return value, valueVersion(value), nil
+}
+
+// TTL returns the time left before the session pointed to by the session
+// id key expires, see TTLStorer
+func (d *DiskStorer) TTL(ctx context.Context, key string) (time.Duration, time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	if !validDiskKey(key) {
+		return 0, 0, errNoSession{}
+	}
 
-	return ioutil.WriteFile(filePath, []byte(value), 0600)
+	unlock, err := d.rlock()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unlock()
+
+	filePath, err := d.findSession(key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	file, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return 0, 0, errNoSession{}
+	} else if err != nil {
+		return 0, 0, errors.Wrapf(err, "unable to stat session file: %s", filePath)
+	}
+	if d.maxAge == 0 {
+		return 0, 0, nil
+	}
+
+	expires := times.Get(file).AccessTime().Add(d.maxAge)
+	return remainingTTL(expires), d.maxAge, nil
+}
+
+// CompareAndSet saves the value string to the session pointed to by the
+// session id key if it is still at version, see VersionedStorer. Other
+// processes sharing the folder are locked out while the version is checked.
+func (d *DiskStorer) CompareAndSet(ctx context.Context, key, value, version string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !validDiskKey(key) {
+		return errNoSession{}
+	}
+
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := d.read(key)
+	if IsNoSessionError(err) {
+		if len(version) != 0 {
+			return errVersionConflict{}
+		}
+	} else if err != nil {
+		return err
+	} else if valueVersion(current) != version {
+		return errVersionConflict{}
+	}
+
+	return d.write(key, value)
 }
 
 // Del the session pointed to by the session id key and remove it.
 func (d *DiskStorer) Del(key string) error {
-	if !validKey(key) {
+	if !validDiskKey(key) {
 		return errNoSession{}
 	}
 
-	filePath := path.Join(d.folderPath, key)
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	d.mut.Lock()
-	defer d.mut.Unlock()
+	for _, filePath := range []string{d.sessionPath(key), d.legacySessionPath(key)} {
+		if err = removeIfExists(filePath); err != nil {
+			return err
+		}
+	}
+
+	return d.delOwnerIndex(key)
+}
 
-	_, err := os.Stat(filePath)
+// SetOwner attaches the session pointed to by the session id key to owner
+func (d *DiskStorer) SetOwner(key, owner string) error {
+	if !validDiskKey(key) {
+		return errNoSession{}
+	}
+
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err = d.findSession(key); err != nil {
+		return err
+	}
+
+	if err = d.delOwnerIndex(key); err != nil {
+		return err
+	}
+
+	for _, folder := range []string{diskOwnersFolder, diskSessionOwnersFolder} {
+		folderPath := path.Join(d.folderPath, folder)
+		if err = os.MkdirAll(folderPath, 0755); err != nil {
+			return errors.Wrapf(err, "unable to make directory: %s", folderPath)
+		}
+	}
+
+	ids, err := d.readOwner(owner)
+	if err != nil {
+		return err
+	}
+	if err = d.writeOwner(owner, append(ids, key)); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(d.sessionOwnerPath(key), []byte(owner))
+}
+
+// Owner returns the owner of the session pointed to by the session id key
+func (d *DiskStorer) Owner(key string) (string, error) {
+	if !validDiskKey(key) {
+		return "", errNoSession{}
+	}
+
+	filePath := d.sessionOwnerPath(key)
+
+	unlock, err := d.rlock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	owner, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrapf(err, "unable to read session owner file: %s", filePath)
+	}
+
+	return string(owner), nil
+}
+
+// OwnerSessions returns the session ids of all sessions of owner
+func (d *DiskStorer) OwnerSessions(owner string) ([]string, error) {
+	unlock, err := d.rlock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return d.readOwner(owner)
+}
+
+// DelOwner deletes all sessions of owner
+func (d *DiskStorer) DelOwner(owner string) error {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	ids, err := d.readOwner(owner)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		for _, filePath := range []string{d.sessionPath(id), d.legacySessionPath(id), d.sessionOwnerPath(id)} {
+			if err = removeIfExists(filePath); err != nil {
+				return err
+			}
+		}
+	}
+
+	return d.writeOwner(owner, nil)
+}
+
+// delOwnerIndex removes the session id key from the owner index.
+// The caller must hold the write lock.
+func (d *DiskStorer) delOwnerIndex(key string) error {
+	filePath := d.sessionOwnerPath(key)
+
+	owner, err := ioutil.ReadFile(filePath)
 	if os.IsNotExist(err) {
 		return nil
 	} else if err != nil {
-		return errors.Wrapf(err, "unable to stat session file: %s", filePath)
+		return errors.Wrapf(err, "unable to read session owner file: %s", filePath)
 	}
 
-	return os.Remove(filePath)
+	ids, err := d.readOwner(string(owner))
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		if id == key {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if err = d.writeOwner(string(owner), ids); err != nil {
+		return err
+	}
+
+	return removeIfExists(filePath)
+}
+
+// readOwner returns the session ids in the index file of owner
+func (d *DiskStorer) readOwner(owner string) ([]string, error) {
+	filePath := d.ownerPath(owner)
+
+	contents, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "unable to read owner file: %s", filePath)
+	}
+
+	return strings.Fields(string(contents)), nil
+}
+
+// writeOwner replaces the session ids in the index file of owner,
+// removing the file if there are none
+func (d *DiskStorer) writeOwner(owner string, ids []string) error {
+	filePath := d.ownerPath(owner)
+
+	if len(ids) == 0 {
+		return removeIfExists(filePath)
+	}
+
+	return writeFileAtomic(filePath, []byte(strings.Join(ids, "\n")+"\n"))
+}
+
+// ownerPath returns the path of the index file of owner. Owners are
+// hashed because they are not necessarily valid file names.
+func (d *DiskStorer) ownerPath(owner string) string {
+	sum := sha256.Sum256([]byte(owner))
+	return path.Join(d.folderPath, diskOwnersFolder, hex.EncodeToString(sum[:]))
+}
+
+// sessionOwnerPath returns the path of the file holding the owner of
+// the session id key
+func (d *DiskStorer) sessionOwnerPath(key string) string {
+	return path.Join(d.folderPath, diskSessionOwnersFolder, key)
+}
+
+// sessionPath returns the path of the file of the session id key
+func (d *DiskStorer) sessionPath(key string) string {
+	return path.Join(d.folderPath, key[:diskShardLen], key)
+}
+
+// legacySessionPath returns the path the file of the session id key had
+// before sessions were sharded
+func (d *DiskStorer) legacySessionPath(key string) string {
+	return path.Join(d.folderPath, key)
+}
+
+// findSession returns the path of the file of the session id key,
+// which is in its shard folder unless it was written before sessions
+// were sharded. It returns an errNoSession error if there is no file.
+func (d *DiskStorer) findSession(key string) (string, error) {
+	for _, filePath := range []string{d.sessionPath(key), d.legacySessionPath(key)} {
+		_, err := os.Stat(filePath)
+		if err == nil {
+			return filePath, nil
+		} else if !os.IsNotExist(err) {
+			return "", errors.Wrapf(err, "unable to stat session file: %s", filePath)
+		}
+	}
+
+	return "", errNoSession{}
+}
+
+// walk calls fn for every session file, in the shard folders and
+// the unsharded files at the root of the folder
+func (d *DiskStorer) walk(fn func(key, filePath string, file os.FileInfo)) error {
+	files, err := ioutil.ReadDir(d.folderPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read directory: %s", d.folderPath)
+	}
+
+	for _, file := range files {
+		if !file.IsDir() {
+			if validDiskKey(file.Name()) {
+				fn(file.Name(), path.Join(d.folderPath, file.Name()), file)
+			}
+			continue
+		}
+
+		// Skip the owner index folders
+		if !isDiskShard(file.Name()) {
+			continue
+		}
+
+		shardPath := path.Join(d.folderPath, file.Name())
+		shard, err := ioutil.ReadDir(shardPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "unable to read directory: %s", shardPath)
+		}
+
+		for _, sessFile := range shard {
+			// Skip temporary files
+			if sessFile.IsDir() || !validDiskKey(sessFile.Name()) {
+				continue
+			}
+			fn(sessFile.Name(), path.Join(shardPath, sessFile.Name()), sessFile)
+		}
+	}
+
+	return nil
+}
+
+// AllContext is All that fails early if ctx is already done
+func (d *DiskStorer) AllContext(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.All()
+}
+
+// GetContext is Get that fails early if ctx is already done
+func (d *DiskStorer) GetContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return d.Get(key)
+}
+
+// SetContext is Set that fails early if ctx is already done
+func (d *DiskStorer) SetContext(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.Set(key, value)
+}
+
+// DelContext is Del that fails early if ctx is already done
+func (d *DiskStorer) DelContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.Del(key)
+}
+
+// ResetExpiryContext is ResetExpiry that fails early if ctx is already done
+func (d *DiskStorer) ResetExpiryContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.ResetExpiry(key)
 }
 
 // StopCleaner stops the cleaner go routine
@@ -152,13 +564,22 @@ func (d *DiskStorer) StopCleaner() {
 
 // ResetExpiry resets the expiry of the key
 func (d *DiskStorer) ResetExpiry(key string) error {
-	if !validKey(key) {
+	if !validDiskKey(key) {
 		return errNoSession{}
 	}
 
-	filePath := path.Join(d.folderPath, key)
-	nowTime := time.Now().UTC()
+	unlock, err := d.rlock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
+	filePath, err := d.findSession(key)
+	if err != nil {
+		return err
+	}
+
+	nowTime := time.Now().UTC()
 	return os.Chtimes(filePath, nowTime, nowTime)
 }
 
@@ -186,13 +607,15 @@ func (d *DiskStorer) cleanerLoop() {
 
 	t, c := timerTestHarness(d.cleanInterval)
 
-	select {
-	case <-c:
-		d.Clean()
-		t.Reset(d.cleanInterval)
-	case <-d.quit:
-		t.Stop()
-		return
+	for {
+		select {
+		case <-c:
+			d.Clean()
+			t.Reset(d.cleanInterval)
+		case <-d.quit:
+			t.Stop()
+			return
+		}
 	}
 }
 
@@ -202,38 +625,158 @@ func (d *DiskStorer) cleanerLoop() {
 func (d *DiskStorer) Clean() {
 	t := time.Now().UTC()
 
-	files, err := ioutil.ReadDir(d.folderPath)
-
+	expired := make(map[string]string)
+	err := d.walk(func(key, filePath string, file os.FileInfo) {
+		if d.isExpired(file, t) {
+			expired[key] = filePath
+		}
+	})
 	if err != nil {
 		panic(err)
 	}
 
-	for _, file := range files {
-		tspec := times.Get(file)
-
-		// File is expired
-		if tspec.AccessTime().UTC().UTC().Add(d.maxAge).Before(t) {
-			filePath := path.Join(d.folderPath, file.Name())
-
-			d.mut.Lock()
-			_, err := os.Stat(filePath)
-			// If the file has been deleted manually from the server
-			// in between the time we read the directory and now, it will
-			// fail here with a ErrNotExist. If so, continue gracefully.
-			// It would be innefficient to hold a lock for the duration of
-			// the loop, so we only lock when we find an expired file.
-			if os.IsNotExist(err) {
-				d.mut.Unlock()
-				continue
-			} else if err != nil {
-				panic(err)
-			}
+	d.mut.RLock()
+	notify := d.expired
+	d.mut.RUnlock()
 
-			err = os.Remove(filePath)
-			d.mut.Unlock()
-			if err != nil {
-				panic(err)
-			}
+	// It would be innefficient to hold a lock for the duration of
+	// the walk, so we only lock when we remove an expired file.
+	for key, filePath := range expired {
+		unlock, err := d.lock()
+		if err != nil {
+			panic(err)
+		}
+
+		cleaned, err := d.cleanFile(key, filePath, t)
+		unlock()
+		if err != nil {
+			panic(err)
+		}
+
+		if cleaned {
+			notifyExpired(notify, []string{key})
 		}
 	}
 }
+
+// NotifyExpired registers fn to be called with the id of every session
+// removed by the cleaner of this process
+func (d *DiskStorer) NotifyExpired(fn func(key string)) func() {
+	return addExpiryListener(&d.mut, &d.expired, fn)
+}
+
+// cleanFile removes an expired session file and returns true if it did.
+// The caller must hold the write lock.
+func (d *DiskStorer) cleanFile(key, filePath string, t time.Time) (bool, error) {
+	file, err := os.Stat(filePath)
+	// If the file has been deleted (or moved to its shard) in between the
+	// time we read the directory and now, it will fail here with a
+	// ErrNotExist. If so, continue gracefully.
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// The session may have been used since we read the directory
+	if !d.isExpired(file, t) {
+		return false, nil
+	}
+
+	if err = os.Remove(filePath); err != nil {
+		return false, err
+	}
+
+	return true, d.delOwnerIndex(key)
+}
+
+// isExpired returns true if the session file was last accessed more
+// than maxAge before t
+func (d *DiskStorer) isExpired(file os.FileInfo, t time.Time) bool {
+	tspec := times.Get(file)
+	return tspec.AccessTime().UTC().Add(d.maxAge).Before(t)
+}
+
+// lock takes the write lock of the storer, both within this process
+// and across the processes sharing the folder
+func (d *DiskStorer) lock() (unlock func(), err error) {
+	d.mut.Lock()
+
+	f, err := lockFile(path.Join(d.folderPath, diskLockFile), true)
+	if err != nil {
+		d.mut.Unlock()
+		return nil, errors.Wrap(err, "unable to lock session folder")
+	}
+
+	return func() {
+		_ = unlockFile(f)
+		d.mut.Unlock()
+	}, nil
+}
+
+// rlock takes the read lock of the storer, both within this process
+// and across the processes sharing the folder
+func (d *DiskStorer) rlock() (unlock func(), err error) {
+	d.mut.RLock()
+
+	f, err := lockFile(path.Join(d.folderPath, diskLockFile), false)
+	if err != nil {
+		d.mut.RUnlock()
+		return nil, errors.Wrap(err, "unable to lock session folder")
+	}
+
+	return func() {
+		_ = unlockFile(f)
+		d.mut.RUnlock()
+	}, nil
+}
+
+// isDiskShard returns true if name is the name of a shard folder
+func isDiskShard(name string) bool {
+	return len(name) == diskShardLen && isIDChars(name)
+}
+
+// validDiskKey returns true if the session id key can be used as a file
+// name. Session ids are made of letters, digits, dashes and underscores,
+// see IDGenerator.
+func validDiskKey(key string) bool {
+	return len(key) > diskShardLen && len(key) <= diskMaxKeyLen && isIDChars(key)
+}
+
+// writeFileAtomic replaces the file at filePath with contents. The contents
+// are written and synced to a temporary file in the same folder which is
+// then renamed over filePath, so readers and crashes only ever see either
+// the old or the new contents.
+func writeFileAtomic(filePath string, contents []byte) error {
+	f, err := ioutil.TempFile(path.Dir(filePath), diskTempPrefix)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create temporary file for: %s", filePath)
+	}
+
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filePath)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return errors.Wrapf(err, "unable to write file: %s", filePath)
+	}
+
+	return nil
+}
+
+// removeIfExists removes the file at filePath if it exists
+func removeIfExists(filePath string) error {
+	err := os.Remove(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "unable to remove file: %s", filePath)
+	}
+
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package abcsessions
+
+import "os"
+
+// lockFile is a noop on systems without flock, the DiskStorer is only
+// safe to use from a single process on those systems
+func lockFile(filePath string, exclusive bool) (*os.File, error) {
+	return nil, nil
+}
+
+// tryLockFile is a noop on systems without flock
+func tryLockFile(filePath string) (*os.File, error) {
+	return nil, nil
+}
+
+// unlockFile is a noop on systems without flock
+func unlockFile(f *os.File) error {
+	return nil
+}
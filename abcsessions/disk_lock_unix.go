@@ -0,0 +1,73 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package abcsessions
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/friendsofgo/errors"
+)
+
+// lockFile opens (creating it if needed) and locks the file at filePath
+// with an advisory lock shared by all processes. The lock is exclusive or
+// shared, and blocks until it is acquired.
+func lockFile(filePath string, exclusive bool) (*os.File, error) {
+	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	for {
+		err = syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// unlockFile releases the lock taken by lockFile and closes the file
+func unlockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// tryLockFile is lockFile with an exclusive lock, that fails instead of
+// blocking if another process holds the lock
+func tryLockFile(filePath string) (*os.File, error) {
+	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err == syscall.EWOULDBLOCK {
+		err = errors.Errorf("%s is locked by another process", filePath)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -119,7 +120,7 @@ func TestDiskStorerSet(t *testing.T) {
 		t.Error(err)
 	}
 
-	files, err := ioutil.ReadDir(d.folderPath)
+	files, err := d.All()
 	if err != nil {
 		t.Error(err)
 	}
@@ -134,7 +135,7 @@ func TestDiskStorerSet(t *testing.T) {
 	d.Set(testid1, "whatsup")
 	d.Set(testid2, "friend")
 
-	files, err = ioutil.ReadDir(d.folderPath)
+	files, err = d.All()
 	if err != nil {
 		t.Error(err)
 	}
@@ -167,7 +168,7 @@ func TestDiskStorerDel(t *testing.T) {
 		t.Error(err)
 	}
 
-	files, err := ioutil.ReadDir(d.folderPath)
+	files, err := d.All()
 	if err != nil {
 		t.Error(err)
 	}
@@ -182,7 +183,7 @@ func TestDiskStorerDel(t *testing.T) {
 	d.Set(testid1, "whatsup")
 	d.Set(testid2, "friend")
 
-	files, err = ioutil.ReadDir(d.folderPath)
+	files, err = d.All()
 	if err != nil {
 		t.Error(err)
 	}
@@ -200,7 +201,7 @@ func TestDiskStorerDel(t *testing.T) {
 		t.Errorf("Expected get hi to fail")
 	}
 
-	files, err = ioutil.ReadDir(d.folderPath)
+	files, err = d.All()
 	if err != nil {
 		t.Error(err)
 	}
@@ -248,13 +249,13 @@ func TestDiskStorerCleaner(t *testing.T) {
 	}
 
 	// Change the mod time of test2 file to yesterday so we can test it gets deleted
-	os.Chtimes(filepath.Join(d.folderPath, testid2),
+	os.Chtimes(d.sessionPath(testid2),
 		time.Now().AddDate(0, 0, -1),
 		time.Now().AddDate(0, 0, -1),
 	)
 
 	// Ensure there are currently 2 files, as expected
-	files, err := ioutil.ReadDir(d.folderPath)
+	files, err := d.All()
 	if err != nil {
 		t.Error(err)
 	}
@@ -271,18 +272,18 @@ func TestDiskStorerCleaner(t *testing.T) {
 	// Stop the cleaner, this will block until the cleaner has finished its operations
 	d.StopCleaner()
 
-	files, err = ioutil.ReadDir(d.folderPath)
+	files, err = d.All()
 	if err != nil {
 		t.Error(err)
 	}
 	if len(files) != 1 {
 		for _, f := range files {
-			t.Log(f.Name())
+			t.Log(f)
 		}
 		t.Errorf("Expected len 1, got %d: %#v", len(files), files)
 
 	}
-	if files[0].Name() == testid2 {
+	if files[0] == testid2 {
 		t.Errorf("expected test2 file to be deleted, but is present")
 	}
 }
@@ -295,7 +296,7 @@ func TestDiskStorerResetExpiry(t *testing.T) {
 		t.Error(err)
 	}
 
-	files, err := ioutil.ReadDir(d.folderPath)
+	files, err := d.All()
 	if err != nil {
 		t.Error(err)
 	}
@@ -310,7 +311,7 @@ func TestDiskStorerResetExpiry(t *testing.T) {
 		t.Error(err)
 	}
 
-	files, err = ioutil.ReadDir(d.folderPath)
+	files, err = d.All()
 	if err != nil {
 		t.Error(err)
 	}
@@ -318,7 +319,7 @@ func TestDiskStorerResetExpiry(t *testing.T) {
 		t.Errorf("Expected len 1, got %d", len(files))
 	}
 
-	ts, err := times.Stat(filepath.Join(d.folderPath, testid1))
+	ts, err := times.Stat(d.sessionPath(testid1))
 	if err != nil {
 		t.Error(err)
 	}
@@ -331,7 +332,7 @@ func TestDiskStorerResetExpiry(t *testing.T) {
 		t.Error(err)
 	}
 
-	files, err = ioutil.ReadDir(d.folderPath)
+	files, err = d.All()
 	if err != nil {
 		t.Error(err)
 	}
@@ -339,7 +340,7 @@ func TestDiskStorerResetExpiry(t *testing.T) {
 		t.Errorf("Expected len 1, got %d", len(files))
 	}
 
-	ts, err = times.Stat(filepath.Join(d.folderPath, testid1))
+	ts, err = times.Stat(d.sessionPath(testid1))
 	if err != nil {
 		t.Error(err)
 	}
@@ -349,3 +350,178 @@ func TestDiskStorerResetExpiry(t *testing.T) {
 		t.Errorf("Expected newexpires to be newer than old expires, got: %#v, %#v", oldExpires, newExpires)
 	}
 }
+
+func TestDiskStorerOwner(t *testing.T) {
+	t.Parallel()
+
+	d, err := NewDiskStorer(filepath.Join(testpath, "owner"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testOwnerStorer(t, d)
+
+	// The index folders are not sessions
+	list, err := d.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Errorf("expected 1 session, got %v", list)
+	}
+}
+
+func TestDiskStorerCleanerLoop(t *testing.T) {
+	d, err := NewDiskStorer(filepath.Join(testpath, "h"), time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm := diskTestTimer{}
+	ch := make(chan time.Time)
+	timerTestHarness = func(d time.Duration) (timer, <-chan time.Time) {
+		return tm, ch
+	}
+
+	testid1 := uuid.NewV4().String()
+	if err = d.Set(testid1, "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	d.StartCleaner()
+
+	// The first clean has nothing to remove
+	ch <- time.Time{}
+
+	yesterday := time.Now().AddDate(0, 0, -1)
+	os.Chtimes(d.sessionPath(testid1), yesterday, yesterday)
+
+	// The cleaner must still be running to receive a second signal
+	ch <- time.Time{}
+
+	d.StopCleaner()
+
+	if _, err = d.Get(testid1); !IsNoSessionError(err) {
+		t.Errorf("expected session to be cleaned on the second interval, got: %v", err)
+	}
+}
+
+func TestDiskStorerLegacyLayout(t *testing.T) {
+	t.Parallel()
+
+	d, err := NewDiskStorer(filepath.Join(testpath, "legacy"), time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sessions written before sessions were sharded
+	testid1 := uuid.NewV4().String()
+	testid2 := uuid.NewV4().String()
+	for _, id := range []string{testid1, testid2} {
+		if err = ioutil.WriteFile(d.legacySessionPath(id), []byte("hello"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := d.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("expected 2 sessions, got %v", list)
+	}
+
+	val, err := d.Get(testid1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "hello" {
+		t.Errorf("expected %q, got %q", "hello", val)
+	}
+
+	// Setting moves the session into its shard
+	if err = d.Set(testid1, "whatsup"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(d.legacySessionPath(testid1)); !os.IsNotExist(err) {
+		t.Errorf("expected legacy session file to be removed, got: %v", err)
+	}
+	if val, _ = d.Get(testid1); val != "whatsup" {
+		t.Errorf("expected %q, got %q", "whatsup", val)
+	}
+
+	// Expired legacy sessions are cleaned
+	yesterday := time.Now().AddDate(0, 0, -1)
+	os.Chtimes(d.legacySessionPath(testid2), yesterday, yesterday)
+	d.Clean()
+
+	if _, err = d.Get(testid2); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if list, _ = d.All(); len(list) != 1 {
+		t.Errorf("expected 1 session, got %v", list)
+	}
+}
+
+func TestDiskStorerAtomicWrite(t *testing.T) {
+	t.Parallel()
+
+	d, err := NewDiskStorer(filepath.Join(testpath, "atomic"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testid1 := uuid.NewV4().String()
+	for i := 0; i < 5; i++ {
+		if err = d.Set(testid1, "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the session file remains in its shard, no temporary files
+	files, err := ioutil.ReadDir(filepath.Dir(d.sessionPath(testid1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != testid1 {
+		for _, f := range files {
+			t.Log(f.Name())
+		}
+		t.Errorf("expected only the session file, got %d files", len(files))
+	}
+
+	// A leftover temporary file from a crash is not a session
+	if err = ioutil.WriteFile(filepath.Join(filepath.Dir(d.sessionPath(testid1)), diskTempPrefix+"123"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := d.All(); len(list) != 1 {
+		t.Errorf("expected 1 session, got %v", list)
+	}
+
+	if _, err = d.Get(uuid.NewV4().String()); !IsNoSessionError(err) {
+		t.Errorf("expected no session error for a missing session, got: %v", err)
+	}
+}
+
+func TestValidDiskKey(t *testing.T) {
+	t.Parallel()
+
+	keys := map[string]bool{
+		"a668b3bb-0cf1-4627-8cd4-7f62d09ebad6":        true,
+		"Qx7_-0aZbY3cD4eF5gH6iJ7kL8mN9oP0qR1sT2uV3wX": true,
+		"":                        false,
+		"ab":                      false,
+		"..":                      false,
+		".lock":                   false,
+		"../a668b3bb-0cf1-4627":   false,
+		"a668b3bb/0cf1-4627-8cd4": false,
+		"a668b3bb 0cf1-4627-8cd4": false,
+		strings.Repeat("a", 129):  false,
+	}
+
+	for key, valid := range keys {
+		if v := validDiskKey(key); v != valid {
+			t.Errorf("key %q, expected validity to be: %t, got %t", key, valid, v)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package abcsessions
+
+import (
+	"context"
+	"encoding/base64"
+	"time"
+
+	"github.com/friendsofgo/errors"
+)
+
+// EncryptedStorer is a Storer that encrypts session values with AES-GCM
+// before they reach the storer it wraps, so that session data is not
+// readable from the disk, a Redis dump or a database backup.
+//
+// Values are sealed with the active key of a Keyring and bound to their
+// session ID, so a value can not be moved to another session. Keys are
+// rotated the same way as for the CookieOverseer: add a new key to the
+// keyring and make it active, new values are sealed with it while values
+// sealed with the other keys can still be read. Values sealed with a key
+// that is no longer in the keyring are treated as nonexistent sessions.
+//
+// The optional ContextStorer, OwnerStorer, VersionedStorer, TTLStorer and
+// ExpiryNotifier interfaces are passed through to the wrapped storer. The
+// StorageOverseer looks through Unwrap to only use the ones it implements.
+type EncryptedStorer struct {
+	// AllowPlaintext makes values that were stored before the storer was
+	// wrapped readable as they are, so that wrapping an existing storer does
+	// not log everyone out. They are encrypted the next time they are Set.
+	// Turn it off once the plaintext sessions have expired.
+	AllowPlaintext bool
+
+	storer  ContextStorer
+	inner   Storer
+	keyring *Keyring
+}
+
+// NewEncryptedStorer wraps storer in an EncryptedStorer using secretKey,
+// which is given the key ID DefaultKeyID. Panics if the key is not a valid
+// AES key. Use NewEncryptedStorerKeyring instead to be able to rotate keys.
+func NewEncryptedStorer(storer Storer, secretKey []byte) *EncryptedStorer {
+	keyring, err := NewKeyring(DefaultKeyID, map[string][]byte{DefaultKeyID: secretKey})
+	if err != nil {
+		panic(err)
+	}
+
+	return NewEncryptedStorerKeyring(storer, keyring)
+}
+
+// NewEncryptedStorerKeyring wraps storer in an EncryptedStorer using the
+// keys of keyring
+func NewEncryptedStorerKeyring(storer Storer, keyring *Keyring) *EncryptedStorer {
+	if storer == nil {
+		panic("storer must be provided")
+	}
+	if keyring == nil {
+		panic("keyring must be provided")
+	}
+
+	return &EncryptedStorer{
+		storer:  NewContextStorer(storer),
+		inner:   storer,
+		keyring: keyring,
+	}
+}
+
+// All keys in the wrapped storer
+func (e *EncryptedStorer) All() ([]string, error) {
+	return e.AllContext(context.Background())
+}
+
+// Get returns the decrypted value of the session pointed to by the
+// session id key.
+func (e *EncryptedStorer) Get(key string) (string, error) {
+	return e.GetContext(context.Background(), key)
+}
+
+// Set encrypts value and saves it to the session pointed to by the
+// session id key.
+func (e *EncryptedStorer) Set(key, value string) error {
+	return e.SetContext(context.Background(), key, value)
+}
+
+// Del the session pointed to by the session id key and remove it.
+func (e *EncryptedStorer) Del(key string) error {
+	return e.DelContext(context.Background(), key)
+}
+
+// ResetExpiry resets the expiry of the key
+func (e *EncryptedStorer) ResetExpiry(key string) error {
+	return e.ResetExpiryContext(context.Background(), key)
+}
+
+// AllContext is All with an explicit context for the wrapped storer
+func (e *EncryptedStorer) AllContext(ctx context.Context) ([]string, error) {
+	return e.storer.AllContext(ctx)
+}
+
+// GetContext is Get with an explicit context for the wrapped storer
+func (e *EncryptedStorer) GetContext(ctx context.Context, key string) (string, error) {
+	sealed, err := e.storer.GetContext(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	value, _, err := e.open(key, sealed)
+	return value, err
+}
+
+// SetContext is Set with an explicit context for the wrapped storer
+func (e *EncryptedStorer) SetContext(ctx context.Context, key, value string) error {
+	sealed, err := e.keyring.seal(value, []byte(key))
+	if err != nil {
+		return errors.Wrap(err, "unable to encrypt session value")
+	}
+
+	return e.storer.SetContext(ctx, key, sealed)
+}
+
+// DelContext is Del with an explicit context for the wrapped storer
+func (e *EncryptedStorer) DelContext(ctx context.Context, key string) error {
+	return e.storer.DelContext(ctx, key)
+}
+
+// ResetExpiryContext is ResetExpiry with an explicit context for the
+// wrapped storer
+func (e *EncryptedStorer) ResetExpiryContext(ctx context.Context, key string) error {
+	return e.storer.ResetExpiryContext(ctx, key)
+}
+
+// Unwrap returns the wrapped storer
+func (e *EncryptedStorer) Unwrap() Storer {
+	return e.inner
+}
+
+// Reseal encrypts every value that is not sealed with the active key of the
+// keyring again (or at all, with AllowPlaintext), so that old keys can be
+// removed without waiting for their sessions to expire. Sessions sealed
+// with a key that is no longer in the keyring are deleted. Note that setting
+// the values again also resets their expiry in the wrapped storer.
+func (e *EncryptedStorer) Reseal(ctx context.Context) error {
+	keys, err := e.storer.AllContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to list sessions")
+	}
+
+	for _, key := range keys {
+		sealed, err := e.storer.GetContext(ctx, key)
+		if IsNoSessionError(err) {
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "unable to get session %s", key)
+		}
+
+		value, stale, err := e.open(key, sealed)
+		if IsNoSessionError(err) {
+			if err = e.storer.DelContext(ctx, key); err != nil && !IsNoSessionError(err) {
+				return errors.Wrapf(err, "unable to delete session %s", key)
+			}
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "unable to decrypt session %s", key)
+		}
+
+		if !stale {
+			continue
+		}
+		if err = e.SetContext(ctx, key, value); err != nil {
+			return errors.Wrapf(err, "unable to reseal session %s", key)
+		}
+	}
+
+	return nil
+}
+
+// TTL returns the time left before the session pointed to by the session id
+// key expires in the wrapped storer, which must implement TTLStorer.
+func (e *EncryptedStorer) TTL(ctx context.Context, key string) (time.Duration, time.Duration, error) {
+	ttlStorer, err := e.ttlStorer()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return ttlStorer.TTL(ctx, key)
+}
+
+// GetVersioned returns the decrypted value of the session pointed to by the
+// session id key along with its version in the wrapped storer, which must
+// implement VersionedStorer.
+func (e *EncryptedStorer) GetVersioned(ctx context.Context, key string) (string, string, error) {
+	versionedStorer, err := e.versionedStorer()
+	if err != nil {
+		return "", "", err
+	}
+
+	sealed, version, err := versionedStorer.GetVersioned(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	value, _, err := e.open(key, sealed)
+	if err != nil {
+		return "", "", err
+	}
+
+	return value, version, nil
+}
+
+// CompareAndSet encrypts value and saves it to the session pointed to by
+// the session id key if it is still at version. The wrapped storer must
+// implement VersionedStorer.
+func (e *EncryptedStorer) CompareAndSet(ctx context.Context, key, value, version string) error {
+	versionedStorer, err := e.versionedStorer()
+	if err != nil {
+		return err
+	}
+
+	sealed, err := e.keyring.seal(value, []byte(key))
+	if err != nil {
+		return errors.Wrap(err, "unable to encrypt session value")
+	}
+
+	return versionedStorer.CompareAndSet(ctx, key, sealed, version)
+}
+
+// SetOwner attaches the session pointed to by the session id key to owner.
+// The wrapped storer must implement OwnerStorer.
+func (e *EncryptedStorer) SetOwner(key, owner string) error {
+	ownerStorer, err := e.ownerStorer()
+	if err != nil {
+		return err
+	}
+	return ownerStorer.SetOwner(key, owner)
+}
+
+// Owner returns the owner of the session pointed to by the session id key.
+// The wrapped storer must implement OwnerStorer.
+func (e *EncryptedStorer) Owner(key string) (string, error) {
+	ownerStorer, err := e.ownerStorer()
+	if err != nil {
+		return "", err
+	}
+	return ownerStorer.Owner(key)
+}
+
+// OwnerSessions returns the session ids of all sessions of owner.
+// The wrapped storer must implement OwnerStorer.
+func (e *EncryptedStorer) OwnerSessions(owner string) ([]string, error) {
+	ownerStorer, err := e.ownerStorer()
+	if err != nil {
+		return nil, err
+	}
+	return ownerStorer.OwnerSessions(owner)
+}
+
+// DelOwner deletes all sessions of owner.
+// The wrapped storer must implement OwnerStorer.
+func (e *EncryptedStorer) DelOwner(owner string) error {
+	ownerStorer, err := e.ownerStorer()
+	if err != nil {
+		return err
+	}
+	return ownerStorer.DelOwner(owner)
+}
+
+// NotifyExpired registers fn with the wrapped storer if it implements
+// ExpiryNotifier, and does nothing otherwise
+func (e *EncryptedStorer) NotifyExpired(fn func(key string)) func() {
+	if notifier, ok := e.inner.(ExpiryNotifier); ok {
+		return notifier.NotifyExpired(fn)
+	}
+
+	return func() {}
+}
+
+// ownerStorer returns the wrapped storer as an OwnerStorer
+func (e *EncryptedStorer) ownerStorer() (OwnerStorer, error) {
+	ownerStorer, ok := e.inner.(OwnerStorer)
+	if !ok {
+		return nil, errors.Errorf("storer %T does not implement OwnerStorer", e.inner)
+	}
+
+	return ownerStorer, nil
+}
+
+// ttlStorer returns the wrapped storer as a TTLStorer
+func (e *EncryptedStorer) ttlStorer() (TTLStorer, error) {
+	ttlStorer, ok := e.inner.(TTLStorer)
+	if !ok {
+		return nil, errors.Errorf("storer %T does not implement TTLStorer", e.inner)
+	}
+
+	return ttlStorer, nil
+}
+
+// versionedStorer returns the wrapped storer as a VersionedStorer
+func (e *EncryptedStorer) versionedStorer() (VersionedStorer, error) {
+	versionedStorer, ok := e.inner.(VersionedStorer)
+	if !ok {
+		return nil, errors.Errorf("storer %T does not implement VersionedStorer", e.inner)
+	}
+
+	return versionedStorer, nil
+}
+
+// open decrypts a stored value and returns whether it should be sealed
+// again. Values sealed with a key that is not in the keyring return an
+// errNoSession error.
+func (e *EncryptedStorer) open(key, sealed string) (value string, stale bool, err error) {
+	id, encoded := sealedKeyID(sealed)
+	if !validKeyID(id) || !isBase64(encoded) {
+		if e.AllowPlaintext {
+			return sealed, true, nil
+		}
+		return "", false, errors.New("session value is not encrypted")
+	}
+
+	if _, ok := e.keyring.aeads[id]; !ok {
+		return "", false, errors.Wrapf(errNoSession{}, "session value was encrypted with unknown key id %q", id)
+	}
+
+	value, stale, err = e.keyring.open(sealed, []byte(key))
+	if err != nil {
+		return "", false, errors.Wrap(err, "unable to decrypt session value")
+	}
+
+	return value, stale, nil
+}
+
+// isBase64 returns true if s is standard base64 encoded
+func isBase64(s string) bool {
+	_, err := base64.StdEncoding.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,190 @@
+package abcsessions
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedStorer(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	e := NewEncryptedStorer(m, testCookieKey)
+
+	if err := e.Set("a", "secret value"); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := m.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored, "secret") {
+		t.Errorf("expected value to be encrypted, got %q", stored)
+	}
+
+	val, err := e.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "secret value" {
+		t.Errorf("expected %q, got %q", "secret value", val)
+	}
+
+	// Values are bound to their session
+	m.Set("b", stored)
+	if _, err = e.Get("b"); err == nil || IsNoSessionError(err) {
+		t.Errorf("expected a decryption error, got: %v", err)
+	}
+
+	// Plaintext values are refused unless allowed
+	m.Set("c", `{"Value":"hi"}`)
+	if _, err = e.Get("c"); err == nil {
+		t.Error("expected plaintext values to be refused")
+	}
+	e.AllowPlaintext = true
+	if val, _ = e.Get("c"); val != `{"Value":"hi"}` {
+		t.Errorf("expected the plaintext value, got %q", val)
+	}
+
+	if _, err = e.Get("missing"); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
+
+func TestEncryptedStorerRotation(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	old := NewEncryptedStorer(m, testCookieKey)
+	if err := old.Set("a", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	m.Set("b", "plain")
+
+	keyring, err := NewKeyring("new", map[string][]byte{
+		DefaultKeyID: testCookieKey,
+		"new":        []byte("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEncryptedStorerKeyring(m, keyring)
+	e.AllowPlaintext = true
+
+	if val, err := e.Get("a"); err != nil || val != "hello" {
+		t.Fatalf("expected old values to be readable, got %q: %v", val, err)
+	}
+
+	if err = e.Reseal(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		stored, _ := m.Get(key)
+		if !strings.HasPrefix(stored, "new"+keyIDSeparator) {
+			t.Errorf("expected %s to be sealed with the new key, got %q", key, stored)
+		}
+	}
+
+	// Once the old key is gone its sessions no longer exist
+	old.Set("c", "hello")
+	keyring, _ = NewKeyring("new", map[string][]byte{"new": []byte("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")})
+	e = NewEncryptedStorerKeyring(m, keyring)
+	if _, err = e.Get("c"); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if val, err := e.Get("a"); err != nil || val != "hello" {
+		t.Errorf("expected resealed values to be readable, got %q: %v", val, err)
+	}
+}
+
+func TestEncryptedStorerOverseer(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), NewEncryptedStorer(m, testCookieKey))
+
+	var events []Event
+	s.Hooks = recordHooks(&events)
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	if err := s.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetOwner(w, r, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Regenerate(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := s.Get(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "hello" {
+		t.Errorf("expected %q, got %q", "hello", val)
+	}
+
+	id, _ := s.SessionID(w, r)
+	if ids, _ := s.OwnerSessions("alice"); len(ids) != 1 || ids[0] != id {
+		t.Errorf("expected the owner to be kept, got %v", ids)
+	}
+
+	// The cleaner of the wrapped storer is still reported
+	events = nil
+	m.mut.Lock()
+	sess := m.sessions[id]
+	sess.expires = sess.expires.AddDate(0, 0, -3)
+	m.sessions[id] = sess
+	m.mut.Unlock()
+	m.Clean()
+	if len(events) != 1 || events[0].Type != EventExpire {
+		t.Errorf("expected an expire event, got %#v", events)
+	}
+}
+
+func TestEncryptedStorerOptionalInterfaces(t *testing.T) {
+	t.Parallel()
+
+	// The wrapped storer implements none of the optional interfaces
+	m, _ := NewDefaultMemoryStorer()
+	e := NewEncryptedStorer(&countingStorer{Storer: m}, testCookieKey)
+
+	if _, ok := asStorer[OwnerStorer](e); ok {
+		t.Error("expected the storer not to be an OwnerStorer")
+	}
+	if _, ok := asStorer[VersionedStorer](e); ok {
+		t.Error("expected the storer not to be a VersionedStorer")
+	}
+	if _, ok := asStorer[TTLStorer](e); ok {
+		t.Error("expected the storer not to be a TTLStorer")
+	}
+
+	s := NewStorageOverseer(NewCookieOptions(), e)
+	s.ResetThreshold = 0.5
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	if err := s.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Regenerate(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(w, r, func(value string) (string, error) { return value + " world", nil }); err != nil {
+		t.Fatal(err)
+	}
+	if due, err := s.resetDue(w, r, s.ResetThreshold); err != nil || !due {
+		t.Errorf("expected the reset to be due, got %t: %v", due, err)
+	}
+
+	if val, err := s.Get(w, r); err != nil || val != "hello world" {
+		t.Errorf("expected %q, got %q: %v", "hello world", val, err)
+	}
+}
@@ -0,0 +1,119 @@
+package abcsessions
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// FlashLevel is the severity of a flash message
+type FlashLevel string
+
+// The flash message levels
+const (
+	FlashSuccess FlashLevel = "success"
+	FlashInfo    FlashLevel = "info"
+	FlashWarning FlashLevel = "warning"
+	FlashError   FlashLevel = "error"
+)
+
+// Flash is a flash message queued with AddFlashMessage
+type Flash struct {
+	Level   FlashLevel `json:"level"`
+	Message string     `json:"message"`
+}
+
+// AddFlashMessage queues a flash message with a level in the session.
+// Unlike AddFlash, adding a message never replaces an earlier one: messages
+// are kept in the order they were added until they are read with Flashes
+// or LevelFlashes.
+func AddFlashMessage(overseer Overseer, w http.ResponseWriter, r *http.Request, level FlashLevel, message string) error {
+	sess, err := getSession(overseer, w, r)
+	if err != nil && !IsNoSessionError(err) {
+		return err
+	}
+
+	sess.Flashes = append(sess.Flashes, Flash{Level: level, Message: message})
+
+	return setSession(overseer, w, r, sess)
+}
+
+// Flashes returns all queued flash messages in the order they were added
+// and removes them from the session. It returns no messages and no error
+// if there is no session.
+func Flashes(overseer Overseer, w http.ResponseWriter, r *http.Request) ([]Flash, error) {
+	return drainFlashes(overseer, w, r, func(Flash) bool { return true })
+}
+
+// LevelFlashes returns the queued flash messages of level in the order
+// they were added and removes them from the session, leaving the messages
+// of the other levels queued. It returns no messages and no error if there
+// is no session.
+func LevelFlashes(overseer Overseer, w http.ResponseWriter, r *http.Request, level FlashLevel) ([]string, error) {
+	flashes, err := drainFlashes(overseer, w, r, func(f Flash) bool { return f.Level == level })
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]string, len(flashes))
+	for i, f := range flashes {
+		messages[i] = f.Message
+	}
+
+	return messages, nil
+}
+
+// drainFlashes removes the queued flash messages matching fn from the
+// session and returns them
+func drainFlashes(overseer Overseer, w http.ResponseWriter, r *http.Request, fn func(Flash) bool) ([]Flash, error) {
+	sess, err := getSession(overseer, w, r)
+	if IsNoSessionError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var drained, kept []Flash
+	for _, f := range sess.Flashes {
+		if fn(f) {
+			drained = append(drained, f)
+		} else {
+			kept = append(kept, f)
+		}
+	}
+
+	if len(drained) == 0 {
+		return nil, nil
+	}
+
+	sess.Flashes = kept
+	if err = setSession(overseer, w, r, sess); err != nil {
+		return nil, err
+	}
+
+	return drained, nil
+}
+
+// FlashHelpers returns the flashes template helper. Add it to the renderer
+// funcs next to abcrender.AppHelpers. It takes the request as argument and
+// drains the flash messages from its session like Flashes, so that a layout
+// can render them without the handlers passing them in:
+//
+//	{{range flashes .Request}}
+//		<div class="alert alert-{{.Level}}">{{.Message}}</div>
+//	{{end}}
+//
+// New apps render them in the templates/partials/flashes.html partial of
+// their main layout. Since layouts are used by every page, requests that did
+// not go through the sessions middleware have no flashes.
+func FlashHelpers() template.FuncMap {
+	return template.FuncMap{
+		"flashes": func(r *http.Request) ([]Flash, error) {
+			sess, ok := FromContext(r.Context())
+			if !ok {
+				return nil, nil
+			}
+
+			return sess.Flashes()
+		},
+	}
+}
@@ -0,0 +1,225 @@
+package abcsessions
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/friendsofgo/errors"
+)
+
+// Handle is the session of a request, as put in the request context by the
+// sessions middlewares. It offers the JSON helpers (Set, Get, AddFlash, ...)
+// without passing the overseer, the ResponseWriter and the Request around:
+//
+//	sess, ok := abcsessions.FromContext(r.Context())
+//	if !ok {
+//		// The request did not go through the sessions middleware
+//	}
+//	err := sess.Set("user", "alice")
+//
+// The handle uses the session loaded once per request by the middleware, and
+// its cookies are buffered by the sessionsResponseWriter of the middleware
+// like the ones of the helpers, so it can be used even from code that only
+// has the context.
+//
+// The handle uses the overseer the middleware was created from, when using
+// the Middleware, MiddlewareWithReset or ResetMiddleware methods of the
+// overseer. With the package Middleware function it uses the first overseer
+// passed to one of the helpers during the request, and its methods return an
+// error until then.
+type Handle struct {
+	rs *requestSession
+	// ctx is the context the handle was taken from, the overseer and the
+	// storer are called with it instead of the context of the request
+	ctx context.Context
+}
+
+// FromContext returns the session handle stored in ctx by the sessions
+// middlewares. It returns false if the request did not go through one.
+// The methods of the handle pass ctx on to the overseer, so that its
+// deadline and values apply to the storer calls.
+func FromContext(ctx context.Context) (*Handle, bool) {
+	rs, ok := ctx.Value(ctxKeyRequestSession).(*requestSession)
+	if !ok {
+		return nil, false
+	}
+
+	return &Handle{rs: rs, ctx: ctx}, true
+}
+
+// Overseer returns the overseer of the session, or nil if no overseer is
+// bound to it yet
+func (h *Handle) Overseer() Overseer {
+	h.rs.mut.Lock()
+	defer h.rs.mut.Unlock()
+
+	return h.rs.overseer
+}
+
+// overseer returns the overseer of the session, or an error if no overseer
+// is bound to it yet
+func (h *Handle) overseer() (Overseer, error) {
+	overseer := h.Overseer()
+	if overseer == nil {
+		return nil, errors.New("no overseer is bound to the session, use the Middleware methods of the overseer")
+	}
+
+	return overseer, nil
+}
+
+// request returns the request of the session with the context of the handle
+func (h *Handle) request() *http.Request {
+	return h.rs.r.WithContext(h.ctx)
+}
+
+// ID returns the session ID, see Overseer.SessionID
+func (h *Handle) ID() (string, error) {
+	overseer, err := h.overseer()
+	if err != nil {
+		return "", err
+	}
+
+	return overseer.SessionID(h.rs.w, h.request())
+}
+
+// Regenerate gives the session a new ID, see Overseer.Regenerate
+func (h *Handle) Regenerate() error {
+	overseer, err := h.overseer()
+	if err != nil {
+		return err
+	}
+
+	return overseer.Regenerate(h.rs.w, h.request())
+}
+
+// Destroy deletes the session, see Overseer.Del
+func (h *Handle) Destroy() error {
+	overseer, err := h.overseer()
+	if err != nil {
+		return err
+	}
+
+	return overseer.Del(h.rs.w, h.request())
+}
+
+// Get returns the value of key, see Get
+func (h *Handle) Get(key string) (string, error) {
+	overseer, err := h.overseer()
+	if err != nil {
+		return "", err
+	}
+
+	return Get(overseer, h.rs.w, h.request(), key)
+}
+
+// Set sets key to value, see Set
+func (h *Handle) Set(key string, value string) error {
+	overseer, err := h.overseer()
+	if err != nil {
+		return err
+	}
+
+	return Set(overseer, h.rs.w, h.request(), key, value)
+}
+
+// Del deletes key, see Del
+func (h *Handle) Del(key string) error {
+	overseer, err := h.overseer()
+	if err != nil {
+		return err
+	}
+
+	return Del(overseer, h.rs.w, h.request(), key)
+}
+
+// GetObj unmarshals the session object into pointer, see GetObj
+func (h *Handle) GetObj(pointer interface{}) error {
+	overseer, err := h.overseer()
+	if err != nil {
+		return err
+	}
+
+	return GetObj(overseer, h.rs.w, h.request(), pointer)
+}
+
+// SetObj stores value as the session object, see SetObj
+func (h *Handle) SetObj(value interface{}) error {
+	overseer, err := h.overseer()
+	if err != nil {
+		return err
+	}
+
+	return SetObj(overseer, h.rs.w, h.request(), value)
+}
+
+// AddFlash adds a flash message under key, see AddFlash
+func (h *Handle) AddFlash(key string, value string) error {
+	overseer, err := h.overseer()
+	if err != nil {
+		return err
+	}
+
+	return AddFlash(overseer, h.rs.w, h.request(), key, value)
+}
+
+// GetFlash returns and removes the flash message under key, see GetFlash
+func (h *Handle) GetFlash(key string) (string, error) {
+	overseer, err := h.overseer()
+	if err != nil {
+		return "", err
+	}
+
+	return GetFlash(overseer, h.rs.w, h.request(), key)
+}
+
+// AddFlashObj adds a flash object under key, see AddFlashObj
+func (h *Handle) AddFlashObj(key string, value interface{}) error {
+	overseer, err := h.overseer()
+	if err != nil {
+		return err
+	}
+
+	return AddFlashObj(overseer, h.rs.w, h.request(), key, value)
+}
+
+// GetFlashObj unmarshals and removes the flash object under key into
+// pointer, see GetFlashObj
+func (h *Handle) GetFlashObj(key string, pointer interface{}) error {
+	overseer, err := h.overseer()
+	if err != nil {
+		return err
+	}
+
+	return GetFlashObj(overseer, h.rs.w, h.request(), key, pointer)
+}
+
+// AddFlashMessage queues a flash message with a level, see AddFlashMessage
+func (h *Handle) AddFlashMessage(level FlashLevel, message string) error {
+	overseer, err := h.overseer()
+	if err != nil {
+		return err
+	}
+
+	return AddFlashMessage(overseer, h.rs.w, h.request(), level, message)
+}
+
+// Flashes returns and removes all queued flash messages, see Flashes
+func (h *Handle) Flashes() ([]Flash, error) {
+	overseer, err := h.overseer()
+	if err != nil {
+		return nil, err
+	}
+
+	return Flashes(overseer, h.rs.w, h.request())
+}
+
+// LevelFlashes returns and removes the queued flash messages of level,
+// see LevelFlashes
+func (h *Handle) LevelFlashes(level FlashLevel) ([]string, error) {
+	overseer, err := h.overseer()
+	if err != nil {
+		return nil, err
+	}
+
+	return LevelFlashes(overseer, h.rs.w, h.request(), level)
+}
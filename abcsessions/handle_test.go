@@ -0,0 +1,185 @@
+package abcsessions
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestFromContext(t *testing.T) {
+	t.Parallel()
+
+	if _, ok := FromContext(context.Background()); ok {
+		t.Error("expected no handle outside of the middleware")
+	}
+
+	called := false
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if _, ok := FromContext(r.Context()); !ok {
+			t.Error("expected a handle")
+		}
+	}
+
+	Middleware(http.HandlerFunc(fn)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !called {
+		t.Error("expected the handler to be called")
+	}
+}
+
+func TestHandle(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	storer := &countingStorer{Storer: m}
+	o := NewStorageOverseer(NewCookieOptions(), storer)
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		sess, ok := FromContext(r.Context())
+		if !ok {
+			t.Fatal("expected a handle")
+		}
+		if sess.Overseer() != o {
+			t.Error("expected the handle to be bound to the overseer")
+		}
+
+		if _, err := sess.Get("a"); !IsNoSessionError(err) {
+			t.Errorf("expected a no session error, got: %v", err)
+		}
+		if err := sess.Set("a", "1"); err != nil {
+			t.Error(err)
+		}
+		if err := sess.AddFlashMessage(FlashInfo, "hello"); err != nil {
+			t.Error(err)
+		}
+
+		// The helpers share the session of the handle
+		if val, err := Get(o, w, r, "a"); err != nil || val != "1" {
+			t.Errorf("expected %q, got %q: %v", "1", val, err)
+		}
+		if storer.sets != 0 {
+			t.Errorf("expected no sets before the header is written, got %d", storer.sets)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	o.Middleware(http.HandlerFunc(fn)).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if storer.sets != 1 {
+		t.Errorf("expected 1 set, got %d", storer.sets)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie, got %d", len(cookies))
+	}
+
+	fn = func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := FromContext(r.Context())
+
+		if val, err := sess.Get("a"); err != nil || val != "1" {
+			t.Errorf("expected %q, got %q: %v", "1", val, err)
+		}
+
+		flashes, err := sess.Flashes()
+		if err != nil {
+			t.Error(err)
+		}
+		if want := []Flash{{Level: FlashInfo, Message: "hello"}}; !reflect.DeepEqual(flashes, want) {
+			t.Errorf("expected %v, got %v", want, flashes)
+		}
+
+		if id, err := sess.ID(); err != nil || id != cookies[0].Value {
+			t.Errorf("expected the session id %q, got %q: %v", cookies[0].Value, id, err)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	o.MiddlewareWithReset(http.HandlerFunc(fn)).ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestHandleUnbound(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	o := NewStorageOverseer(NewCookieOptions(), m)
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := FromContext(r.Context())
+
+		if sess.Overseer() != nil {
+			t.Error("expected no overseer")
+		}
+		if err := sess.Set("a", "1"); err == nil || IsNoSessionError(err) {
+			t.Errorf("expected an unbound handle error, got: %v", err)
+		}
+
+		// The first helper call binds the overseer
+		if err := Set(o, w, r, "a", "1"); err != nil {
+			t.Error(err)
+		}
+		if val, err := sess.Get("a"); err != nil || val != "1" {
+			t.Errorf("expected %q, got %q: %v", "1", val, err)
+		}
+	}
+
+	Middleware(http.HandlerFunc(fn)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+// handleCtxKey is the key of the context value of TestHandleContext
+type handleCtxKey struct{}
+
+// contextRecordingStorer records the handleCtxKey value of the contexts
+// it is called with
+type contextRecordingStorer struct {
+	*MemoryStorer
+	values []interface{}
+}
+
+func (c *contextRecordingStorer) GetContext(ctx context.Context, key string) (string, error) {
+	c.values = append(c.values, ctx.Value(handleCtxKey{}))
+	return c.MemoryStorer.GetContext(ctx, key)
+}
+
+func TestHandleContext(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	storer := &contextRecordingStorer{MemoryStorer: m}
+	o := NewStorageOverseer(NewCookieOptions(), storer)
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	if err := o.Set(w, httptest.NewRequest("GET", "/", nil), `{"Value":{"a":"1"}}`); err != nil {
+		t.Fatal(err)
+	}
+	id := w.GetCookie("id").Value
+	storer.values = nil
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), handleCtxKey{}, "handle")
+		sess, _ := FromContext(ctx)
+
+		if _, err := sess.Get("a"); err != nil {
+			t.Error(err)
+		}
+		if err := sess.Destroy(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: id})
+	o.Middleware(http.HandlerFunc(fn)).ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(storer.values) == 0 {
+		t.Fatal("expected the storer to be called")
+	}
+	for _, v := range storer.values {
+		if v != "handle" {
+			t.Errorf("expected the context of the handle, got the value %v", v)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package abcsessions
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/friendsofgo/errors"
+)
+
+// HeaderOptions configures the headers the session ID is carried in by a
+// StorageOverseer created with NewHeaderOverseer, for API clients that
+// can not use cookies.
+type HeaderOptions struct {
+	// Name is the request header holding the session token,
+	// for example "X-Session-Token" or "Authorization"
+	Name string
+	// Scheme is the authentication scheme the token follows in the request
+	// header, for example "Bearer" for "Authorization: Bearer <token>".
+	// Leave it empty if the header holds only the token.
+	Scheme string
+	// ResponseName is the response header new session tokens are returned
+	// in, without the Scheme. Defaults to Name when empty, set it when Name
+	// is a request only header like "Authorization".
+	ResponseName string
+}
+
+// NewHeaderOptions gives healthy defaults for session headers: the token is
+// sent in the X-Session-Token header in both directions.
+func NewHeaderOptions() HeaderOptions {
+	return HeaderOptions{
+		Name: "X-Session-Token",
+	}
+}
+
+// Validate checks that the options can be used to carry session tokens
+func (h HeaderOptions) Validate() error {
+	if len(h.Name) == 0 {
+		return errors.New("header name must be provided")
+	}
+	if strings.ContainsAny(h.Name+h.ResponseName, " :\t\r\n") {
+		return errors.Errorf("header names %q and %q must not contain spaces or colons", h.Name, h.ResponseName)
+	}
+	if strings.ContainsAny(h.Scheme, " \t\r\n") {
+		return errors.Errorf("header scheme %q must not contain spaces", h.Scheme)
+	}
+
+	return nil
+}
+
+// responseName returns the configured response header or the default
+func (h HeaderOptions) responseName() string {
+	if len(h.ResponseName) == 0 {
+		return h.Name
+	}
+
+	return h.ResponseName
+}
+
+// getID returns the session token set in the response during this request,
+// or the token in the request header. A token removed during this request
+// is reported as missing.
+func (h HeaderOptions) getID(w http.ResponseWriter, r *http.Request) (string, error) {
+	if values, ok := w.Header()[http.CanonicalHeaderKey(h.responseName())]; ok {
+		if len(values) == 0 || len(values[0]) == 0 {
+			return "", errNoSession{}
+		}
+		return values[0], nil
+	}
+
+	token := strings.TrimSpace(r.Header.Get(h.Name))
+	if len(h.Scheme) != 0 {
+		// The scheme is case insensitive
+		if len(token) <= len(h.Scheme) || !strings.EqualFold(token[:len(h.Scheme)], h.Scheme) || token[len(h.Scheme)] != ' ' {
+			return "", errNoSession{}
+		}
+		token = strings.TrimSpace(token[len(h.Scheme)+1:])
+	}
+
+	if len(token) == 0 {
+		return "", errNoSession{}
+	}
+
+	return token, nil
+}
+
+// setID returns the session token in the response header
+func (h HeaderOptions) setID(w http.ResponseWriter, id string) {
+	w.Header().Set(h.responseName(), id)
+}
+
+// refreshID does nothing, session tokens do not expire on the client
+func (h HeaderOptions) refreshID(w http.ResponseWriter, id string) {}
+
+// deleteID returns an empty session token in the response header to tell
+// the client to forget its token
+func (h HeaderOptions) deleteID(w http.ResponseWriter) {
+	w.Header().Set(h.responseName(), "")
+}
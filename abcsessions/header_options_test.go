@@ -0,0 +1,186 @@
+package abcsessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderOptionsValidate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		opts  HeaderOptions
+		valid bool
+	}{
+		{opts: NewHeaderOptions(), valid: true},
+		{opts: HeaderOptions{Name: "Authorization", Scheme: "Bearer", ResponseName: "X-Session-Token"}, valid: true},
+		{opts: HeaderOptions{}},
+		{opts: HeaderOptions{Name: "X Token"}},
+		{opts: HeaderOptions{Name: "Authorization", ResponseName: "X-Token:"}},
+		{opts: HeaderOptions{Name: "Authorization", Scheme: "My Bearer"}},
+	}
+
+	for i, test := range tests {
+		err := test.opts.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%d) expected options to be valid, got: %v", i, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%d) expected options to be invalid", i)
+		}
+	}
+}
+
+func TestHeaderOptionsGetID(t *testing.T) {
+	t.Parallel()
+
+	opts := HeaderOptions{Name: "Authorization", Scheme: "Bearer", ResponseName: "X-Session-Token"}
+
+	tests := []struct {
+		header string
+		id     string
+	}{
+		{header: "Bearer abc", id: "abc"},
+		{header: "bearer  abc ", id: "abc"},
+		{header: "Basic abc"},
+		{header: "Bearerabc"},
+		{header: "Bearer "},
+		{header: ""},
+	}
+
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", "http://localhost", nil)
+		r.Header.Set("Authorization", test.header)
+
+		id, err := opts.getID(httptest.NewRecorder(), r)
+		if len(test.id) == 0 {
+			if !IsNoSessionError(err) {
+				t.Errorf("%d) expected no session error, got %q: %v", i, id, err)
+			}
+		} else if err != nil || id != test.id {
+			t.Errorf("%d) expected %q, got %q: %v", i, test.id, id, err)
+		}
+	}
+
+	// The token returned in the response takes precedence
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.Header.Set("Authorization", "Bearer abc")
+	w := httptest.NewRecorder()
+	opts.setID(w, "def")
+	if id, _ := opts.getID(w, r); id != "def" {
+		t.Errorf("expected the response token, got %q", id)
+	}
+	opts.deleteID(w)
+	if _, err := opts.getID(w, r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error after delete, got: %v", err)
+	}
+}
+
+func TestHeaderOverseer(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewHeaderOverseer(HeaderOptions{Name: "Authorization", Scheme: "Bearer", ResponseName: "X-Session-Token"}, m)
+
+	var events []Event
+	s.Hooks = recordHooks(&events)
+
+	// No sessions middleware, the writer is a plain ResponseWriter
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := httptest.NewRecorder()
+
+	if _, err := s.Get(w, r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if err := s.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	token := w.Header().Get("X-Session-Token")
+	if !(RandomIDGenerator{}).ValidID(token) {
+		t.Fatalf("expected a session token in the response, got %q", token)
+	}
+	if val, err := s.Get(w, r); err != nil || val != "hello" {
+		t.Errorf("expected the session to be readable in the same request, got %q: %v", val, err)
+	}
+
+	// The next request sends the token back
+	r = httptest.NewRequest("GET", "http://localhost", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+
+	if val, err := s.Get(w, r); err != nil || val != "hello" {
+		t.Errorf("expected %q, got %q: %v", "hello", val, err)
+	}
+	if err := s.ResetExpiry(w, r); err != nil {
+		t.Error(err)
+	}
+	if len(w.Header()) != 0 {
+		t.Errorf("expected no response headers, got %v", w.Header())
+	}
+
+	if err := s.Regenerate(w, r); err != nil {
+		t.Fatal(err)
+	}
+	newToken := w.Header().Get("X-Session-Token")
+	if !(RandomIDGenerator{}).ValidID(newToken) || newToken == token {
+		t.Errorf("expected a new session token in the response, got %q", newToken)
+	}
+	if _, err := m.Get(token); !IsNoSessionError(err) {
+		t.Errorf("expected the old session to be deleted, got: %v", err)
+	}
+	if val, err := s.Get(w, r); err != nil || val != "hello" {
+		t.Errorf("expected the value to be kept, got %q: %v", val, err)
+	}
+
+	r = httptest.NewRequest("GET", "http://localhost", nil)
+	r.Header.Set("Authorization", "Bearer "+newToken)
+	w = httptest.NewRecorder()
+
+	if err := s.Del(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if values, ok := w.Header()["X-Session-Token"]; !ok || len(values) != 1 || len(values[0]) != 0 {
+		t.Errorf("expected an empty session token in the response, got %v", values)
+	}
+	if _, err := m.Get(newToken); !IsNoSessionError(err) {
+		t.Errorf("expected the session to be deleted, got: %v", err)
+	}
+
+	want := []EventType{EventCreate, EventRegenerate, EventDelete}
+	if got := eventTypes(events); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestHeaderOverseerMiddleware(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewHeaderOverseer(NewHeaderOptions(), m)
+	name := NewValue[string]("name")
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := name.Set(s, w, r, "alice"); err != nil {
+			t.Error(err)
+		}
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost", nil))
+
+	token := w.Header().Get("X-Session-Token")
+	if !(RandomIDGenerator{}).ValidID(token) {
+		t.Fatalf("expected a session token in the response, got %q", token)
+	}
+	if len(w.Header().Values("Set-Cookie")) != 0 {
+		t.Errorf("expected no cookies, got %v", w.Header().Values("Set-Cookie"))
+	}
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.Header.Set("X-Session-Token", token)
+	if val, err := name.Get(s, httptest.NewRecorder(), r); err != nil || val != "alice" {
+		t.Errorf("expected %q, got %q: %v", "alice", val, err)
+	}
+}
@@ -0,0 +1,118 @@
+package abcsessions
+
+import (
+	"net/http"
+	"sync"
+)
+
+// EventType is the kind of session lifecycle event passed to a Hook
+type EventType int
+
+// The session lifecycle events
+const (
+	// EventCreate is raised when a new session is stored
+	EventCreate EventType = iota + 1
+	// EventRegenerate is raised when a session is given a new ID
+	EventRegenerate
+	// EventDelete is raised when a session is deleted with Del or DelOwner
+	EventDelete
+	// EventExpire is raised when a session is removed by the cleaner of
+	// the storer, or evicted by a limited MemoryStorer
+	EventExpire
+	// EventInvalidate is raised when a session is deleted because it
+	// violated the Policy of the overseer
+	EventInvalidate
+)
+
+// String returns the name of the event type
+func (e EventType) String() string {
+	switch e {
+	case EventCreate:
+		return "create"
+	case EventRegenerate:
+		return "regenerate"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	case EventInvalidate:
+		return "invalidate"
+	}
+
+	return "unknown"
+}
+
+// Event describes a change in the lifecycle of a session
+type Event struct {
+	Type EventType
+	// SessionID is the ID of the session, or its new ID for EventRegenerate.
+	// For CookieOverseer sessions it is the ID sealed in the cookie, which
+	// can be passed to CookieOverseer.Revoke.
+	SessionID string
+	// PreviousID is the ID of the session before EventRegenerate
+	PreviousID string
+	// Request is the request that caused the event. It is nil for events
+	// that do not happen during a request: EventExpire, and EventDelete
+	// raised by DelOwner.
+	Request *http.Request
+	// Err is the reason the session was invalidated for EventInvalidate
+	Err error
+}
+
+// Hook is called synchronously with each session lifecycle event, for
+// example to write them to an audit log. Hooks called with a Request run
+// while the request is being handled, so they should be quick.
+type Hook func(e Event)
+
+// ExpiryNotifier is an optional interface a Storer can implement to report
+// the sessions removed by its cleaner. The StorageOverseer registers itself
+// with storers implementing it to raise EventExpire, until it is closed.
+type ExpiryNotifier interface {
+	// NotifyExpired registers fn to be called with the ID of every expired
+	// session that is removed. Calling the returned func unregisters fn.
+	NotifyExpired(fn func(key string)) (unregister func())
+}
+
+// expiryListener is a func registered with NotifyExpired
+type expiryListener struct {
+	fn func(key string)
+}
+
+// addExpiryListener adds fn to the listeners guarded by mut and returns
+// the func that removes it again. The listeners are copied on removal, so
+// that copies taken to notify without holding mut are left as they are.
+func addExpiryListener(mut sync.Locker, listeners *[]*expiryListener, fn func(key string)) func() {
+	listener := &expiryListener{fn: fn}
+
+	mut.Lock()
+	*listeners = append(*listeners, listener)
+	mut.Unlock()
+
+	return func() {
+		mut.Lock()
+		defer mut.Unlock()
+
+		for i, l := range *listeners {
+			if l == listener {
+				*listeners = append((*listeners)[:i:i], (*listeners)[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// fireHooks calls every hook with e
+func fireHooks(hooks []Hook, e Event) {
+	for _, hook := range hooks {
+		hook(e)
+	}
+}
+
+// notifyExpired calls every listener with each key
+func notifyExpired(listeners []*expiryListener, keys []string) {
+	for _, key := range keys {
+		for _, l := range listeners {
+			l.fn(key)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package abcsessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// recordHooks returns a hook that appends the events it receives to events
+func recordHooks(events *[]Event) []Hook {
+	return []Hook{func(e Event) {
+		*events = append(*events, e)
+	}}
+}
+
+// eventTypes returns the types of events
+func eventTypes(events []Event) []EventType {
+	types := make([]EventType, len(events))
+	for i, e := range events {
+		types[i] = e.Type
+	}
+
+	return types
+}
+
+func TestStorageOverseerHooks(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), m)
+
+	var events []Event
+	s.Hooks = recordHooks(&events)
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	if err := s.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(w, r, "world"); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := s.SessionID(w, r)
+
+	if err := s.Regenerate(w, r); err != nil {
+		t.Fatal(err)
+	}
+	newID, _ := s.SessionID(w, r)
+
+	if err := s.Del(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []EventType{EventCreate, EventRegenerate, EventDelete}
+	if got := eventTypes(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected events %v, got %v", want, got)
+	}
+	if events[0].SessionID != id || events[0].Request != r {
+		t.Errorf("unexpected create event: %#v", events[0])
+	}
+	if events[1].SessionID != newID || events[1].PreviousID != id {
+		t.Errorf("unexpected regenerate event: %#v", events[1])
+	}
+	if events[2].SessionID != newID {
+		t.Errorf("unexpected delete event: %#v", events[2])
+	}
+
+	// A session that only exists in the cookie is created again
+	events = nil
+	w = newSessionsResponseWriter(httptest.NewRecorder())
+	if err := s.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	id, _ = s.SessionID(w, r)
+	m.Del(id)
+	if err := s.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if got := eventTypes(events); !reflect.DeepEqual(got, []EventType{EventCreate, EventCreate}) {
+		t.Errorf("expected two create events, got %v", got)
+	}
+
+	// Expired sessions are reported by the cleaner, without a request
+	events = nil
+	m.Set("expired", "hello")
+	m.mut.Lock()
+	sess := m.sessions["expired"]
+	sess.expires = time.Now().AddDate(0, 0, -1)
+	m.sessions["expired"] = sess
+	m.mut.Unlock()
+	m.Clean()
+
+	if len(events) != 1 || events[0].Type != EventExpire || events[0].SessionID != "expired" || events[0].Request != nil {
+		t.Errorf("expected an expire event, got %#v", events)
+	}
+}
+
+func TestStorageOverseerHooksMiddleware(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	storer := &countingStorer{Storer: m}
+	s := NewStorageOverseer(NewCookieOptions(), storer)
+
+	var events []Event
+	s.Hooks = recordHooks(&events)
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if err := Set(s, w, r, "a", "1"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	Middleware(http.HandlerFunc(fn)).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie, got %d", len(cookies))
+	}
+	if got := eventTypes(events); !reflect.DeepEqual(got, []EventType{EventCreate}) {
+		t.Errorf("expected a create event, got %v", got)
+	}
+
+	// The hooks tell a changed session from a created one without
+	// looking it up again: once when loaded and once to merge the changes
+	events = nil
+	storer.gets = 0
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	Middleware(http.HandlerFunc(fn)).ServeHTTP(httptest.NewRecorder(), r)
+
+	if storer.gets != 2 {
+		t.Errorf("expected 2 gets, got %d", storer.gets)
+	}
+	if len(events) != 0 {
+		t.Errorf("expected no events, got %v", eventTypes(events))
+	}
+}
+
+func TestStorageOverseerClose(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), m)
+	other := NewStorageOverseer(NewCookieOptions(), m)
+
+	var events, otherEvents []Event
+	s.Hooks = recordHooks(&events)
+	other.Hooks = recordHooks(&otherEvents)
+
+	s.Close()
+
+	m.Set("expired", "hello")
+	m.mut.Lock()
+	sess := m.sessions["expired"]
+	sess.expires = time.Now().AddDate(0, 0, -1)
+	m.sessions["expired"] = sess
+	m.mut.Unlock()
+	m.Clean()
+
+	if len(events) != 0 {
+		t.Errorf("expected no events after close, got %v", eventTypes(events))
+	}
+	if len(otherEvents) != 1 || otherEvents[0].Type != EventExpire {
+		t.Errorf("expected an expire event, got %v", eventTypes(otherEvents))
+	}
+	if len(m.expired) != 1 {
+		t.Errorf("expected 1 listener, got %d", len(m.expired))
+	}
+}
+
+func TestStorageOverseerHooksPolicy(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), m)
+	s.Policy = Policy{AbsoluteTimeout: time.Hour}
+
+	var events []Event
+	s.Hooks = recordHooks(&events)
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	if err := s.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := s.SessionID(w, r)
+	if err := s.SetOwner(w, r, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DelOwner("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	id2, _ := s.SessionID(w, r)
+	m.Set(id2, testEnvelope(t, s.Policy, r, "hello", time.Hour*2, time.Minute))
+	if _, err := s.Get(w, r); !IsNoSessionError(err) {
+		t.Fatalf("expected no session error, got: %v", err)
+	}
+
+	want := []EventType{EventCreate, EventDelete, EventCreate, EventInvalidate}
+	if got := eventTypes(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected events %v, got %v", want, got)
+	}
+	if events[1].SessionID != id || events[1].Request != nil {
+		t.Errorf("unexpected delete owner event: %#v", events[1])
+	}
+	if events[3].SessionID != id2 || events[3].Err == nil {
+		t.Errorf("unexpected invalidate event: %#v", events[3])
+	}
+}
+
+func TestCookieOverseerHooks(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	c.Policy = Policy{Fingerprint: UserAgentFingerprint}
+
+	var events []Event
+	c.Hooks = recordHooks(&events)
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	if err := c.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(w, r, "world"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := c.SessionID(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Del(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("User-Agent", "curl")
+	if _, err := c.Get(w, r); !IsNoSessionError(err) {
+		t.Fatalf("expected no session error, got: %v", err)
+	}
+
+	want := []EventType{EventCreate, EventDelete, EventCreate, EventInvalidate}
+	if got := eventTypes(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected events %v, got %v", want, got)
+	}
+	// The events carry the ID sealed in the cookie
+	if len(id) == 0 || events[0].SessionID != id || events[1].SessionID != id {
+		t.Errorf("expected the events of session %q, got %#v", id, events[:2])
+	}
+}
+
+func TestMemoryStorerNotifyEvicted(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewLimitedMemoryStorer(0, 0, MemoryLimits{MaxSessions: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expired []string
+	m.NotifyExpired(func(key string) {
+		expired = append(expired, key)
+	})
+
+	m.Set("a", "1")
+	m.Set("b", "2")
+
+	if !reflect.DeepEqual(expired, []string{"a"}) {
+		t.Errorf("expected a to be reported, got %v", expired)
+	}
+}
+
+func TestDiskStorerNotifyExpired(t *testing.T) {
+	t.Parallel()
+
+	d, err := NewDiskStorer(filepath.Join(testpath, "notify"), time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expired []string
+	d.NotifyExpired(func(key string) {
+		expired = append(expired, key)
+	})
+
+	testid1 := uuid.NewV4().String()
+	testid2 := uuid.NewV4().String()
+	d.Set(testid1, "hello")
+	d.Set(testid2, "hello")
+
+	yesterday := time.Now().AddDate(0, 0, -1)
+	os.Chtimes(d.sessionPath(testid2), yesterday, yesterday)
+	d.Clean()
+
+	if !reflect.DeepEqual(expired, []string{testid2}) {
+		t.Errorf("expected %s to be reported, got %v", testid2, expired)
+	}
+}
@@ -0,0 +1,143 @@
+package abcsessions
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"github.com/friendsofgo/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// randomIDBytes is the number of random bytes in the IDs of the
+// RandomIDGenerator, 256 bits
+const randomIDBytes = 32
+
+// IDGenerator creates the session IDs of a StorageOverseer, and recognizes
+// the IDs it creates so that IDs made up by clients can be rejected without
+// looking them up in the Storer.
+type IDGenerator interface {
+	// NewID returns a new, unguessable session ID. The IDs are used as
+	// storer keys and must only contain letters, digits, dashes and
+	// underscores.
+	NewID() (string, error)
+	// ValidID returns true if id has the format of the IDs made by NewID
+	ValidID(id string) bool
+}
+
+// RandomIDGenerator is the default IDGenerator. It makes IDs of 256 random
+// bits encoded in unpadded base64url, 43 characters long.
+type RandomIDGenerator struct{}
+
+// NewID returns 256 random bits encoded in base64url
+func (RandomIDGenerator) NewID() (string, error) {
+	b := make([]byte, randomIDBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "unable to generate session id")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ValidID returns true if id is 256 bits encoded in base64url
+func (RandomIDGenerator) ValidID(id string) bool {
+	if len(id) != base64.RawURLEncoding.EncodedLen(randomIDBytes) {
+		return false
+	}
+
+	// Also rejects the non-canonical encodings of the last character
+	b, err := base64.RawURLEncoding.Strict().DecodeString(id)
+	return err == nil && len(b) == randomIDBytes
+}
+
+// UUIDGenerator makes UUIDv4 session IDs, which hold 122 random bits. It is
+// the format session IDs had before RandomIDGenerator became the default,
+// use it to keep the sessions of existing clients valid.
+type UUIDGenerator struct{}
+
+// NewID returns a new UUIDv4
+func (UUIDGenerator) NewID() (string, error) {
+	return uuid.NewV4().String(), nil
+}
+
+// ValidID returns true if the session key is a valid UUIDv4 format:
+// 8chars-4chars-4chars-4chars-12chars (chars are a-f 0-9)
+// Example: a668b3bb-0cf1-4627-8cd4-7f62d09ebad6
+func (UUIDGenerator) ValidID(key string) bool {
+	// UUIDv4's are 36 chars (16 bytes not including dashes)
+	if len(key) != 36 {
+		return false
+	}
+
+	// 0 indexed dash positions
+	dashPos := []int{8, 13, 18, 23}
+	for i := 0; i < len(key); i++ {
+		atDashPos := false
+		for _, pos := range dashPos {
+			if i == pos {
+				atDashPos = true
+				break
+			}
+		}
+
+		if atDashPos == true {
+			if key[i] != '-' {
+				return false
+			}
+			// continue the loop if dash is found
+			continue
+		}
+
+		// if not a dash, make sure char is a-f or 0-9
+		// 48 == '0', 57 == '9', 97 == 'a', 102 == 'f'
+		if key[i] < 48 || (key[i] > 57 && key[i] < 97) || key[i] > 102 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isIDChars returns true if s is only made of the characters of session
+// ids: letters, digits, dashes and underscores
+func isIDChars(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// signID appends the base64url HMAC-SHA256 signature of id made with key
+func signID(key []byte, id string) string {
+	return id + "." + idSignature(key, id)
+}
+
+// verifyID returns the ID of a value made by signID, and false if the
+// signature is missing or was not made with key
+func verifyID(key []byte, signed string) (string, bool) {
+	i := strings.LastIndexByte(signed, '.')
+	if i < 0 {
+		return "", false
+	}
+
+	id, sig := signed[:i], signed[i+1:]
+	if subtle.ConstantTimeCompare([]byte(sig), []byte(idSignature(key, id))) != 1 {
+		return "", false
+	}
+
+	return id, true
+}
+
+// idSignature returns the base64url HMAC-SHA256 of id made with key
+func idSignature(key []byte, id string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,171 @@
+package abcsessions
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRandomIDGenerator(t *testing.T) {
+	t.Parallel()
+
+	gen := RandomIDGenerator{}
+
+	id1, err := gen.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, _ := gen.NewID()
+
+	if len(id1) != 43 {
+		t.Errorf("expected a 43 chars id, got %q", id1)
+	}
+	if id1 == id2 {
+		t.Error("expected different ids")
+	}
+	if !gen.ValidID(id1) || !validDiskKey(id1) {
+		t.Errorf("expected %q to be valid", id1)
+	}
+
+	invalid := []string{
+		"",
+		id1[:42],
+		id1 + "A",
+		"a668b3bb-0cf1-4627-8cd4-7f62d09ebad6",
+		strings.Repeat("/", 43),
+		strings.Repeat("+", 43),
+		// Non-canonical encoding of the last byte
+		strings.Repeat("A", 42) + "B",
+	}
+
+	for i, id := range invalid {
+		if gen.ValidID(id) {
+			t.Errorf("%d) expected %q to be invalid", i, id)
+		}
+	}
+}
+
+func TestUUIDGeneratorValidID(t *testing.T) {
+	t.Parallel()
+
+	// Example:
+	keys := map[string]bool{
+		"a668b3bb-0cf1-4627-8cd4-7f62d09ebad6": true,
+		"a668b3bf-0cf9-a629-fcd0-7aaaaaaaaaaa": true,
+		// too short
+		"668b3bf-0cf9-a629-fcd0-7aaaaaaaaaaa": false,
+		// too long
+		"668b3bf-0cf9-a629-fcd0-7aaaaaaaaaaaaa": false,
+		// invalid chars and positions
+		"/668b3bf-0cf9-a629-fcd0-7aaaaaaaaaaa": false,
+		"a668b3bf-0cf9-a6:9-fcd0-7aaaaaaaaaaa": false,
+		"a668b3bf-0cf9-a6z9-fcd0-7a`aaaaaaaaa": false,
+		"a668b3bf-0cf9-a6z9-fcd0-7aaaaaaaaaag": false,
+		"a668b3bfa0cf9aa6z9afcd0a7aaaaaaaaaaa": false,
+		"a668b3b-f0cf9-a6z9-fcd0-7aaaaaaaaaaa": false,
+		"a668b3bf-0cf-9a6z9-fcd0-7aaaaaaaaaaa": false,
+		"a668b3bf-0cf9-a6z-9fcd0-7aaaaaaaaaaa": false,
+		"a668b3bf-0cf9-a6z9-fcd-07aaaaaaaaaaa": false,
+		"a668b3b-f0cf-fa6z-ffcf-07aaaaaaaaaaa": false,
+	}
+
+	for key, valid := range keys {
+		v := UUIDGenerator{}.ValidID(key)
+
+		if valid != v {
+			t.Errorf("key %s, expected validity to be: %t, got %t", key, valid, v)
+		}
+	}
+}
+
+func TestSignID(t *testing.T) {
+	t.Parallel()
+
+	key := []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	signed := signID(key, "abc")
+
+	if id, ok := verifyID(key, signed); !ok || id != "abc" {
+		t.Errorf("expected %q to verify, got %q %t", signed, id, ok)
+	}
+
+	invalid := []string{
+		"abc",
+		"abd" + signed[3:],
+		signed + "a",
+		signID([]byte("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"), "abc"),
+	}
+
+	for i, value := range invalid {
+		if _, ok := verifyID(key, value); ok {
+			t.Errorf("%d) expected %q to be rejected", i, value)
+		}
+	}
+}
+
+func TestStorageOverseerSigningKey(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewHeaderOverseer(NewHeaderOptions(), m)
+	s.SigningKey = testCookieKey
+
+	w := httptest.NewRecorder()
+	if err := s.Set(w, httptest.NewRequest("GET", "/", nil), "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	token := w.Header().Get("X-Session-Token")
+	id, ok := verifyID(s.SigningKey, token)
+	if !ok || !(RandomIDGenerator{}).ValidID(id) {
+		t.Fatalf("expected a signed session id, got %q", token)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Session-Token", token)
+	if val, err := s.Get(httptest.NewRecorder(), r); err != nil || val != "hello" {
+		t.Errorf("expected %q, got %q: %v", "hello", val, err)
+	}
+	if got, _ := s.SessionID(httptest.NewRecorder(), r); got != id {
+		t.Errorf("expected the unsigned id %q, got %q", id, got)
+	}
+
+	// The bare id and forged signatures are rejected
+	for _, forged := range []string{id, id + ".abc", signID([]byte("other"), id)} {
+		r = httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Session-Token", forged)
+		if _, err := s.Get(httptest.NewRecorder(), r); !IsNoSessionError(err) {
+			t.Errorf("expected no session error for %q, got: %v", forged, err)
+		}
+	}
+}
+
+func TestStorageOverseerIDGenerator(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewHeaderOverseer(NewHeaderOptions(), m)
+	s.IDGenerator = UUIDGenerator{}
+
+	w := httptest.NewRecorder()
+	if err := s.Set(w, httptest.NewRequest("GET", "/", nil), "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	token := w.Header().Get("X-Session-Token")
+	if !(UUIDGenerator{}).ValidID(token) {
+		t.Fatalf("expected a uuid session id, got %q", token)
+	}
+
+	// Ids of another format are not looked up
+	counting := &countingStorer{Storer: m}
+	s.Storer = counting
+	other, _ := RandomIDGenerator{}.NewID()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Session-Token", other)
+	if _, err := s.Get(httptest.NewRecorder(), r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if counting.gets != 0 {
+		t.Errorf("expected no storer lookups, got %d", counting.gets)
+	}
+}
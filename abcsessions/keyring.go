@@ -0,0 +1,181 @@
+package abcsessions
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+
+	"github.com/friendsofgo/errors"
+)
+
+// DefaultKeyID is the key ID given to the secret key passed to
+// NewCookieOverseer. Use it as the ID of that key when moving to a Keyring
+// so that existing cookies can still be decrypted.
+const DefaultKeyID = "0"
+
+// keyIDSeparator separates the key ID from the base64 encoded ciphertext.
+// It is not part of the standard base64 alphabet, which is how values that
+// were sealed before key IDs existed are told apart.
+const keyIDSeparator = "."
+
+// Keyring holds the AES-GCM keys used to seal session data. One key is
+// active and encrypts all new values, every key in the ring (including the
+// active one) can decrypt. This allows keys to be rotated without
+// invalidating every existing session at once: add a new key, make it
+// active, and remove the old key once everything sealed with it has expired.
+//
+// Sealed values are prefixed with the ID of the key that sealed them,
+// so opening a value only ever tries one key.
+type Keyring struct {
+	active string
+	aeads  map[string]cipher.AEAD
+}
+
+// NewKeyring creates a keyring from keys, a mapping of key IDs to AES keys
+// (16, 24 or 32 bytes long). activeID is the ID of the key used to encrypt
+// and must be present in keys. Key IDs may only contain letters, digits,
+// '-' and '_'.
+func NewKeyring(activeID string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[activeID]; !ok {
+		return nil, errors.Errorf("active key %q is not in the keyring", activeID)
+	}
+
+	k := &Keyring{
+		active: activeID,
+		aeads:  make(map[string]cipher.AEAD, len(keys)),
+	}
+
+	for id, key := range keys {
+		if !validKeyID(id) {
+			return nil, errors.Errorf("invalid key id %q", id)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key %q", id)
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key %q", id)
+		}
+
+		k.aeads[id] = gcm
+	}
+
+	return k, nil
+}
+
+// ActiveKeyID returns the ID of the key used to seal new values
+func (k *Keyring) ActiveKeyID() string {
+	return k.active
+}
+
+// seal encrypts plaintext with the active key and returns it as
+// "keyID.base64(nonce|ciphertext)". The key ID and additionalData are
+// authenticated but not encrypted.
+func (k *Keyring) seal(plaintext string, additionalData []byte) (string, error) {
+	gcm := k.aeads[k.active]
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "unable to generate nonce")
+	}
+
+	// Append ciphertext to the end of nonce so we have the nonce for decrypt
+	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), k.additionalData(k.active, additionalData))
+	return k.active + keyIDSeparator + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// open decrypts a value created by seal. It also returns whether the value
+// was sealed with a key other than the active key, in which case the caller
+// should seal it again.
+//
+// Values that carry no key ID were sealed by a single key CookieOverseer
+// before keyrings existed. Those are tried against every key with no
+// additional data.
+func (k *Keyring) open(sealed string, additionalData []byte) (plaintext string, stale bool, err error) {
+	id, encoded := sealedKeyID(sealed)
+
+	ct, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false, errors.Wrap(err, "unable to base64 decode sealed value")
+	}
+
+	if len(id) == 0 {
+		for _, gcm := range k.aeads {
+			pt, err := openGCM(gcm, ct, nil)
+			if err == nil {
+				return string(pt), true, nil
+			}
+		}
+		return "", false, errors.New("unable to open sealed value with any key")
+	}
+
+	gcm, ok := k.aeads[id]
+	if !ok {
+		return "", false, errors.Errorf("unknown key id %q", id)
+	}
+
+	pt, err := openGCM(gcm, ct, k.additionalData(id, additionalData))
+	if err != nil {
+		return "", false, err
+	}
+
+	return string(pt), id != k.active, nil
+}
+
+// isStale reports whether sealed was not sealed with the active key,
+// without decrypting it.
+func (k *Keyring) isStale(sealed string) bool {
+	id, _ := sealedKeyID(sealed)
+	return id != k.active
+}
+
+func (k *Keyring) additionalData(id string, additionalData []byte) []byte {
+	return append([]byte(id+keyIDSeparator), additionalData...)
+}
+
+// sealedKeyID splits a sealed value into its key ID and encoded ciphertext.
+// The key ID is empty for values sealed before key IDs existed.
+func sealedKeyID(sealed string) (id string, encoded string) {
+	i := strings.Index(sealed, keyIDSeparator)
+	if i < 0 {
+		return "", sealed
+	}
+
+	return sealed[:i], sealed[i+1:]
+}
+
+// openGCM opens a nonce|ciphertext value
+func openGCM(gcm cipher.AEAD, ct []byte, additionalData []byte) ([]byte, error) {
+	if len(ct) <= gcm.NonceSize() {
+		return nil, errors.New("sealed value is too short")
+	}
+
+	// Nonce comes from the first n bytes (n = NonceSize)
+	pt, err := gcm.Open(nil, ct[:gcm.NonceSize()], ct[gcm.NonceSize():], additionalData)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open gcm block mode")
+	}
+
+	return pt, nil
+}
+
+// validKeyID returns true if id is non-empty and only made up of
+// letters, digits, '-' and '_'
+func validKeyID(id string) bool {
+	if len(id) == 0 {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
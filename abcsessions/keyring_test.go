@@ -0,0 +1,113 @@
+package abcsessions
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewKeyring(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		active string
+		keys   map[string][]byte
+		ok     bool
+	}{
+		{"a", map[string][]byte{"a": testCookieKey}, true},
+		{"a", map[string][]byte{"a": testCookieKey, "b-2_c": testCookieKey[:16]}, true},
+		{"b", map[string][]byte{"a": testCookieKey}, false},
+		{"a", map[string][]byte{"a": testCookieKey, "b.c": testCookieKey}, false},
+		{"", map[string][]byte{"": testCookieKey}, false},
+		{"a", map[string][]byte{"a": []byte("short")}, false},
+	}
+
+	for i, test := range tests {
+		_, err := NewKeyring(test.active, test.keys)
+		if test.ok && err != nil {
+			t.Errorf("%d) unexpected error: %v", i, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%d) expected an error", i)
+		}
+	}
+}
+
+func TestKeyringSealOpen(t *testing.T) {
+	t.Parallel()
+
+	k, err := NewKeyring("a", map[string][]byte{"a": testCookieKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := k.seal("hello world", []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, "a.") {
+		t.Errorf("expected key id prefix, got: %s", sealed)
+	}
+	if k.isStale(sealed) {
+		t.Error("value sealed with the active key should not be stale")
+	}
+
+	pt, stale, err := k.open(sealed, []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt != "hello world" {
+		t.Error("plaintext was wrong:", pt)
+	}
+	if stale {
+		t.Error("value sealed with the active key should not be stale")
+	}
+
+	if _, _, err = k.open(sealed, []byte("other")); err == nil {
+		t.Error("expected different additional data to fail")
+	}
+
+	// Swapping the key id must fail authentication
+	k2, err := NewKeyring("a", map[string][]byte{"a": testCookieKey, "b": testCookieKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = k2.open("b"+sealed[1:], []byte("ad")); err == nil {
+		t.Error("expected a swapped key id to fail")
+	}
+
+	if _, _, err = k.open("c"+sealed[1:], []byte("ad")); err == nil {
+		t.Error("expected an unknown key id to fail")
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	t.Parallel()
+
+	old, err := NewKeyring("1", map[string][]byte{"1": testCookieKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := old.seal("hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := NewKeyring("2", map[string][]byte{
+		"1": testCookieKey,
+		"2": []byte("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !k.isStale(sealed) {
+		t.Error("expected value sealed with an old key to be stale")
+	}
+
+	pt, stale, err := k.open(sealed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt != "hello" || !stale {
+		t.Errorf("expected stale hello, got %q %t", pt, stale)
+	}
+}
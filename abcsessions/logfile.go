@@ -0,0 +1,983 @@
+package abcsessions
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/friendsofgo/errors"
+)
+
+const (
+	// logMagic starts every session log file
+	logMagic = "abcslog1"
+	// logHeaderLen is the length of a record header: crc (4), op (1),
+	// expires (8), key length (4) and value length (4)
+	logHeaderLen = 21
+	// logMaxKeyLen is the length of the longest session id
+	logMaxKeyLen = 1 << 16
+	// logMaxValueLen is the length of the longest session value
+	logMaxValueLen = 1 << 30
+	// logCompactMinBytes is the amount of dead records a log must hold
+	// before Clean compacts it
+	logCompactMinBytes = 1 << 20
+	// logCompactSuffix is appended to the path of the log being compacted
+	logCompactSuffix = ".compact"
+	// logLockSuffix is appended to the path of the log to name its lock file
+	logLockSuffix = ".lock"
+)
+
+// logOp is the operation recorded by a log record
+type logOp byte
+
+const (
+	// logOpSet sets the value and the expiry of a session
+	logOpSet logOp = iota + 1
+	// logOpDel deletes a session
+	logOpDel
+	// logOpTouch resets the expiry of a session
+	logOpTouch
+	// logOpOwner sets the owner of a session, which is the record value
+	logOpOwner
+)
+
+// logCRCTable is the table of the record checksums
+var logCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// LogStorer is a session storer implementation for saving sessions to a
+// single append-only log file, for deployments that want sessions to
+// survive restarts without running Redis or a database.
+//
+// Every change is appended to the file as a checksummed record, and an
+// in-memory index holds the offset of the value and the expiry of every
+// session, so that Get is a single read and All does not touch the disk.
+// Deleted, overwritten and expired sessions leave dead records behind, the
+// cleaner compacts the file by rewriting the live sessions to a new file
+// once the dead records outweigh them, see Compact.
+//
+// The file is replayed to rebuild the index when the storer is created. A
+// record torn by a crash in the middle of a write is discarded along with
+// everything after it. Records are not synced to the disk one by one: a
+// crash of the process loses nothing, but a power loss can lose the changes
+// made since the last Clean, Compact or Close, which sync the file.
+//
+// The file is locked by the storer, it can only be used by a single process
+// at a time. On systems without flock it is not locked.
+type LogStorer struct {
+	// Path to the log file
+	filePath string
+	// How long sessions take to expire
+	maxAge time.Duration
+	// How often expired sessions should be removed
+	cleanInterval time.Duration
+	// file is the log, nil once the storer is closed
+	file *os.File
+	// lock is the lock file held while the log is open
+	lock *os.File
+	// size is the length of the log, new records are written there
+	size int64
+	// live is the length of the records of the live sessions
+	live int64
+	// index maps the session ids to the location of their value
+	index map[string]logEntry
+	// owners maps owners to the ids of their sessions
+	owners map[string]map[string]struct{}
+	// expired are called with the ids of cleaned sessions
+	expired []*expiryListener
+	// Log storage mutex
+	mut sync.RWMutex
+	// wg is used to manage the cleaner loop
+	wg sync.WaitGroup
+	// quit channel for exiting the cleaner loop
+	quit chan struct{}
+
+	// ErrorLog is the logger for the errors of Clean, after which the old
+	// log is kept and the compaction is retried on the next clean interval.
+	// The standard logger of the log package is used when nil.
+	ErrorLog *log.Logger
+}
+
+// logEntry is the index entry of a session
+type logEntry struct {
+	// offset and length locate the value in the log
+	offset int64
+	length int64
+	// size is the length of the records needed to restore the session,
+	// its last set record and owner record
+	size int64
+	// expires is the unix time in nanoseconds the session expires at,
+	// zero if it never expires
+	expires int64
+	owner   string
+	// ownerSize is the length of the owner record
+	ownerSize int64
+}
+
+// isExpired returns true if the session expired at the unix time now
+func (e logEntry) isExpired(now int64) bool {
+	return e.expires != 0 && e.expires <= now
+}
+
+// logRecord is a decoded log record
+type logRecord struct {
+	op      logOp
+	expires int64
+	key     string
+	value   string
+}
+
+// NewDefaultLogStorer returns a LogStorer object with default values.
+// The default values are:
+// filePath: system tmp dir + file name
+// maxAge: 2 days (clear session stored on server after 2 days)
+// cleanInterval: 1 hour (delete sessions older than maxAge every 1 hour)
+func NewDefaultLogStorer(tmpFile string) (*LogStorer, error) {
+	return NewLogStorer(filepath.Join(os.TempDir(), tmpFile), time.Hour*24*2, time.Hour)
+}
+
+// NewLogStorer opens the log file at filePath, creating it if it does not
+// exist, and returns a new LogStorer object. The sessions in the file are
+// loaded, and a record torn by a crash is removed from its end.
+// It takes the maxAge of how long each session should live, and a
+// cleanInterval duration which defines how often the clean task should
+// remove the expired sessions and compact the file.
+// Persistent storage can be attained by setting maxAge and cleanInterval
+// to zero.
+func NewLogStorer(filePath string, maxAge, cleanInterval time.Duration) (*LogStorer, error) {
+	if (maxAge != 0 && cleanInterval == 0) || (cleanInterval != 0 && maxAge == 0) {
+		panic("if max age or clean interval is set, the other must also be set")
+	}
+
+	l := &LogStorer{
+		filePath:      filePath,
+		maxAge:        maxAge,
+		cleanInterval: cleanInterval,
+		index:         make(map[string]logEntry),
+		owners:        make(map[string]map[string]struct{}),
+	}
+
+	lock, err := tryLockFile(filePath + logLockSuffix)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to lock session log: %s", filePath)
+	}
+	l.lock = lock
+
+	if err := l.open(); err != nil {
+		_ = unlockFile(lock)
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// open opens the log file and replays it into the index
+func (l *LogStorer) open() error {
+	// A compaction that did not finish is abandoned, the log it was
+	// replacing is still complete
+	if err := removeIfExists(l.filePath + logCompactSuffix); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(l.filePath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open session log: %s", l.filePath)
+	}
+
+	if err := l.replay(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	return nil
+}
+
+// replay reads the records of the log into the index. A torn record left at
+// the end of the log by a crash is truncated, but a corrupt record followed
+// by other records is an error, so that the records after it are not lost.
+func (l *LogStorer) replay(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "unable to stat session log: %s", l.filePath)
+	}
+
+	// A new log, or one whose magic was torn by a crash right after it
+	// was created
+	if info.Size() < int64(len(logMagic)) {
+		start := make([]byte, info.Size())
+		if _, err := io.ReadFull(f, start); err != nil {
+			return errors.Wrapf(err, "unable to read session log: %s", l.filePath)
+		}
+		if !strings.HasPrefix(logMagic, string(start)) {
+			return errors.Errorf("%s is not a session log", l.filePath)
+		}
+
+		if err := f.Truncate(0); err != nil {
+			return errors.Wrapf(err, "unable to truncate session log: %s", l.filePath)
+		}
+		if _, err := f.WriteAt([]byte(logMagic), 0); err != nil {
+			return errors.Wrapf(err, "unable to write session log: %s", l.filePath)
+		}
+		l.size = int64(len(logMagic))
+		return nil
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f, 0, info.Size()))
+
+	magic := make([]byte, len(logMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return errors.Wrapf(err, "unable to read session log: %s", l.filePath)
+	}
+	if string(magic) != logMagic {
+		return errors.Errorf("%s is not a session log", l.filePath)
+	}
+
+	offset := int64(len(logMagic))
+	for offset != info.Size() {
+		rec, n, err := readLogRecord(r, info.Size()-offset)
+		if err != nil {
+			torn, tornErr := isTornLogTail(f, err, offset, n, info.Size())
+			if tornErr != nil {
+				return errors.Wrapf(tornErr, "unable to read session log: %s", l.filePath)
+			}
+			if !torn {
+				return errors.Wrapf(err, "session log %s is corrupt at offset %d", l.filePath, offset)
+			}
+
+			// Drop the torn record left by a crash
+			if err := f.Truncate(offset); err != nil {
+				return errors.Wrapf(err, "unable to truncate session log: %s", l.filePath)
+			}
+			break
+		}
+		l.apply(rec, offset, n)
+		offset += n
+	}
+	l.size = offset
+
+	// Sessions that expired while the storer was not running
+	now := time.Now().UnixNano()
+	for key, entry := range l.index {
+		if entry.isExpired(now) {
+			l.remove(key)
+		}
+	}
+
+	return nil
+}
+
+// apply updates the index with a record of n bytes found at offset.
+// The caller must hold the write lock.
+func (l *LogStorer) apply(rec logRecord, offset, n int64) {
+	entry, ok := l.index[rec.key]
+
+	switch rec.op {
+	case logOpSet:
+		l.live -= entry.size
+		entry.offset = offset + logHeaderLen + int64(len(rec.key))
+		entry.length = int64(len(rec.value))
+		entry.size = n
+		entry.expires = rec.expires
+		l.live += n
+		l.index[rec.key] = entry
+	case logOpDel:
+		l.remove(rec.key)
+	case logOpTouch:
+		if ok {
+			entry.expires = rec.expires
+			l.index[rec.key] = entry
+		}
+	case logOpOwner:
+		if ok {
+			l.delOwnerIndex(rec.key)
+			entry = l.index[rec.key]
+			if len(rec.value) != 0 {
+				entry.owner = rec.value
+				entry.ownerSize = n
+				l.live += n
+			}
+			l.index[rec.key] = entry
+			l.addOwnerIndex(rec.key, rec.value)
+		}
+	}
+}
+
+// All keys in the log store
+func (l *LogStorer) All() ([]string, error) {
+	l.mut.RLock()
+	defer l.mut.RUnlock()
+
+	now := time.Now().UnixNano()
+	sessions := make([]string, 0, len(l.index))
+	for key, entry := range l.index {
+		if !entry.isExpired(now) {
+			sessions = append(sessions, key)
+		}
+	}
+
+	return sessions, nil
+}
+
+// Get returns the value string saved in the session pointed to by the
+// session id key.
+func (l *LogStorer) Get(key string) (value string, err error) {
+	l.mut.RLock()
+	defer l.mut.RUnlock()
+
+	return l.read(key)
+}
+
+// read returns the value of the session id key. The caller must hold
+// the lock.
+func (l *LogStorer) read(key string) (string, error) {
+	if l.file == nil {
+		return "", errLogClosed()
+	}
+
+	entry, ok := l.index[key]
+	if !ok || entry.isExpired(time.Now().UnixNano()) {
+		return "", errNoSession{}
+	}
+
+	b := make([]byte, entry.length)
+	if _, err := l.file.ReadAt(b, entry.offset); err != nil {
+		return "", errors.Wrapf(err, "unable to read session log: %s", l.filePath)
+	}
+
+	return string(b), nil
+}
+
+// Set saves the value string to the session pointed to by the session id key.
+func (l *LogStorer) Set(key, value string) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	return l.write(key, value)
+}
+
+// write appends the value of the session id key to the log. The caller
+// must hold the write lock.
+func (l *LogStorer) write(key, value string) error {
+	if int64(len(value)) > logMaxValueLen {
+		return errors.Errorf("session of %d bytes exceeds the log storer limit of %d bytes", len(value), logMaxValueLen)
+	}
+
+	return l.append(logRecord{op: logOpSet, expires: l.expiry(), key: key, value: value})
+}
+
+// GetVersioned returns the value of the session pointed to by the session
+// id key and its version, see VersionedStorer
+func (l *LogStorer) GetVersioned(ctx context.Context, key string) (string, string, error) {
+	value, err := l.GetContext(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	return value, valueVersion(value), nil
+}
+
+// TTL returns the time left before the session pointed to by the session
+// id key expires, see TTLStorer
+func (l *LogStorer) TTL(ctx context.Context, key string) (time.Duration, time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	l.mut.RLock()
+	entry, ok := l.index[key]
+	l.mut.RUnlock()
+
+	if !ok || entry.isExpired(time.Now().UnixNano()) {
+		return 0, 0, errNoSession{}
+	}
+	if l.maxAge == 0 {
+		return 0, 0, nil
+	}
+
+	return remainingTTL(time.Unix(0, entry.expires)), l.maxAge, nil
+}
+
+// CompareAndSet saves the value string to the session pointed to by the
+// session id key if it is still at version, see VersionedStorer
+func (l *LogStorer) CompareAndSet(ctx context.Context, key, value, version string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	current, err := l.read(key)
+	exists := err == nil
+	if err != nil && !IsNoSessionError(err) {
+		return err
+	}
+	if exists != (len(version) != 0) || (exists && valueVersion(current) != version) {
+		return errVersionConflict{}
+	}
+
+	return l.write(key, value)
+}
+
+// Del the session pointed to by the session id key and remove it.
+func (l *LogStorer) Del(key string) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if _, ok := l.index[key]; !ok {
+		return nil
+	}
+
+	return l.append(logRecord{op: logOpDel, key: key})
+}
+
+// ResetExpiry resets the expiry of the key
+func (l *LogStorer) ResetExpiry(key string) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	entry, ok := l.index[key]
+	if !ok || entry.isExpired(time.Now().UnixNano()) {
+		return errNoSession{}
+	}
+	if l.maxAge == 0 {
+		return nil
+	}
+
+	return l.append(logRecord{op: logOpTouch, expires: l.expiry(), key: key})
+}
+
+// SetOwner attaches the session pointed to by the session id key to owner
+func (l *LogStorer) SetOwner(key, owner string) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	entry, ok := l.index[key]
+	if !ok || entry.isExpired(time.Now().UnixNano()) {
+		return errNoSession{}
+	}
+
+	return l.append(logRecord{op: logOpOwner, key: key, value: owner})
+}
+
+// Owner returns the owner of the session pointed to by the session id key
+func (l *LogStorer) Owner(key string) (string, error) {
+	l.mut.RLock()
+	defer l.mut.RUnlock()
+
+	return l.index[key].owner, nil
+}
+
+// OwnerSessions returns the session ids of all sessions of owner
+func (l *LogStorer) OwnerSessions(owner string) ([]string, error) {
+	l.mut.RLock()
+	defer l.mut.RUnlock()
+
+	ids := l.owners[owner]
+	sessions := make([]string, 0, len(ids))
+	for id := range ids {
+		sessions = append(sessions, id)
+	}
+
+	return sessions, nil
+}
+
+// DelOwner deletes all sessions of owner
+func (l *LogStorer) DelOwner(owner string) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	for id := range l.owners[owner] {
+		if err := l.append(logRecord{op: logOpDel, key: id}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AllContext is All that fails early if ctx is already done
+func (l *LogStorer) AllContext(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return l.All()
+}
+
+// GetContext is Get that fails early if ctx is already done
+func (l *LogStorer) GetContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return l.Get(key)
+}
+
+// SetContext is Set that fails early if ctx is already done
+func (l *LogStorer) SetContext(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.Set(key, value)
+}
+
+// DelContext is Del that fails early if ctx is already done
+func (l *LogStorer) DelContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.Del(key)
+}
+
+// ResetExpiryContext is ResetExpiry that fails early if ctx is already done
+func (l *LogStorer) ResetExpiryContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.ResetExpiry(key)
+}
+
+// NotifyExpired registers fn to be called with the id of every session
+// removed by the cleaner
+func (l *LogStorer) NotifyExpired(fn func(key string)) func() {
+	return addExpiryListener(&l.mut, &l.expired, fn)
+}
+
+// Clean removes the expired sessions from the index, compacts the log if
+// its dead records outweigh the live sessions and syncs it to the disk.
+// A failed compaction or sync, such as when the disk is full, is written to
+// the ErrorLog and the old log is kept, instead of taking down the app.
+func (l *LogStorer) Clean() {
+	now := time.Now().UnixNano()
+	var cleaned []string
+
+	l.mut.Lock()
+	for key, entry := range l.index {
+		if entry.isExpired(now) {
+			l.remove(key)
+			cleaned = append(cleaned, key)
+		}
+	}
+
+	var err error
+	if l.file != nil {
+		if dead := l.size - int64(len(logMagic)) - l.live; dead >= logCompactMinBytes && dead >= l.live {
+			err = l.compact()
+		} else if err = l.file.Sync(); err != nil {
+			err = errors.Wrapf(err, "unable to sync session log: %s", l.filePath)
+		}
+	}
+	expired := l.expired
+	l.mut.Unlock()
+
+	if err != nil {
+		logCleanError(l.ErrorLog, err)
+	}
+
+	notifyExpired(expired, cleaned)
+}
+
+// Compact rewrites the log with only the records of the live sessions.
+// The new log is written next to the old one and renamed over it once it
+// is synced, so a crash during the compaction leaves the old log in place.
+// Clean compacts the log when needed, calling Compact is only required to
+// shrink the log right away. The storer is locked during the compaction.
+func (l *LogStorer) Compact() error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	return l.compact()
+}
+
+// compact rewrites the log, see Compact. The caller must hold the write
+// lock.
+func (l *LogStorer) compact() error {
+	if l.file == nil {
+		return errLogClosed()
+	}
+
+	tmpPath := l.filePath + logCompactSuffix
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create compacted session log: %s", tmpPath)
+	}
+
+	index := make(map[string]logEntry, len(l.index))
+	size, live, err := l.copyLive(tmp, index)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, l.filePath)
+	}
+	if err != nil {
+		tmp.Close()
+		_ = os.Remove(tmpPath)
+		return errors.Wrapf(err, "unable to compact session log: %s", l.filePath)
+	}
+	syncDir(filepath.Dir(l.filePath))
+
+	l.file.Close()
+	l.file = tmp
+	l.index = index
+	l.size = size
+	l.live = live
+
+	return nil
+}
+
+// copyLive writes the records of the live sessions to w, filling index
+// with their new location, and returns the length of the new log and of
+// its records. The caller must hold the write lock.
+func (l *LogStorer) copyLive(w io.Writer, index map[string]logEntry) (size, live int64, err error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(logMagic); err != nil {
+		return 0, 0, err
+	}
+	size = int64(len(logMagic))
+
+	for key, entry := range l.index {
+		value, err := l.read(key)
+		if IsNoSessionError(err) {
+			// Expired, it will not be read anymore
+			continue
+		} else if err != nil {
+			return 0, 0, err
+		}
+
+		b := encodeLogRecord(logRecord{op: logOpSet, expires: entry.expires, key: key, value: value})
+		if _, err := bw.Write(b); err != nil {
+			return 0, 0, err
+		}
+
+		newEntry := entry
+		newEntry.offset = size + logHeaderLen + int64(len(key))
+		newEntry.size = int64(len(b))
+		size += int64(len(b))
+
+		if len(entry.owner) != 0 {
+			b = encodeLogRecord(logRecord{op: logOpOwner, key: key, value: entry.owner})
+			if _, err := bw.Write(b); err != nil {
+				return 0, 0, err
+			}
+			newEntry.ownerSize = int64(len(b))
+			size += int64(len(b))
+		}
+
+		index[key] = newEntry
+		live += newEntry.size + newEntry.ownerSize
+	}
+
+	return size, live, bw.Flush()
+}
+
+// Close syncs and closes the log file and releases its lock. The storer
+// can not be used anymore, stop its cleaner before closing it.
+func (l *LogStorer) Close() error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Sync()
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	l.file = nil
+	if uerr := unlockFile(l.lock); err == nil {
+		err = uerr
+	}
+
+	return errors.Wrapf(err, "unable to close session log: %s", l.filePath)
+}
+
+// StartCleaner starts the log session cleaner go routine. This go routine
+// will delete expired sessions and compact the log on the cleanInterval
+// interval.
+func (l *LogStorer) StartCleaner() {
+	if l.maxAge == 0 || l.cleanInterval == 0 {
+		panic("both max age and clean interval must be set to non-zero")
+	}
+
+	// init quit chan
+	l.quit = make(chan struct{})
+
+	l.wg.Add(1)
+
+	// Start the cleaner infinite loop go routine.
+	// StopCleaner() can be used to kill this go routine.
+	go l.cleanerLoop()
+}
+
+// StopCleaner stops the cleaner go routine
+func (l *LogStorer) StopCleaner() {
+	close(l.quit)
+	l.wg.Wait()
+}
+
+// cleanerLoop executes the Clean() method every time cleanInterval elapses.
+// StopCleaner() can be used to kill this go routine loop.
+func (l *LogStorer) cleanerLoop() {
+	defer l.wg.Done()
+
+	t, c := timerTestHarness(l.cleanInterval)
+
+	for {
+		select {
+		case <-c:
+			l.Clean()
+			t.Reset(l.cleanInterval)
+		case <-l.quit:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// append writes a record at the end of the log and applies it to the
+// index. The caller must hold the write lock.
+func (l *LogStorer) append(rec logRecord) error {
+	if l.file == nil {
+		return errLogClosed()
+	}
+	if len(rec.key) == 0 || len(rec.key) > logMaxKeyLen {
+		return errors.Errorf("session id of %d bytes can not be stored in the session log", len(rec.key))
+	}
+
+	b := encodeLogRecord(rec)
+	if _, err := l.file.WriteAt(b, l.size); err != nil {
+		// Do not leave part of the record behind
+		_ = l.file.Truncate(l.size)
+		return errors.Wrapf(err, "unable to write session log: %s", l.filePath)
+	}
+
+	l.apply(rec, l.size, int64(len(b)))
+	l.size += int64(len(b))
+
+	return nil
+}
+
+// remove deletes the session id key from the index along with its owner.
+// The caller must hold the write lock.
+func (l *LogStorer) remove(key string) {
+	entry, ok := l.index[key]
+	if !ok {
+		return
+	}
+
+	l.delOwnerIndex(key)
+	l.live -= entry.size
+	delete(l.index, key)
+}
+
+// addOwnerIndex adds the session id key to the sessions of owner.
+// The caller must hold the write lock.
+func (l *LogStorer) addOwnerIndex(key, owner string) {
+	if len(owner) == 0 {
+		return
+	}
+
+	ids, ok := l.owners[owner]
+	if !ok {
+		ids = make(map[string]struct{})
+		l.owners[owner] = ids
+	}
+	ids[key] = struct{}{}
+}
+
+// delOwnerIndex removes the owner of the session id key.
+// The caller must hold the write lock.
+func (l *LogStorer) delOwnerIndex(key string) {
+	entry, ok := l.index[key]
+	if !ok || len(entry.owner) == 0 {
+		return
+	}
+
+	delete(l.owners[entry.owner], key)
+	if len(l.owners[entry.owner]) == 0 {
+		delete(l.owners, entry.owner)
+	}
+
+	l.live -= entry.ownerSize
+	entry.owner = ""
+	entry.ownerSize = 0
+	l.index[key] = entry
+}
+
+// expiry returns the expiry of a session set or reset now
+func (l *LogStorer) expiry() int64 {
+	if l.maxAge == 0 {
+		return 0
+	}
+
+	return time.Now().Add(l.maxAge).UnixNano()
+}
+
+// encodeLogRecord returns the bytes of a log record
+func encodeLogRecord(rec logRecord) []byte {
+	b := make([]byte, logHeaderLen+len(rec.key)+len(rec.value))
+	b[4] = byte(rec.op)
+	binary.BigEndian.PutUint64(b[5:13], uint64(rec.expires))
+	binary.BigEndian.PutUint32(b[13:17], uint32(len(rec.key)))
+	binary.BigEndian.PutUint32(b[17:21], uint32(len(rec.value)))
+	copy(b[logHeaderLen:], rec.key)
+	copy(b[logHeaderLen+len(rec.key):], rec.value)
+	binary.BigEndian.PutUint32(b[0:4], crc32.Checksum(b[4:], logCRCTable))
+
+	return b
+}
+
+// errLogRecordPastEnd is returned by readLogRecord for a record whose
+// header is complete but whose length runs past the end of the log
+var errLogRecordPastEnd = errors.New("session log record runs past the end of the log")
+
+// readLogRecord reads the next record of a log that has remaining bytes
+// left and returns it along with its length. It returns an error if the
+// record is incomplete or corrupt, along with the length of a record that
+// only fails its checksum. The lengths in the header are checked against
+// remaining before the record is read, so that a corrupt header can not
+// make it allocate more than the log holds.
+func readLogRecord(r io.Reader, remaining int64) (logRecord, int64, error) {
+	header := make([]byte, logHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return logRecord{}, 0, err
+	}
+
+	op, keyLen, valueLen, ok := decodeLogHeader(header)
+	if !ok {
+		return logRecord{}, 0, errors.New("corrupt session log record")
+	}
+	if logHeaderLen+keyLen+valueLen > remaining {
+		return logRecord{}, 0, errLogRecordPastEnd
+	}
+
+	body := make([]byte, keyLen+valueLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return logRecord{}, 0, errors.Wrap(err, "unable to read session log record")
+	}
+
+	if !checkLogRecord(header, body) {
+		return logRecord{}, int64(logHeaderLen + len(body)), errors.New("corrupt session log record")
+	}
+
+	rec := logRecord{
+		op:      op,
+		expires: int64(binary.BigEndian.Uint64(header[5:13])),
+		key:     string(body[:keyLen]),
+		value:   string(body[keyLen:]),
+	}
+
+	return rec, int64(logHeaderLen + len(body)), nil
+}
+
+// decodeLogHeader returns the operation and the key and value lengths of
+// a record header, ok is false if they are out of range
+func decodeLogHeader(header []byte) (op logOp, keyLen, valueLen int64, ok bool) {
+	op = logOp(header[4])
+	keyLen = int64(binary.BigEndian.Uint32(header[13:17]))
+	valueLen = int64(binary.BigEndian.Uint32(header[17:21]))
+
+	ok = op >= logOpSet && op <= logOpOwner && keyLen <= logMaxKeyLen && valueLen <= logMaxValueLen
+	return op, keyLen, valueLen, ok
+}
+
+// checkLogRecord returns true if the checksum of a record matches its
+// header and body
+func checkLogRecord(header, body []byte) bool {
+	crc := crc32.Update(crc32.Checksum(header[4:], logCRCTable), logCRCTable, body)
+	return crc == binary.BigEndian.Uint32(header[0:4])
+}
+
+// isTornLogTail returns true if the record at offset that readLogRecord
+// failed to read with err, and found to be n bytes long if only its checksum
+// failed, is the torn last record of a log of size bytes. A record is torn
+// if its header is cut short by the end of the log, if it runs past the end
+// of the log and no valid record follows its header, if it is the last
+// record and fails its checksum, or if the log ends with zeros from there.
+// Anything else is corruption in the middle of the log, which must not be
+// truncated away along with the valid records after it.
+func isTornLogTail(f *os.File, err error, offset, n, size int64) (bool, error) {
+	switch {
+	case offset+logHeaderLen > size:
+		return true, nil
+	case errors.Is(err, errLogRecordPastEnd):
+		found, err := hasLogRecord(f, offset+logHeaderLen, size)
+		return !found, err
+	case n != 0:
+		return offset+n == size, nil
+	}
+
+	tail := io.NewSectionReader(f, offset, size-offset)
+	buf := make([]byte, 32*1024)
+	for {
+		read, err := tail.Read(buf)
+		for _, b := range buf[:read] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+
+		if err == io.EOF {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+}
+
+// hasLogRecord returns true if a record with a valid checksum starts
+// anywhere between offset and the end of a log of size bytes. A record
+// torn by a crash is the last write to the log, so finding one after a
+// record that runs past the end means that record's length is corrupt.
+func hasLogRecord(f *os.File, offset, size int64) (bool, error) {
+	r := bufio.NewReader(io.NewSectionReader(f, offset, size-offset))
+	for ; offset+logHeaderLen <= size; offset++ {
+		header, err := r.Peek(logHeaderLen)
+		if err != nil {
+			return false, err
+		}
+
+		_, keyLen, valueLen, ok := decodeLogHeader(header)
+		if ok && offset+logHeaderLen+keyLen+valueLen <= size {
+			body := make([]byte, keyLen+valueLen)
+			if _, err := f.ReadAt(body, offset+logHeaderLen); err != nil {
+				return false, err
+			}
+			if checkLogRecord(header, body) {
+				return true, nil
+			}
+		}
+
+		if _, err := r.Discard(1); err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// syncDir syncs a folder so that a file renamed into it survives a power
+// loss. Not all systems can sync folders, so errors are ignored.
+func syncDir(dirPath string) {
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return
+	}
+
+	_ = d.Sync()
+	d.Close()
+}
+
+// errLogClosed is returned by the operations of a closed LogStorer
+func errLogClosed() error {
+	return errors.New("session log is closed")
+}
@@ -0,0 +1,588 @@
+package abcsessions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestLogStorer opens a log storer in a temporary folder and returns it
+// along with the path of its log
+func newTestLogStorer(t *testing.T, maxAge, cleanInterval time.Duration) (*LogStorer, string) {
+	t.Helper()
+
+	filePath := filepath.Join(t.TempDir(), "sessions.log")
+	l, err := NewLogStorer(filePath, maxAge, cleanInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	return l, filePath
+}
+
+// reopenLogStorer closes l and opens its log again
+func reopenLogStorer(t *testing.T, l *LogStorer, filePath string) *LogStorer {
+	t.Helper()
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewLogStorer(filePath, l.maxAge, l.cleanInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	return l
+}
+
+func TestLogStorerReopen(t *testing.T) {
+	t.Parallel()
+
+	l, filePath := newTestLogStorer(t, 0, 0)
+
+	for key, value := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		if err := l.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Set("a", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Del("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetOwner("c", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	l = reopenLogStorer(t, l, filePath)
+
+	keys, err := l.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"a", "c"}) {
+		t.Errorf("expected sessions a and c, got %v", keys)
+	}
+	if val, err := l.Get("a"); err != nil || val != "changed" {
+		t.Errorf("expected %q, got %q: %v", "changed", val, err)
+	}
+	if ids, err := l.OwnerSessions("alice"); err != nil || !reflect.DeepEqual(ids, []string{"c"}) {
+		t.Errorf("expected the sessions of alice to be [c], got %v: %v", ids, err)
+	}
+}
+
+func TestLogStorerExpiryReopen(t *testing.T) {
+	t.Parallel()
+
+	l, filePath := newTestLogStorer(t, time.Hour, time.Hour)
+
+	if err := l.Set("expired", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set("kept", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expire a session while the storer is not running
+	if err := l.append(logRecord{op: logOpTouch, expires: time.Now().Add(-time.Minute).UnixNano(), key: "expired"}); err != nil {
+		t.Fatal(err)
+	}
+
+	l = reopenLogStorer(t, l, filePath)
+
+	if _, err := l.Get("expired"); !IsNoSessionError(err) {
+		t.Errorf("expected the expired session to be gone, got: %v", err)
+	}
+	if val, err := l.Get("kept"); err != nil || val != "2" {
+		t.Errorf("expected %q, got %q: %v", "2", val, err)
+	}
+}
+
+func TestLogStorerTornRecord(t *testing.T) {
+	t.Parallel()
+
+	l, filePath := newTestLogStorer(t, 0, 0)
+
+	if err := l.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash in the middle of appending a record
+	torn := encodeLogRecord(logRecord{op: logOpSet, key: "b", value: "2"})
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(torn[:len(torn)-1]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	l, err = NewLogStorer(filePath, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	if val, err := l.Get("a"); err != nil || val != "1" {
+		t.Errorf("expected %q, got %q: %v", "1", val, err)
+	}
+	if _, err := l.Get("b"); !IsNoSessionError(err) {
+		t.Errorf("expected the torn session to be dropped, got: %v", err)
+	}
+	if l.size != info.Size() {
+		t.Errorf("expected the log to be truncated to %d bytes, got %d", info.Size(), l.size)
+	}
+
+	// New records are appended after the last complete one
+	if err := l.Set("c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	l = reopenLogStorer(t, l, filePath)
+	if val, err := l.Get("c"); err != nil || val != "3" {
+		t.Errorf("expected %q, got %q: %v", "3", val, err)
+	}
+}
+
+func TestLogStorerCorruptRecord(t *testing.T) {
+	t.Parallel()
+
+	l, filePath := newTestLogStorer(t, 0, 0)
+
+	if err := l.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	size := l.size
+	if err := l.Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip the last byte of the value of b
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	if err := ioutil.WriteFile(filePath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = NewLogStorer(filePath, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	if _, err := l.Get("b"); !IsNoSessionError(err) {
+		t.Errorf("expected the corrupt session to be dropped, got: %v", err)
+	}
+	if l.size != size {
+		t.Errorf("expected the log to be truncated to %d bytes, got %d", size, l.size)
+	}
+}
+
+func TestLogStorerCorruptMiddleRecord(t *testing.T) {
+	t.Parallel()
+
+	l, filePath := newTestLogStorer(t, 0, 0)
+
+	if err := l.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip the last byte of the value of a, b follows it
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := len(logMagic) + len(encodeLogRecord(logRecord{op: logOpSet, key: "a", value: "1"}))
+	b[first-1] ^= 0xff
+	if err := ioutil.WriteFile(filePath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewLogStorer(filePath, 0, 0); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("expected a corrupt log error, got: %v", err)
+	}
+
+	after, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(b) {
+		t.Errorf("expected the log to be left as is, got %d bytes instead of %d", len(after), len(b))
+	}
+}
+
+func TestLogStorerCorruptLengthMiddleRecord(t *testing.T) {
+	t.Parallel()
+
+	l, filePath := newTestLogStorer(t, 0, 0)
+
+	if err := l.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the value length of a point past the end of the log, b follows it
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(b[len(logMagic)+17:], 1<<20)
+	if err := ioutil.WriteFile(filePath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewLogStorer(filePath, 0, 0); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("expected a corrupt log error, got: %v", err)
+	}
+
+	after, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(b) {
+		t.Errorf("expected the log to be left as is, got %d bytes instead of %d", len(after), len(b))
+	}
+}
+
+func TestLogStorerTornHeader(t *testing.T) {
+	t.Parallel()
+
+	l, filePath := newTestLogStorer(t, 0, 0)
+
+	if err := l.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	size := l.size
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash in the middle of the header of a record
+	torn := encodeLogRecord(logRecord{op: logOpSet, key: "b", value: "2"})
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(torn[:logHeaderLen-1]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	l, err = NewLogStorer(filePath, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	if val, err := l.Get("a"); err != nil || val != "1" {
+		t.Errorf("expected %q, got %q: %v", "1", val, err)
+	}
+	if l.size != size {
+		t.Errorf("expected the log to be truncated to %d bytes, got %d", size, l.size)
+	}
+}
+
+func TestLogStorerZeroTail(t *testing.T) {
+	t.Parallel()
+
+	l, filePath := newTestLogStorer(t, 0, 0)
+
+	if err := l.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	size := l.size
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash can leave the space of an unwritten record filled with zeros
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	l, err = NewLogStorer(filePath, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	if val, err := l.Get("a"); err != nil || val != "1" {
+		t.Errorf("expected %q, got %q: %v", "1", val, err)
+	}
+	if l.size != size {
+		t.Errorf("expected the log to be truncated to %d bytes, got %d", size, l.size)
+	}
+}
+
+func TestLogStorerCompact(t *testing.T) {
+	t.Parallel()
+
+	l, filePath := newTestLogStorer(t, time.Hour, time.Hour)
+
+	for i := 0; i < 100; i++ {
+		if err := l.Set("a", strings.Repeat("x", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetOwner("b", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ResetExpiry("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set("c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Del("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	before := l.size
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != l.size || l.size >= before {
+		t.Errorf("expected the log to shrink from %d bytes, got %d (%d on disk)", before, l.size, info.Size())
+	}
+	if l.size != int64(len(logMagic))+l.live {
+		t.Errorf("expected only live records after compaction, got %d bytes for %d live", l.size, l.live)
+	}
+
+	check := func(l *LogStorer) {
+		t.Helper()
+
+		if val, err := l.Get("a"); err != nil || val != strings.Repeat("x", 99) {
+			t.Errorf("expected the last value of a, got %q: %v", val, err)
+		}
+		if val, err := l.Get("b"); err != nil || val != "2" {
+			t.Errorf("expected %q, got %q: %v", "2", val, err)
+		}
+		if _, err := l.Get("c"); !IsNoSessionError(err) {
+			t.Errorf("expected c to stay deleted, got: %v", err)
+		}
+		if owner, _ := l.Owner("b"); owner != "alice" {
+			t.Errorf("expected b to be owned by alice, got %q", owner)
+		}
+	}
+
+	check(l)
+	check(reopenLogStorer(t, l, filePath))
+}
+
+func TestLogStorerAbandonedCompaction(t *testing.T) {
+	t.Parallel()
+
+	l, filePath := newTestLogStorer(t, 0, 0)
+
+	if err := l.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash during a compaction leaves the new log behind
+	if err := ioutil.WriteFile(filePath+logCompactSuffix, []byte(logMagic+"partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewLogStorer(filePath, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	if val, err := l.Get("a"); err != nil || val != "1" {
+		t.Errorf("expected %q, got %q: %v", "1", val, err)
+	}
+	if _, err := os.Stat(filePath + logCompactSuffix); !os.IsNotExist(err) {
+		t.Errorf("expected the abandoned compaction to be removed, got: %v", err)
+	}
+}
+
+func TestLogStorerCleanError(t *testing.T) {
+	t.Parallel()
+
+	l, filePath := newTestLogStorer(t, time.Hour, time.Hour)
+	buf := &bytes.Buffer{}
+	l.ErrorLog = log.New(buf, "", 0)
+
+	var expired []string
+	l.NotifyExpired(func(key string) { expired = append(expired, key) })
+
+	// Enough dead records for Clean to compact the log
+	value := strings.Repeat("x", logCompactMinBytes)
+	for i := 0; i < 2; i++ {
+		if err := l.Set("a", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.append(logRecord{op: logOpTouch, expires: time.Now().Add(-time.Minute).UnixNano(), key: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The compacted log can not be created
+	if err := os.Mkdir(filePath+logCompactSuffix, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	size := l.size
+	l.Clean()
+
+	if !strings.Contains(buf.String(), "unable to create compacted session log") {
+		t.Errorf("expected the error to be logged, got: %q", buf.String())
+	}
+	if l.size != size {
+		t.Errorf("expected the old log to be kept, got %d bytes instead of %d", l.size, size)
+	}
+	if val, err := l.Get("a"); err != nil || val != value {
+		t.Errorf("expected the value of a to be kept: %v", err)
+	}
+	if !reflect.DeepEqual(expired, []string{"b"}) {
+		t.Errorf("expected b to expire, got %v", expired)
+	}
+}
+
+func TestLogStorerCleaner(t *testing.T) {
+	l, _ := newTestLogStorer(t, time.Hour, time.Hour)
+
+	tm := diskTestTimer{}
+	ch := make(chan time.Time)
+	timerTestHarness = func(d time.Duration) (timer, <-chan time.Time) {
+		return tm, ch
+	}
+
+	var expired []string
+	l.NotifyExpired(func(key string) { expired = append(expired, key) })
+
+	if err := l.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.append(logRecord{op: logOpTouch, expires: time.Now().Add(-time.Minute).UnixNano(), key: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	l.StartCleaner()
+	ch <- time.Time{}
+	l.StopCleaner()
+
+	if !reflect.DeepEqual(expired, []string{"b"}) {
+		t.Errorf("expected b to expire, got %v", expired)
+	}
+	keys, err := l.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Errorf("expected only a to be left, got %v", keys)
+	}
+}
+
+func TestLogStorerOwner(t *testing.T) {
+	t.Parallel()
+
+	l, _ := newTestLogStorer(t, 0, 0)
+
+	testOwnerStorer(t, l)
+}
+
+func TestLogStorerLock(t *testing.T) {
+	t.Parallel()
+
+	l, filePath := newTestLogStorer(t, 0, 0)
+
+	if _, err := NewLogStorer(filePath, 0, 0); err == nil {
+		t.Error("expected the log to be locked")
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set("a", "1"); err == nil {
+		t.Error("expected an error from a closed storer")
+	}
+
+	reopened, err := NewLogStorer(filePath, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.Close()
+}
+
+func TestLogStorerNotALog(t *testing.T) {
+	t.Parallel()
+
+	filePath := filepath.Join(t.TempDir(), "notes.txt")
+	if err := ioutil.WriteFile(filePath, []byte("not a session log"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewLogStorer(filePath, 0, 0); err == nil {
+		t.Error("expected an error")
+	}
+
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "not a session log" {
+		t.Errorf("expected the file to be left alone, got %q", b)
+	}
+}
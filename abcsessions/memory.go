@@ -1,15 +1,41 @@
 package abcsessions
 
 import (
+	"container/list"
+	"context"
 	"sync"
 	"time"
+
+	"github.com/friendsofgo/errors"
 )
 
+// memorySessionOverhead is the approximate number of bytes used by a session
+// besides its id and value, it is counted against MemoryLimits.MaxBytes
+const memorySessionOverhead = 128
+
 // MemoryStorer is a session storer implementation for saving sessions
 // to memory.
+//
+// The number of sessions and the memory they use can be bounded with
+// MemoryLimits. When a limit is reached the least recently used sessions
+// are evicted to make room, see NewLimitedMemoryStorer.
 type MemoryStorer struct {
 	// sessions is the memory storage for the sessions. The map key is the id.
 	sessions map[string]memorySession
+	// lru orders the session ids from the most to the least recently used
+	lru *list.List
+	// limits bounds the size of the storer
+	limits MemoryLimits
+	// bytes is the approximate memory used by the sessions
+	bytes int64
+	// hits, misses and evictions are counters exposed by Stats
+	hits, misses, evictions uint64
+	// expired are called with the ids of cleaned and evicted sessions
+	expired []*expiryListener
+	// owners maps owners to the ids of their sessions
+	owners map[string]map[string]struct{}
+	// sessionOwners maps session ids to their owner
+	sessionOwners map[string]string
 	// How long sessions take to expire on disk
 	maxAge time.Duration
 	// How often the memory map should be polled for maxAge expired sessions
@@ -25,6 +51,33 @@ type MemoryStorer struct {
 type memorySession struct {
 	expires time.Time
 	value   string
+	// elem is the element of the session in the lru list
+	elem *list.Element
+}
+
+// MemoryLimits bounds the size of a MemoryStorer. A zero field means
+// no limit.
+type MemoryLimits struct {
+	// MaxSessions is the maximum number of sessions kept in memory
+	MaxSessions int
+	// MaxBytes is the approximate maximum number of bytes used by the
+	// sessions. The size of a session is the length of its id and value
+	// plus a fixed overhead, the real memory usage is somewhat higher.
+	MaxBytes int64
+}
+
+// MemoryStats are counters describing the usage of a MemoryStorer
+type MemoryStats struct {
+	// Hits is the number of Get calls that found a session
+	Hits uint64
+	// Misses is the number of Get calls that did not find a session
+	Misses uint64
+	// Evictions is the number of sessions evicted to stay within the limits
+	Evictions uint64
+	// Sessions is the number of sessions currently stored
+	Sessions int
+	// Bytes is the approximate memory used by the stored sessions
+	Bytes int64
 }
 
 // NewDefaultMemoryStorer returns a MemoryStorer object with default values.
@@ -42,12 +95,27 @@ func NewDefaultMemoryStorer() (*MemoryStorer, error) {
 // Persistent storage can be attained by setting maxAge and cleanInterval
 // to zero, however the memory will be wiped when the server is restarted.
 func NewMemoryStorer(maxAge, cleanInterval time.Duration) (*MemoryStorer, error) {
+	return NewLimitedMemoryStorer(maxAge, cleanInterval, MemoryLimits{})
+}
+
+// NewLimitedMemoryStorer initializes and returns a new MemoryStorer object
+// like NewMemoryStorer, whose size is bounded by limits. Once a limit is
+// reached, setting a new session evicts the least recently used sessions.
+// A session is used when it is Set, Get or has its expiry reset.
+func NewLimitedMemoryStorer(maxAge, cleanInterval time.Duration, limits MemoryLimits) (*MemoryStorer, error) {
 	if (maxAge != 0 && cleanInterval == 0) || (cleanInterval != 0 && maxAge == 0) {
 		panic("if max age or clean interval is set, the other must also be set")
 	}
+	if limits.MaxSessions < 0 || limits.MaxBytes < 0 {
+		panic("memory limits must not be negative")
+	}
 
 	m := &MemoryStorer{
 		sessions:      make(map[string]memorySession),
+		lru:           list.New(),
+		limits:        limits,
+		owners:        make(map[string]map[string]struct{}),
+		sessionOwners: make(map[string]string),
 		maxAge:        maxAge,
 		cleanInterval: cleanInterval,
 	}
@@ -74,63 +142,343 @@ func (m *MemoryStorer) All() ([]string, error) {
 // Get returns the value string saved in the session pointed to by the
 // session id key.
 func (m *MemoryStorer) Get(key string) (value string, err error) {
-	m.mut.RLock()
+	// Getting a session changes the lru order so it needs the write lock
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
 	session, ok := m.sessions[key]
-	m.mut.RUnlock()
 	if !ok {
+		m.misses++
 		return "", errNoSession{}
 	}
 
+	m.hits++
+	if session.elem != nil {
+		m.lru.MoveToFront(session.elem)
+	}
+
 	return session.value, nil
 }
 
 // Set saves the value string to the session pointed to by the session id key.
+// If the storer is limited, least recently used sessions are evicted to make
+// room for it. A session larger than MaxBytes on its own is refused.
 func (m *MemoryStorer) Set(key, value string) error {
+	size := memorySessionSize(key, value)
+	if m.limits.MaxBytes != 0 && size > m.limits.MaxBytes {
+		return errors.Errorf("session of %d bytes exceeds the memory storer limit of %d bytes", size, m.limits.MaxBytes)
+	}
+
+	m.mut.Lock()
+	evicted := m.set(key, value, size)
+	expired := m.expired
+	m.mut.Unlock()
+
+	// Notify without the lock so that the callbacks can use the storer
+	notifyExpired(expired, evicted)
+
+	return nil
+}
+
+// set saves the value of the session id key, whose size is size, and
+// returns the ids of the sessions evicted to make room for it. The caller
+// must hold the write lock.
+func (m *MemoryStorer) set(key, value string, size int64) []string {
+	session, ok := m.sessions[key]
+	if ok && session.elem != nil {
+		m.bytes -= memorySessionSize(key, session.value)
+		m.lru.MoveToFront(session.elem)
+	} else {
+		session.elem = m.lru.PushFront(key)
+	}
+
+	session.expires = time.Now().UTC().Add(m.maxAge)
+	session.value = value
+	m.sessions[key] = session
+	m.bytes += size
+
+	return m.evict()
+}
+
+// GetVersioned returns the value of the session pointed to by the session
+// id key along with its version
+func (m *MemoryStorer) GetVersioned(ctx context.Context, key string) (string, string, error) {
+	value, err := m.GetContext(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	return value, valueVersion(value), nil
+}
+
+// TTL returns the time left before the session pointed to by the session
+// id key expires, see TTLStorer
+func (m *MemoryStorer) TTL(ctx context.Context, key string) (time.Duration, time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	m.mut.RLock()
+	session, ok := m.sessions[key]
+	m.mut.RUnlock()
+
+	if !ok {
+		return 0, 0, errNoSession{}
+	}
+	if m.maxAge == 0 {
+		return 0, 0, nil
+	}
+
+	return remainingTTL(session.expires), m.maxAge, nil
+}
+
+// CompareAndSet saves the value string to the session pointed to by the
+// session id key if it is still at version, see VersionedStorer
+func (m *MemoryStorer) CompareAndSet(ctx context.Context, key, value, version string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	size := memorySessionSize(key, value)
+	if m.limits.MaxBytes != 0 && size > m.limits.MaxBytes {
+		return errors.Errorf("session of %d bytes exceeds the memory storer limit of %d bytes", size, m.limits.MaxBytes)
+	}
+
 	m.mut.Lock()
-	m.sessions[key] = memorySession{
-		expires: time.Now().UTC().Add(m.maxAge),
-		value:   value,
+	session, ok := m.sessions[key]
+	if ok != (len(version) != 0) || (ok && valueVersion(session.value) != version) {
+		m.mut.Unlock()
+		return errVersionConflict{}
 	}
+
+	evicted := m.set(key, value, size)
+	expired := m.expired
 	m.mut.Unlock()
 
+	notifyExpired(expired, evicted)
+
 	return nil
 }
 
 // Del the session pointed to by the session id key and remove it.
 func (m *MemoryStorer) Del(key string) error {
 	m.mut.Lock()
-	delete(m.sessions, key)
+	m.remove(key)
 	m.mut.Unlock()
 
 	return nil
 }
 
+// Stats returns the usage counters of the storer
+func (m *MemoryStorer) Stats() MemoryStats {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	return MemoryStats{
+		Hits:      m.hits,
+		Misses:    m.misses,
+		Evictions: m.evictions,
+		Sessions:  len(m.sessions),
+		Bytes:     m.bytes,
+	}
+}
+
+// NotifyExpired registers fn to be called with the id of every session
+// removed by the cleaner or evicted to stay within the limits
+func (m *MemoryStorer) NotifyExpired(fn func(key string)) func() {
+	return addExpiryListener(&m.mut, &m.expired, fn)
+}
+
+// evict removes the least recently used sessions until the storer is
+// within its limits and returns their ids. The caller must hold the
+// write lock.
+func (m *MemoryStorer) evict() []string {
+	var evicted []string
+	for m.lru.Len() > 0 && m.overLimits() {
+		key := m.lru.Back().Value.(string)
+		m.remove(key)
+		m.evictions++
+		evicted = append(evicted, key)
+	}
+
+	return evicted
+}
+
+// overLimits returns true if the storer holds more than its limits allow.
+// The caller must hold the lock.
+func (m *MemoryStorer) overLimits() bool {
+	return (m.limits.MaxSessions != 0 && len(m.sessions) > m.limits.MaxSessions) ||
+		(m.limits.MaxBytes != 0 && m.bytes > m.limits.MaxBytes)
+}
+
+// remove deletes the session id key along with its lru entry and owner
+// index. The caller must hold the write lock.
+func (m *MemoryStorer) remove(key string) {
+	session, ok := m.sessions[key]
+	if !ok {
+		return
+	}
+
+	if session.elem != nil {
+		m.lru.Remove(session.elem)
+		m.bytes -= memorySessionSize(key, session.value)
+	}
+	delete(m.sessions, key)
+	m.delOwnerIndex(key)
+}
+
+// memorySessionSize returns the approximate memory used by a session
+func memorySessionSize(key, value string) int64 {
+	return int64(len(key) + len(value) + memorySessionOverhead)
+}
+
+// SetOwner attaches the session pointed to by the session id key to owner
+func (m *MemoryStorer) SetOwner(key, owner string) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	if _, ok := m.sessions[key]; !ok {
+		return errNoSession{}
+	}
+
+	m.delOwnerIndex(key)
+
+	ids, ok := m.owners[owner]
+	if !ok {
+		ids = make(map[string]struct{})
+		m.owners[owner] = ids
+	}
+	ids[key] = struct{}{}
+	m.sessionOwners[key] = owner
+
+	return nil
+}
+
+// Owner returns the owner of the session pointed to by the session id key
+func (m *MemoryStorer) Owner(key string) (string, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	return m.sessionOwners[key], nil
+}
+
+// OwnerSessions returns the session ids of all sessions of owner
+func (m *MemoryStorer) OwnerSessions(owner string) ([]string, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	ids := m.owners[owner]
+	sessions := make([]string, 0, len(ids))
+	for id := range ids {
+		sessions = append(sessions, id)
+	}
+
+	return sessions, nil
+}
+
+// DelOwner deletes all sessions of owner
+func (m *MemoryStorer) DelOwner(owner string) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	for id := range m.owners[owner] {
+		m.remove(id)
+	}
+
+	return nil
+}
+
+// delOwnerIndex removes the session id key from the owner index.
+// The caller must hold the write lock.
+func (m *MemoryStorer) delOwnerIndex(key string) {
+	owner, ok := m.sessionOwners[key]
+	if !ok {
+		return
+	}
+
+	delete(m.sessionOwners, key)
+	delete(m.owners[owner], key)
+	if len(m.owners[owner]) == 0 {
+		delete(m.owners, owner)
+	}
+}
+
 // ResetExpiry resets the expiry of the key
 func (m *MemoryStorer) ResetExpiry(key string) error {
-	m.mut.RLock()
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
 	session, ok := m.sessions[key]
-	m.mut.RUnlock()
 	if !ok {
 		return errNoSession{}
 	}
 
 	session.expires = time.Now().UTC().Add(m.maxAge)
 	m.sessions[key] = session
+	if session.elem != nil {
+		m.lru.MoveToFront(session.elem)
+	}
+
 	return nil
 }
 
+// AllContext is All that fails early if ctx is already done
+func (m *MemoryStorer) AllContext(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.All()
+}
+
+// GetContext is Get that fails early if ctx is already done
+func (m *MemoryStorer) GetContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return m.Get(key)
+}
+
+// SetContext is Set that fails early if ctx is already done
+func (m *MemoryStorer) SetContext(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.Set(key, value)
+}
+
+// DelContext is Del that fails early if ctx is already done
+func (m *MemoryStorer) DelContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.Del(key)
+}
+
+// ResetExpiryContext is ResetExpiry that fails early if ctx is already done
+func (m *MemoryStorer) ResetExpiryContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.ResetExpiry(key)
+}
+
 // Clean checks all sessions in memory to see if they are older than
 // maxAge by checking their expiry. If it finds an expired session
 // it will remove it from memory.
 func (m *MemoryStorer) Clean() {
 	t := time.Now().UTC()
+	var cleaned []string
 	m.mut.Lock()
 	for id, session := range m.sessions {
 		if t.After(session.expires) {
-			delete(m.sessions, id)
+			m.remove(id)
+			cleaned = append(cleaned, id)
 		}
 	}
+	expired := m.expired
 	m.mut.Unlock()
+
+	notifyExpired(expired, cleaned)
 }
 
 // StartCleaner starts the memory session cleaner go routine. This go routine
@@ -163,12 +511,14 @@ func (m *MemoryStorer) cleanerLoop() {
 
 	t, c := timerTestHarness(m.cleanInterval)
 
-	select {
-	case <-c:
-		m.Clean()
-		t.Reset(m.cleanInterval)
-	case <-m.quit:
-		t.Stop()
-		return
+	for {
+		select {
+		case <-c:
+			m.Clean()
+			t.Reset(m.cleanInterval)
+		case <-m.quit:
+			t.Stop()
+			return
+		}
 	}
 }
@@ -237,3 +237,120 @@ func TestMemoryStorerResetExpiry(t *testing.T) {
 		t.Errorf("Expected newexpires to be newer than old expires, got: %#v, %#v", oldExpires, newExpires)
 	}
 }
+
+func TestMemoryStorerOwner(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	testOwnerStorer(t, m)
+}
+
+func TestMemoryStorerCleanerLoop(t *testing.T) {
+	m, err := NewMemoryStorer(time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm := memoryTestTimer{}
+	ch := make(chan time.Time)
+	timerTestHarness = func(d time.Duration) (timer, <-chan time.Time) {
+		return tm, ch
+	}
+
+	m.StartCleaner()
+
+	// The first clean has nothing to remove
+	ch <- time.Time{}
+
+	m.mut.Lock()
+	m.sessions["testid1"] = memorySession{
+		value:   "test1",
+		expires: time.Now().AddDate(0, 0, -1),
+	}
+	m.mut.Unlock()
+
+	// The cleaner must still be running to receive a second signal
+	ch <- time.Time{}
+
+	m.StopCleaner()
+
+	if len(m.sessions) != 0 {
+		t.Errorf("expected session to be cleaned on the second interval, got len %d", len(m.sessions))
+	}
+}
+
+func TestMemoryStorerLimits(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewLimitedMemoryStorer(0, 0, MemoryLimits{MaxSessions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Set("a", "1")
+	m.Set("b", "2")
+
+	// Use a so that b is the least recently used
+	if _, err = m.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	m.Set("c", "3")
+
+	if _, err = m.Get("b"); !IsNoSessionError(err) {
+		t.Errorf("expected b to be evicted, got: %v", err)
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, err = m.Get(key); err != nil {
+			t.Errorf("expected %s to be kept, got: %v", key, err)
+		}
+	}
+
+	stats := m.Stats()
+	if stats.Hits != 3 || stats.Misses != 1 || stats.Evictions != 1 || stats.Sessions != 2 {
+		t.Errorf("unexpected stats: %#v", stats)
+	}
+	if want := memorySessionSize("a", "1") + memorySessionSize("c", "3"); stats.Bytes != want {
+		t.Errorf("expected %d bytes, got %d", want, stats.Bytes)
+	}
+
+	m.Del("a")
+	if stats = m.Stats(); stats.Sessions != 1 || stats.Bytes != memorySessionSize("c", "3") {
+		t.Errorf("unexpected stats after delete: %#v", stats)
+	}
+}
+
+func TestMemoryStorerMaxBytes(t *testing.T) {
+	t.Parallel()
+
+	max := memorySessionSize("a", "12345") * 2
+	m, err := NewLimitedMemoryStorer(0, 0, MemoryLimits{MaxBytes: max})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Set("a", "12345")
+	m.Set("b", "12345")
+	m.ResetExpiry("a")
+
+	// Resetting the expiry of a made b the least recently used
+	m.Set("c", "1")
+	if _, err = m.Get("b"); !IsNoSessionError(err) {
+		t.Errorf("expected b to be evicted, got: %v", err)
+	}
+
+	// Growing c pushes out a
+	m.Set("c", string(make([]byte, max-memorySessionSize("c", ""))))
+	if _, err = m.Get("a"); !IsNoSessionError(err) {
+		t.Errorf("expected a to be evicted, got: %v", err)
+	}
+	if _, err = m.Get("c"); err != nil {
+		t.Errorf("expected c to be kept, got: %v", err)
+	}
+	if stats := m.Stats(); stats.Bytes > max {
+		t.Errorf("expected at most %d bytes, got %d", max, stats.Bytes)
+	}
+
+	if err = m.Set("d", string(make([]byte, max))); err == nil {
+		t.Error("expected a session larger than the limit to be refused")
+	}
+}
@@ -0,0 +1,145 @@
+package abcsessions
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// mergeSessions applies the changes a request made to its session on top
+// of the session as it is stored now, so that concurrent requests changing
+// different keys do not overwrite each other. base is the session as the
+// request loaded it, mine is the session as the request left it and theirs
+// is the stored session, possibly changed by other requests since base.
+//
+// Keys of the typed values, flash messages and object values are merged one
+// by one, the changes of the request winning over theirs for the same key.
+// Queued flash messages added by the request are appended to theirs and the
+// ones it read are removed.
+func mergeSessions(base, mine, theirs session) session {
+	merged := theirs.clone()
+	merged.Value = mergeRawValue(base.Value, mine.Value, theirs.Value)
+	merged.Flash = mergeRawMap(base.Flash, mine.Flash, theirs.Flash)
+	merged.Values = mergeRawMap(base.Values, mine.Values, theirs.Values)
+	merged.Flashes = mergeFlashes(base.Flashes, mine.Flashes, theirs.Flashes)
+
+	return merged
+}
+
+// mergeRawValue merges the session value. Values that are JSON objects, like
+// the map of the key-value API, are merged key by key, other values are
+// replaced by mine if the request changed them.
+func mergeRawValue(base, mine, theirs *json.RawMessage) *json.RawMessage {
+	if rawEqual(base, mine) {
+		return theirs
+	}
+
+	baseMap, ok := rawObject(base)
+	if !ok {
+		return mine
+	}
+	mineMap, ok := rawObject(mine)
+	if !ok || mineMap == nil {
+		return mine
+	}
+	theirsMap, ok := rawObject(theirs)
+	if !ok {
+		return mine
+	}
+
+	b, err := json.Marshal(mergeRawMap(baseMap, mineMap, theirsMap))
+	if err != nil {
+		return mine
+	}
+
+	return (*json.RawMessage)(&b)
+}
+
+// mergeRawMap applies the keys set and deleted in mine since base to theirs
+func mergeRawMap(base, mine, theirs map[string]*json.RawMessage) map[string]*json.RawMessage {
+	merged := cloneRawMap(theirs)
+
+	for key, value := range mine {
+		if old, ok := base[key]; ok && rawEqual(old, value) {
+			continue
+		}
+		if merged == nil {
+			merged = make(map[string]*json.RawMessage)
+		}
+		merged[key] = value
+	}
+
+	for key := range base {
+		if _, ok := mine[key]; !ok {
+			delete(merged, key)
+		}
+	}
+
+	return merged
+}
+
+// mergeFlashes removes the messages read from mine since base from theirs,
+// and appends the messages added to mine since base
+func mergeFlashes(base, mine, theirs []Flash) []Flash {
+	counts := make(map[Flash]int)
+	for _, f := range base {
+		counts[f]++
+	}
+	for _, f := range mine {
+		counts[f]--
+	}
+
+	var merged []Flash
+	for _, f := range theirs {
+		// Read by the request
+		if counts[f] > 0 {
+			counts[f]--
+			continue
+		}
+		merged = append(merged, f)
+	}
+
+	// The messages added by the request are the last ones of mine
+	added := make([]bool, len(mine))
+	for i := len(mine) - 1; i >= 0; i-- {
+		if counts[mine[i]] < 0 {
+			counts[mine[i]]++
+			added[i] = true
+		}
+	}
+	for i, f := range mine {
+		if added[i] {
+			merged = append(merged, f)
+		}
+	}
+
+	return merged
+}
+
+// rawEqual returns true if a and b hold the same JSON bytes
+func rawEqual(a, b *json.RawMessage) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return bytes.Equal(*a, *b)
+}
+
+// rawObject unmarshals a JSON object into its keys. It returns false if
+// the value is not an object, and a nil map if there is no value.
+func rawObject(raw *json.RawMessage) (map[string]*json.RawMessage, bool) {
+	if raw == nil {
+		return nil, true
+	}
+
+	trimmed := bytes.TrimSpace(*raw)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, false
+	}
+
+	var m map[string]*json.RawMessage
+	if err := json.Unmarshal(trimmed, &m); err != nil {
+		return nil, false
+	}
+
+	return m, true
+}
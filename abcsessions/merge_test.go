@@ -0,0 +1,56 @@
+package abcsessions
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func rawJSON(s string) *json.RawMessage {
+	raw := json.RawMessage(s)
+	return &raw
+}
+
+func TestMergeSessions(t *testing.T) {
+	t.Parallel()
+
+	base := session{
+		Value:   rawJSON(`{"a":"1","b":"2"}`),
+		Values:  map[string]*json.RawMessage{"x": rawJSON(`1`), "y": rawJSON(`2`)},
+		Flashes: []Flash{{Level: FlashInfo, Message: "hi"}, {Level: FlashInfo, Message: "hi"}},
+	}
+	mine := base.clone()
+	mine.Value = rawJSON(`{"a":"10","b":"2"}`)
+	mine.Values["x"] = rawJSON(`10`)
+	delete(mine.Values, "y")
+	mine.Flashes = []Flash{{Level: FlashInfo, Message: "hi"}, {Level: FlashError, Message: "new"}}
+
+	theirs := base.clone()
+	theirs.Value = rawJSON(`{"a":"1","b":"20","c":"3"}`)
+	theirs.Values["z"] = rawJSON(`3`)
+	theirs.Flashes = append(theirs.Flashes, Flash{Level: FlashWarning, Message: "theirs"})
+
+	merged := mergeSessions(base, mine, theirs)
+
+	if got := string(*merged.Value); got != `{"a":"10","b":"20","c":"3"}` {
+		t.Errorf("unexpected merged value: %s", got)
+	}
+	if len(merged.Values) != 2 || string(*merged.Values["x"]) != "10" || string(*merged.Values["z"]) != "3" {
+		t.Errorf("unexpected merged values: %v", merged.Values)
+	}
+	want := []Flash{{Level: FlashInfo, Message: "hi"}, {Level: FlashWarning, Message: "theirs"}, {Level: FlashError, Message: "new"}}
+	if !reflect.DeepEqual(merged.Flashes, want) {
+		t.Errorf("expected flashes %v, got %v", want, merged.Flashes)
+	}
+
+	// Values that are not objects are replaced
+	mine.Value = rawJSON(`"scalar"`)
+	if got := string(*mergeSessions(base, mine, theirs).Value); got != `"scalar"` {
+		t.Errorf("expected the value to be replaced, got %s", got)
+	}
+
+	// Unchanged values are left to theirs
+	if got := string(*mergeSessions(base, base, theirs).Value); got != string(*theirs.Value) {
+		t.Errorf("expected their value, got %s", got)
+	}
+}
@@ -1,6 +1,12 @@
 package abcsessions
 
-import "net/http"
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/friendsofgo/errors"
+)
 
 type cookieWriter interface {
 	SetCookie(cookie *http.Cookie)
@@ -14,7 +20,15 @@ type sessionsResponseWriter struct {
 	http.ResponseWriter
 	wroteHeader  bool
 	wroteCookies bool
-	cookies      map[string]*http.Cookie
+	// discard is true once the response was replaced because the session
+	// could not be stored, the rest of the response is dropped
+	discard bool
+	// cookiesMut guards cookies, which the helpers can change from other
+	// go routines through the session handle
+	cookiesMut sync.Mutex
+	cookies    map[string]*http.Cookie
+	// session is the request's session, stored before the cookies are written
+	session *requestSession
 }
 
 // newSessionsResponseWriter returns a new sessionsResponseWriter object with a pointer to
@@ -28,38 +42,106 @@ func (s *sessionsResponseWriter) Write(buf []byte) (int, error) {
 	if !s.wroteHeader {
 		s.WriteHeader(http.StatusOK)
 	}
+	if s.discard {
+		return len(buf), nil
+	}
 	return s.ResponseWriter.Write(buf)
 }
 
-// WriteHeader sets all cookies in the buffer on the underlying ResponseWriter's
-// headers and calls the underlying ResponseWriter WriteHeader func
+// WriteHeader stores the request's session if it was changed, sets all cookies
+// in the buffer on the underlying ResponseWriter's headers and calls the
+// underlying ResponseWriter WriteHeader func.
+//
+// If the session can't be stored the response is replaced with the one of
+// the StoreErrorHandler, or with a 500 Internal Server Error if there is none.
 func (s *sessionsResponseWriter) WriteHeader(code int) {
+	if s.discard {
+		return
+	}
 	s.wroteHeader = true
 
 	// Set all the cookies in the cookie buffer
 	if !s.wroteCookies {
+		// Storing the session can add cookies to the buffer
+		var err error
+		if s.session != nil {
+			err = s.session.flush()
+		}
+
 		s.wroteCookies = true
+		s.cookiesMut.Lock()
 		for _, c := range s.cookies {
-			http.SetCookie(s.ResponseWriter, c)
+			setCookie(s.ResponseWriter, c)
+		}
+		s.cookiesMut.Unlock()
+
+		if err != nil {
+			s.discard = true
+			s.storeFailed(errors.Wrap(err, "unable to store session"))
+			return
 		}
 	}
 
 	s.ResponseWriter.WriteHeader(code)
 }
 
-func (s *sessionsResponseWriter) SetCookie(cookie *http.Cookie) {
-	if s.cookies == nil {
-		s.cookies = make(map[string]*http.Cookie)
+// storeFailed writes the response for a session that could not be stored
+func (s *sessionsResponseWriter) storeFailed(err error) {
+	handler := s.session.errorHandler()
+	if handler == nil {
+		http.Error(s.ResponseWriter, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	handler(s.ResponseWriter, s.session.r, err)
+}
+
+// finish writes the header if the handler did not write a response, so that
+// a changed session is still stored and its cookies are sent
+func (s *sessionsResponseWriter) finish() {
+	if !s.wroteHeader && s.session != nil && s.session.isDirty() {
+		s.WriteHeader(http.StatusOK)
+	}
+}
+
+// setCookie adds the Set-Cookie header for cookie like http.SetCookie,
+// including the Partitioned attribute which http.Cookie can not represent
+// before Go 1.23
+func setCookie(w http.ResponseWriter, cookie *http.Cookie) {
+	v := cookie.String()
+	if len(v) == 0 {
+		return
 	}
 
+	for _, attr := range cookie.Unparsed {
+		if attr == cookieAttrPartitioned {
+			v += "; " + cookieAttrPartitioned
+			break
+		}
+	}
+
+	w.Header().Add("Set-Cookie", v)
+}
+
+func (s *sessionsResponseWriter) SetCookie(cookie *http.Cookie) {
 	if len(cookie.Name) == 0 {
 		panic("cookie name cannot be empty")
 	}
 
+	s.cookiesMut.Lock()
+	defer s.cookiesMut.Unlock()
+
+	if s.cookies == nil {
+		s.cookies = make(map[string]*http.Cookie)
+	}
+
 	s.cookies[cookie.Name] = cookie
 }
 
 func (s *sessionsResponseWriter) GetCookie(name string) *http.Cookie {
+	s.cookiesMut.Lock()
+	defer s.cookiesMut.Unlock()
+
 	return s.cookies[name]
 }
 
@@ -67,46 +149,105 @@ func (s *sessionsResponseWriter) GetCookie(name string) *http.Cookie {
 // for buffering cookies across session API requests.
 // The sessionsResponseWriter implements cookieWriter.
 //
+// Middleware also adds the session to the request context, so that the JSON
+// helpers (Set, Get, AddFlash, ...) only load it from the overseer once per
+// request and store it once, when the response header is written, if it was
+// changed. If the handler does not write a response the header is written
+// when it returns so that the changes are not lost. The session handle is
+// returned by FromContext, it is bound to the first overseer the helpers
+// are called with. The Middleware method of the overseers binds it to the
+// overseer from the start.
+//
 // If you would also like to reset the users session expiry on each
 // request (recommended), then use MiddlewareWithReset instead.
 func Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Convert the response writer to a sessions response, so we can
-		// use its cookie buffering and writing capabilities
-		w = newSessionsResponseWriter(w)
+		// use its cookie buffering and writing capabilities, and give the
+		// request a session that is only loaded and stored once
+		sw, r := newRequestSession(w, r)
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(sw, r)
+		sw.finish()
 	})
 }
 
 type resetExpiryMiddleware struct {
+	// ResetThreshold is the fraction of its lifetime a session must have
+	// used before MiddlewareWithReset and ResetMiddleware reset its expiry,
+	// for example 0.5 resets sessions that have less than half of their
+	// lifetime left. It saves writing the cookie and touching the storer on
+	// every request. The lifetime is the shortest of the cookie MaxAge, the
+	// storer maxAge and the Policy IdleTimeout. Zero resets the expiry on
+	// every request. It must be less than 1.
+	ResetThreshold float64
+	// ResetErrorHandler is called when resetting the expiry of a session
+	// fails, the request is then handled as usual. Nil panics with the
+	// error instead.
+	ResetErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+	// StoreErrorHandler is called when storing the changes the JSON helpers
+	// made to the session fails as the response header is written. It must
+	// write the response, the response of the request handler is discarded.
+	// Nil responds with a 500 Internal Server Error.
+	StoreErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
 	resetter Resetter
 }
 
-// Middleware converts the ResponseWriter object to a sessionsResponseWriter
-// for buffering cookies across session API requests.
+// resetScheduler is implemented by overseers that know how much of its
+// lifetime a session has used
+type resetScheduler interface {
+	// resetDue returns true if the session has used at least threshold
+	// of its lifetime. It returns an errNoSession error if the request
+	// has no session.
+	resetDue(w http.ResponseWriter, r *http.Request, threshold float64) (bool, error)
+}
+
+// storeErrorReporter is implemented by overseers with a StoreErrorHandler
+type storeErrorReporter interface {
+	// storeErrorHandler returns the StoreErrorHandler of the overseer
+	storeErrorHandler() func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// Middleware is the sessions Middleware, with the session handle of the
+// request context bound to the overseer, see FromContext.
+func (m resetExpiryMiddleware) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw, r := newRequestSession(w, r)
+		m.bind(r)
+
+		next.ServeHTTP(sw, r)
+		sw.finish()
+	})
+}
+
+// MiddlewareWithReset converts the ResponseWriter object to a
+// sessionsResponseWriter for buffering cookies across session API requests.
 // The sessionsResponseWriter implements cookieWriter.
 //
-// MiddlewareWithReset also resets the users session expiry on each request.
+// Like Middleware, it adds the session to the request context, bound to the
+// overseer. MiddlewareWithReset also resets the users session expiry on each request,
+// or only once the session used ResetThreshold of its lifetime.
 // If you do not want this added functionality use Middleware instead.
 func (m resetExpiryMiddleware) MiddlewareWithReset(next http.Handler) http.Handler {
+	m.validate()
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Convert the response writer to a sessions response, so we can
-		// use its cookie buffering and writing capabilities
-		w = newSessionsResponseWriter(w)
-
-		err := m.resetter.ResetExpiry(w, r)
-		// It's possible that the session hasn't been created yet
-		// so there's nothing to reset. In that case, do not explode.
-		if err != nil && !IsNoSessionError(err) {
-			panic(err)
-		}
+		// use its cookie buffering and writing capabilities, and give the
+		// request a session that is only loaded and stored once
+		sw, r := newRequestSession(w, r)
+		m.bind(r)
 
-		next.ServeHTTP(w, r)
+		m.reset(sw, r)
+
+		next.ServeHTTP(sw, r)
+		sw.finish()
 	})
 }
 
-// ResetMiddleware resets the users session expiry on each request.
+// ResetMiddleware resets the users session expiry on each request, or only
+// once the session used ResetThreshold of its lifetime.
 //
 // Note: Generally you will want to use Middleware or MiddlewareWithReset instead
 // of this middleware, but if you have a requirement to insert a middleware
@@ -116,15 +257,82 @@ func (m resetExpiryMiddleware) MiddlewareWithReset(next http.Handler) http.Handl
 //
 // It's also important to note that the sessions Middleware must come BEFORE
 // this middleware in the chain, or you will get a panic.
+// It binds the session handle of the request context to the overseer, if
+// it is not bound to another overseer already.
 func (m resetExpiryMiddleware) ResetMiddleware(next http.Handler) http.Handler {
+	m.validate()
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		err := m.resetter.ResetExpiry(w, r)
-		// It's possible that the session hasn't been created yet
-		// so there's nothing to reset. In that case, do not explode.
-		if err != nil && !IsNoSessionError(err) {
-			panic(err)
-		}
+		m.bind(r)
+		m.reset(w, r)
 
 		next.ServeHTTP(w, r)
 	})
 }
+
+// validate panics if the ResetThreshold is out of range
+func (m resetExpiryMiddleware) validate() {
+	if m.ResetThreshold < 0 || m.ResetThreshold >= 1 {
+		panic(errors.Errorf("ResetThreshold must be at least 0 and less than 1, got %v", m.ResetThreshold))
+	}
+}
+
+// bind binds the session of the request context to the overseer, if the
+// session is not bound to another overseer already
+func (m resetExpiryMiddleware) bind(r *http.Request) {
+	if overseer, ok := m.resetter.(Overseer); ok {
+		getRequestSession(r, overseer)
+	}
+}
+
+// storeErrorHandler returns the StoreErrorHandler, the session of the
+// request is given it when it is bound to the overseer
+func (m resetExpiryMiddleware) storeErrorHandler() func(w http.ResponseWriter, r *http.Request, err error) {
+	return m.StoreErrorHandler
+}
+
+// reset resets the expiry of the session of the request if it is due
+func (m resetExpiryMiddleware) reset(w http.ResponseWriter, r *http.Request) {
+	if scheduler, ok := m.resetter.(resetScheduler); ok && m.ResetThreshold != 0 {
+		due, err := scheduler.resetDue(w, r, m.ResetThreshold)
+		// Reset anyway if the lifetime of the session can't be checked,
+		// errors that prevent the reset are reported by ResetExpiry
+		if IsNoSessionError(err) || (err == nil && !due) {
+			return
+		}
+	}
+
+	err := m.resetter.ResetExpiry(w, r)
+	// It's possible that the session hasn't been created yet
+	// so there's nothing to reset. In that case, do not explode.
+	if err == nil || IsNoSessionError(err) {
+		return
+	}
+
+	if m.ResetErrorHandler == nil {
+		panic(err)
+	}
+	m.ResetErrorHandler(w, r, err)
+}
+
+// resetIsDue returns true if elapsed is at least threshold of lifetime.
+// Sessions without a lifetime are always due.
+func resetIsDue(elapsed, lifetime time.Duration, threshold float64) bool {
+	if lifetime <= 0 {
+		return true
+	}
+
+	return float64(elapsed) >= threshold*float64(lifetime)
+}
+
+// shortestLifetime returns the shortest of the non-zero durations
+func shortestLifetime(durations ...time.Duration) time.Duration {
+	var shortest time.Duration
+	for _, d := range durations {
+		if d > 0 && (shortest == 0 || d < shortest) {
+			shortest = d
+		}
+	}
+
+	return shortest
+}
@@ -1,9 +1,14 @@
 package abcsessions
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/friendsofgo/errors"
 )
 
 func TestMiddlewareWrite(t *testing.T) {
@@ -92,17 +97,18 @@ func TestMiddleware(t *testing.T) {
 
 	hf := Middleware(http.HandlerFunc(fn))
 
-	hf.ServeHTTP(nil, nil)
+	hf.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
 }
 
 type middlewareOverseerMock struct {
 	called bool
+	err    error
 	resetExpiryMiddleware
 }
 
 func (m *middlewareOverseerMock) ResetExpiry(w http.ResponseWriter, r *http.Request) error {
 	m.called = true
-	return nil
+	return m.err
 }
 
 func TestResetMiddleware(t *testing.T) {
@@ -135,8 +141,435 @@ func TestMiddlewareWithReset(t *testing.T) {
 
 	hf := o.MiddlewareWithReset(http.HandlerFunc(fn))
 
-	hf.ServeHTTP(nil, nil)
+	hf.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
 	if !o.called {
 		t.Error("expected called true")
 	}
 }
+
+func TestResetMiddlewareErrorHandler(t *testing.T) {
+	t.Parallel()
+
+	o := &middlewareOverseerMock{err: errors.New("storer down")}
+	o.resetExpiryMiddleware.resetter = o
+
+	var handled error
+	o.ResetErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		handled = err
+	}
+
+	served := false
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		served = true
+	}
+
+	hf := o.MiddlewareWithReset(http.HandlerFunc(fn))
+
+	hf.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if handled != o.err {
+		t.Errorf("expected the error handler to get %v, got %v", o.err, handled)
+	}
+	if !served {
+		t.Error("expected the request to be served")
+	}
+
+	// Without a handler the error panics, like before
+	o.ResetErrorHandler = nil
+	hf = o.ResetMiddleware(http.HandlerFunc(fn))
+
+	defer func() {
+		if r := recover(); r != o.err {
+			t.Errorf("expected a panic with %v, got %v", o.err, r)
+		}
+	}()
+	hf.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestResetMiddlewareThresholdRange(t *testing.T) {
+	t.Parallel()
+
+	o := &middlewareOverseerMock{}
+	o.resetExpiryMiddleware.resetter = o
+	o.ResetThreshold = 1
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected a panic")
+		}
+	}()
+	o.ResetMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+}
+
+// ttlStorer is a memory storer that reports a fixed ttl
+type ttlStorer struct {
+	*MemoryStorer
+	ttl time.Duration
+}
+
+func (s ttlStorer) TTL(ctx context.Context, key string) (time.Duration, time.Duration, error) {
+	if _, err := s.Get(key); err != nil {
+		return 0, 0, err
+	}
+
+	return s.ttl, time.Hour, nil
+}
+
+func TestMiddlewareWithResetThreshold(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	storer := &ttlStorer{MemoryStorer: m}
+
+	opts := NewCookieOptions()
+	opts.MaxAge = time.Hour
+	o := NewStorageOverseer(opts, storer)
+	o.ResetThreshold = 0.5
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	if err := o.Set(w, httptest.NewRequest("GET", "/", nil), "hello"); err != nil {
+		t.Fatal(err)
+	}
+	cookie := w.cookies[opts.Name]
+
+	hf := o.MiddlewareWithReset(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		ttl   time.Duration
+		reset bool
+	}{
+		{ttl: 50 * time.Minute, reset: false},
+		{ttl: 31 * time.Minute, reset: false},
+		{ttl: 30 * time.Minute, reset: true},
+		{ttl: 5 * time.Minute, reset: true},
+	}
+
+	for _, test := range tests {
+		storer.ttl = test.ttl
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		hf.ServeHTTP(rec, r)
+
+		// The session ID cookie is sent again when the expiry is reset
+		if reset := len(rec.Result().Cookies()) != 0; reset != test.reset {
+			t.Errorf("ttl %s: expected reset %t, got %t", test.ttl, test.reset, reset)
+		}
+	}
+
+	// Requests without a session are not reset
+	rec := httptest.NewRecorder()
+	hf.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if len(rec.Result().Cookies()) != 0 {
+		t.Error("expected no cookies")
+	}
+}
+
+// countingStorer counts the calls made to the storer it wraps
+type countingStorer struct {
+	Storer
+	gets int
+	sets int
+}
+
+func (c *countingStorer) Get(key string) (string, error) {
+	c.gets++
+	return c.Storer.Get(key)
+}
+
+func (c *countingStorer) Set(key, value string) error {
+	c.sets++
+	return c.Storer.Set(key, value)
+}
+
+func TestMiddlewareRequestSession(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	storer := &countingStorer{Storer: m}
+	o := NewStorageOverseer(NewCookieOptions(), storer)
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if err := Set(o, w, r, "a", "1"); err != nil {
+			t.Error(err)
+		}
+		if err := Set(o, w, r, "b", "2"); err != nil {
+			t.Error(err)
+		}
+		if err := AddFlash(o, w, r, "f", "flash"); err != nil {
+			t.Error(err)
+		}
+		if val, err := Get(o, w, r, "a"); err != nil || val != "1" {
+			t.Errorf("expected %q, got %q: %v", "1", val, err)
+		}
+		if storer.sets != 0 {
+			t.Errorf("expected no sets before the header is written, got %d", storer.sets)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	Middleware(http.HandlerFunc(fn)).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if storer.sets != 1 {
+		t.Errorf("expected 1 set, got %d", storer.sets)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie, got %d", len(cookies))
+	}
+
+	// Read the session back in a second request, nothing changes
+	// so it must not be stored again
+	storer.gets, storer.sets = 0, 0
+	fn = func(w http.ResponseWriter, r *http.Request) {
+		if val, err := Get(o, w, r, "b"); err != nil || val != "2" {
+			t.Errorf("expected %q, got %q: %v", "2", val, err)
+		}
+		if val, err := Get(o, w, r, "a"); err != nil || val != "1" {
+			t.Errorf("expected %q, got %q: %v", "1", val, err)
+		}
+		w.Write([]byte("hi"))
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	Middleware(http.HandlerFunc(fn)).ServeHTTP(httptest.NewRecorder(), r)
+
+	if storer.gets != 1 {
+		t.Errorf("expected 1 get, got %d", storer.gets)
+	}
+	if storer.sets != 0 {
+		t.Errorf("expected no sets, got %d", storer.sets)
+	}
+}
+
+func TestMiddlewareRequestSessionDel(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	o := NewStorageOverseer(NewCookieOptions(), m)
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if err := Set(o, w, r, "a", "1"); err != nil {
+			t.Error(err)
+		}
+		// Deleting the session discards the pending changes
+		if err := o.Del(w, r); err != nil {
+			t.Error(err)
+		}
+		if _, err := Get(o, w, r, "a"); !IsNoSessionError(err) {
+			t.Errorf("expected no session error, got: %v", err)
+		}
+	}
+
+	Middleware(http.HandlerFunc(fn)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if list, _ := m.All(); len(list) != 0 {
+		t.Errorf("expected no sessions, got %d", len(list))
+	}
+}
+
+func TestMiddlewareConcurrentChanges(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	o := NewStorageOverseer(NewCookieOptions(), m)
+
+	w := httptest.NewRecorder()
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := Set(o, w, r, "a", "1"); err != nil {
+			t.Error(err)
+		}
+		if err := AddFlashMessage(o, w, r, FlashInfo, "old"); err != nil {
+			t.Error(err)
+		}
+	})).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	cookie := w.Result().Cookies()[0]
+
+	request := func(fn http.HandlerFunc) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		Middleware(fn).ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// The first request loads the session and is only stored after the
+	// second one changed it
+	loaded := make(chan struct{})
+	stored := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		request(func(w http.ResponseWriter, r *http.Request) {
+			if err := Set(o, w, r, "b", "2"); err != nil {
+				t.Error(err)
+			}
+			if err := AddFlashMessage(o, w, r, FlashSuccess, "first"); err != nil {
+				t.Error(err)
+			}
+			close(loaded)
+			<-stored
+		})
+	}()
+
+	<-loaded
+	request(func(w http.ResponseWriter, r *http.Request) {
+		if err := Set(o, w, r, "c", "3"); err != nil {
+			t.Error(err)
+		}
+		if err := Del(o, w, r, "a"); err != nil {
+			t.Error(err)
+		}
+		if flashes, err := Flashes(o, w, r); err != nil || len(flashes) != 1 {
+			t.Errorf("expected the old flash message, got %v: %v", flashes, err)
+		}
+		if err := AddFlashMessage(o, w, r, FlashSuccess, "second"); err != nil {
+			t.Error(err)
+		}
+	})
+	close(stored)
+	<-done
+
+	request(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := Get(o, w, r, "a"); !IsNoMapKeyError(err) {
+			t.Errorf("expected a to be deleted, got: %v", err)
+		}
+		for key, want := range map[string]string{"b": "2", "c": "3"} {
+			if val, err := Get(o, w, r, key); err != nil || val != want {
+				t.Errorf("expected %s to be %q, got %q: %v", key, want, val, err)
+			}
+		}
+
+		flashes, err := LevelFlashes(o, w, r, FlashSuccess)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(flashes) != 2 || flashes[0] != "second" || flashes[1] != "first" {
+			t.Errorf("expected the flash messages of both requests, got %q", flashes)
+		}
+		if flashes, _ := LevelFlashes(o, w, r, FlashInfo); len(flashes) != 0 {
+			t.Errorf("expected the read flash message to stay read, got %q", flashes)
+		}
+	})
+}
+
+func TestMiddlewareCookieValueTooLarge(t *testing.T) {
+	t.Parallel()
+
+	o := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+
+	rec := httptest.NewRecorder()
+	o.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := Set(o, w, r, "big", strings.Repeat("a", 20000)); err == nil {
+			t.Error("expected an error for a value over the max size")
+		}
+		if err := Set(o, w, r, "small", "a"); err != nil {
+			t.Error(err)
+		}
+	})).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if len(rec.Result().Cookies()) != 1 {
+		t.Errorf("expected the session cookie, got %d cookies", len(rec.Result().Cookies()))
+	}
+}
+
+func TestMiddlewareSetAfterWriteHeader(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	o := NewStorageOverseer(NewCookieOptions(), m)
+
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if err := Set(o, w, r, "a", "1"); err == nil {
+			t.Error("expected an error setting the session after the header was written")
+		}
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestMiddlewareSetConcurrentWriteHeader(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	o := NewStorageOverseer(NewCookieOptions(), m)
+
+	var setErr error
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := FromContext(r.Context())
+
+		done := make(chan error)
+		go func() {
+			done <- sess.Set("a", "1")
+		}()
+		w.WriteHeader(http.StatusOK)
+		setErr = <-done
+	}
+
+	rec := httptest.NewRecorder()
+	o.Middleware(http.HandlerFunc(fn)).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	// The change is either stored with the response or refused
+	cookies := rec.Result().Cookies()
+	if setErr == nil && len(cookies) != 1 {
+		t.Errorf("expected the accepted change to be stored, got %d cookies", len(cookies))
+	}
+	if setErr != nil && len(cookies) != 0 {
+		t.Errorf("expected the refused change not to be stored, got %d cookies", len(cookies))
+	}
+}
+
+// failingStorer fails to set the sessions of the storer it wraps
+type failingStorer struct {
+	Storer
+}
+
+func (failingStorer) Set(key, value string) error {
+	return errors.New("storer down")
+}
+
+func TestMiddlewareStoreErrorHandler(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	o := NewStorageOverseer(NewCookieOptions(), failingStorer{Storer: m})
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if err := Set(o, w, r, "a", "1"); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte("hello"))
+	}
+
+	// Without a handler the response is replaced with an error
+	rec := httptest.NewRecorder()
+	o.Middleware(http.HandlerFunc(fn)).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "hello") {
+		t.Error("expected the response of the handler to be discarded")
+	}
+
+	var handled error
+	o.StoreErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		handled = err
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	rec = httptest.NewRecorder()
+	o.Middleware(http.HandlerFunc(fn)).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if handled == nil {
+		t.Error("expected the error handler to be called")
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("expected the response of the handler to be discarded, got %q", rec.Body.String())
+	}
+}
@@ -0,0 +1,194 @@
+package abcsessions
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/friendsofgo/errors"
+)
+
+const (
+	// policyEnvelopePrefix marks session values that are wrapped in a
+	// policyEnvelope, values without it were stored before a Policy was set.
+	policyEnvelopePrefix = "abcsp2:"
+	// policyEnvelopeSecondsPrefix marks the envelopes stored before their
+	// times were kept in milliseconds, they are still read
+	policyEnvelopeSecondsPrefix = "abcsp1:"
+)
+
+// Policy limits how long a session can be used and who can use it. Set it
+// on a StorageOverseer or CookieOverseer to have it enforced on every Get,
+// Set and ResetExpiry. A session that violates the policy is deleted and
+// treated as if it did not exist (an errNoSession error is returned).
+//
+// The zero value enforces nothing. When any field is set, the overseer keeps
+// the creation time, last activity time and client fingerprint of the session
+// next to the session value.
+type Policy struct {
+	// AbsoluteTimeout is the maximum lifetime of a session counted from its
+	// creation. Unlike the cookie MaxAge and the storer maxAge it is never
+	// extended, not by ResetExpiry nor by Set. Zero means no absolute timeout.
+	AbsoluteTimeout time.Duration
+	// IdleTimeout is the maximum time between two uses of the session. The
+	// session is used when it is Set, and on every request when the
+	// ResetMiddleware or MiddlewareWithReset are in use. Zero means no idle
+	// timeout.
+	IdleTimeout time.Duration
+	// Fingerprint returns a string identifying the client of the request.
+	// Sessions are bound to the fingerprint of the client that created
+	// them, a request with a different fingerprint invalidates the session.
+	// See UserAgentFingerprint, IPPrefixFingerprint and Fingerprints.
+	// Nil means sessions are not bound to clients.
+	Fingerprint func(r *http.Request) string
+}
+
+// policyEnvelope is what is stored in place of the session value when
+// a Policy is set
+type policyEnvelope struct {
+	Value string `json:"v"`
+	// Created is the unix time in milliseconds the session was created at
+	Created int64 `json:"c"`
+	// Seen is the unix time in milliseconds the session was last used at
+	Seen int64 `json:"s"`
+	// Fingerprint is the hashed fingerprint of the client
+	Fingerprint string `json:"f,omitempty"`
+}
+
+// enabled returns true if the policy enforces anything
+func (p Policy) enabled() bool {
+	return p.AbsoluteTimeout != 0 || p.IdleTimeout != 0 || p.Fingerprint != nil
+}
+
+// open unwraps a stored session value and checks it against the policy.
+// It returns a wrapped errNoSession error if the session violates the
+// policy, the caller is responsible for deleting it.
+//
+// Values stored before the policy was set are adopted as if they had
+// been created now by the client of r. If the policy is not enabled the
+// value is only unwrapped, so that a policy can be removed again.
+func (p Policy) open(r *http.Request, stored string) (policyEnvelope, error) {
+	now := time.Now()
+
+	var env policyEnvelope
+	switch {
+	case strings.HasPrefix(stored, policyEnvelopePrefix):
+		if err := json.Unmarshal([]byte(stored[len(policyEnvelopePrefix):]), &env); err != nil {
+			return env, errors.Wrap(err, "unable to unmarshal session policy envelope")
+		}
+	case strings.HasPrefix(stored, policyEnvelopeSecondsPrefix):
+		if err := json.Unmarshal([]byte(stored[len(policyEnvelopeSecondsPrefix):]), &env); err != nil {
+			return env, errors.Wrap(err, "unable to unmarshal session policy envelope")
+		}
+		env.Created *= int64(time.Second / time.Millisecond)
+		env.Seen *= int64(time.Second / time.Millisecond)
+	default:
+		env = policyEnvelope{
+			Value:       stored,
+			Created:     now.UnixMilli(),
+			Seen:        now.UnixMilli(),
+			Fingerprint: p.fingerprint(r),
+		}
+		return env, nil
+	}
+
+	// The timeouts are compared as durations, so that they are not rounded
+	if p.AbsoluteTimeout != 0 && now.Sub(time.UnixMilli(env.Created)) >= p.AbsoluteTimeout {
+		return env, errors.Wrap(errNoSession{}, "session exceeded its absolute timeout")
+	}
+	if p.IdleTimeout != 0 && now.Sub(time.UnixMilli(env.Seen)) >= p.IdleTimeout {
+		return env, errors.Wrap(errNoSession{}, "session exceeded its idle timeout")
+	}
+	if p.Fingerprint != nil && subtle.ConstantTimeCompare([]byte(env.Fingerprint), []byte(p.fingerprint(r))) != 1 {
+		return env, errors.Wrap(errNoSession{}, "session fingerprint does not match the client")
+	}
+
+	return env, nil
+}
+
+// seal marks the session as used now by the client of r and returns the
+// value to store. A zero Created means the session is created now. If the
+// policy is not enabled the session value is returned as is.
+func (p Policy) seal(r *http.Request, env policyEnvelope) (string, error) {
+	if !p.enabled() {
+		return env.Value, nil
+	}
+
+	now := time.Now().UnixMilli()
+	if env.Created == 0 {
+		env.Created = now
+	}
+	env.Seen = now
+	env.Fingerprint = p.fingerprint(r)
+
+	b, err := json.Marshal(env)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to marshal session policy envelope")
+	}
+
+	return policyEnvelopePrefix + string(b), nil
+}
+
+// fingerprint returns the hashed fingerprint of the client of r, so
+// that client details such as IP addresses are not stored in the session
+func (p Policy) fingerprint(r *http.Request) string {
+	if p.Fingerprint == nil {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(p.Fingerprint(r)))
+	return base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// UserAgentFingerprint is a Policy fingerprint function that binds
+// sessions to the User-Agent of the client
+func UserAgentFingerprint(r *http.Request) string {
+	return r.UserAgent()
+}
+
+// IPPrefixFingerprint returns a Policy fingerprint function that binds
+// sessions to the network of the client: the first ipv4Bits bits of IPv4
+// addresses and the first ipv6Bits bits of IPv6 addresses. Matching on a
+// prefix instead of the full address keeps clients whose address changes
+// within their network logged in, 24 and 64 are reasonable values.
+//
+// The address is taken from r.RemoteAddr. Behind a proxy or load balancer
+// use a middleware that sets RemoteAddr from the forwarding headers (such
+// as chi's middleware.RealIP), or every client will have the same
+// fingerprint.
+func IPPrefixFingerprint(ipv4Bits, ipv6Bits int) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return host
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(ipv4Bits, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(ipv6Bits, 128)).String()
+	}
+}
+
+// Fingerprints returns a Policy fingerprint function that combines the
+// fingerprints of fns, so that a change in any of them invalidates the session.
+func Fingerprints(fns ...func(r *http.Request) string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		parts := make([]string, len(fns))
+		for i, fn := range fns {
+			parts[i] = fn(r)
+		}
+
+		return strings.Join(parts, "\x00")
+	}
+}
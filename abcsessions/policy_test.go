@@ -0,0 +1,328 @@
+package abcsessions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testEnvelope returns a stored session value created and last seen the
+// given durations ago by the client of r
+func testEnvelope(t *testing.T, p Policy, r *http.Request, value string, created, seen time.Duration) string {
+	t.Helper()
+
+	now := time.Now()
+	env := policyEnvelope{
+		Value:       value,
+		Created:     now.Add(-created).UnixMilli(),
+		Seen:        now.Add(-seen).UnixMilli(),
+		Fingerprint: p.fingerprint(r),
+	}
+
+	b, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return policyEnvelopePrefix + string(b)
+}
+
+func TestPolicyOpenLegacy(t *testing.T) {
+	t.Parallel()
+
+	p := Policy{AbsoluteTimeout: time.Hour}
+	r := httptest.NewRequest("GET", "/", nil)
+
+	env, err := p.open(r, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Value != "hello" {
+		t.Errorf("expected %q, got %q", "hello", env.Value)
+	}
+	if env.Created == 0 || env.Seen == 0 {
+		t.Error("expected legacy values to be adopted as new sessions")
+	}
+
+	// A value wrapped with a policy can be read without one
+	sealed, err := p.seal(r, policyEnvelope{Value: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err = Policy{}.open(r, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Value != "hello" {
+		t.Errorf("expected %q, got %q", "hello", env.Value)
+	}
+
+	if sealed, _ = (Policy{}).seal(r, policyEnvelope{Value: "hello"}); sealed != "hello" {
+		t.Errorf("expected values to not be wrapped without a policy, got %q", sealed)
+	}
+}
+
+func TestPolicyTimeouts(t *testing.T) {
+	t.Parallel()
+
+	p := Policy{AbsoluteTimeout: time.Hour, IdleTimeout: time.Minute * 10}
+	r := httptest.NewRequest("GET", "/", nil)
+
+	tests := []struct {
+		created time.Duration
+		seen    time.Duration
+		valid   bool
+	}{
+		{created: time.Minute * 30, seen: time.Minute, valid: true},
+		{created: time.Minute * 61, seen: time.Minute, valid: false},
+		{created: time.Minute * 30, seen: time.Minute * 11, valid: false},
+	}
+
+	for i, test := range tests {
+		_, err := p.open(r, testEnvelope(t, p, r, "hello", test.created, test.seen))
+		if test.valid && err != nil {
+			t.Errorf("%d) expected session to be valid, got: %v", i, err)
+		}
+		if !test.valid && !IsNoSessionError(err) {
+			t.Errorf("%d) expected no session error, got: %v", i, err)
+		}
+	}
+}
+
+func TestPolicySubSecondTimeouts(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest("GET", "/", nil)
+
+	// Timeouts are not rounded down to whole seconds
+	p := Policy{IdleTimeout: time.Millisecond * 500}
+	if _, err := p.open(r, testEnvelope(t, p, r, "hello", 0, time.Millisecond*100)); err != nil {
+		t.Errorf("expected session to be valid, got: %v", err)
+	}
+	if _, err := p.open(r, testEnvelope(t, p, r, "hello", 0, time.Millisecond*600)); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+
+	p = Policy{AbsoluteTimeout: time.Millisecond * 1500}
+	if _, err := p.open(r, testEnvelope(t, p, r, "hello", time.Millisecond*1200, 0)); err != nil {
+		t.Errorf("expected session to be valid, got: %v", err)
+	}
+	if _, err := p.open(r, testEnvelope(t, p, r, "hello", time.Millisecond*1600, 0)); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
+
+func TestPolicyOpenSeconds(t *testing.T) {
+	t.Parallel()
+
+	p := Policy{AbsoluteTimeout: time.Hour}
+	r := httptest.NewRequest("GET", "/", nil)
+
+	// Envelopes stored with times in seconds are still read
+	created := time.Now().Add(-time.Minute * 30).Unix()
+	stored := fmt.Sprintf(`%s{"v":"hello","c":%d,"s":%d}`, policyEnvelopeSecondsPrefix, created, created)
+	env, err := p.open(r, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Value != "hello" || env.Created != created*1000 {
+		t.Errorf("expected the creation time in milliseconds, got: %#v", env)
+	}
+
+	created = time.Now().Add(-time.Minute * 61).Unix()
+	stored = fmt.Sprintf(`%s{"v":"hello","c":%d,"s":%d}`, policyEnvelopeSecondsPrefix, created, created)
+	if _, err = p.open(r, stored); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
+
+func TestPolicyFingerprint(t *testing.T) {
+	t.Parallel()
+
+	p := Policy{Fingerprint: Fingerprints(UserAgentFingerprint, IPPrefixFingerprint(24, 64))}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "firefox")
+	r.RemoteAddr = "10.0.0.1:1234"
+
+	sealed, err := p.seal(r, policyEnvelope{Value: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same network
+	r.RemoteAddr = "10.0.0.2:4321"
+	if _, err = p.open(r, sealed); err != nil {
+		t.Error(err)
+	}
+
+	r.RemoteAddr = "10.0.1.1:1234"
+	if _, err = p.open(r, sealed); !IsNoSessionError(err) {
+		t.Errorf("expected no session error on ip change, got: %v", err)
+	}
+
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("User-Agent", "chrome")
+	if _, err = p.open(r, sealed); !IsNoSessionError(err) {
+		t.Errorf("expected no session error on user agent change, got: %v", err)
+	}
+}
+
+func TestIPPrefixFingerprint(t *testing.T) {
+	t.Parallel()
+
+	fn := IPPrefixFingerprint(24, 48)
+
+	tests := []struct {
+		remote string
+		want   string
+	}{
+		{remote: "192.168.1.77:80", want: "192.168.1.0"},
+		{remote: "[2001:db8:1:2:3:4:5:6]:80", want: "2001:db8:1::"},
+		{remote: "192.168.1.77", want: "192.168.1.0"},
+		{remote: "garbage", want: "garbage"},
+	}
+
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		if got := fn(r); got != test.want {
+			t.Errorf("%d) expected %q, got %q", i, test.want, got)
+		}
+	}
+}
+
+func TestStorageOverseerPolicy(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), m)
+	s.Policy = Policy{AbsoluteTimeout: time.Hour, IdleTimeout: time.Minute * 10}
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	if err := s.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := s.SessionID(w, r)
+
+	val, err := s.Get(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "hello" {
+		t.Errorf("expected %q, got %q", "hello", val)
+	}
+
+	// Resetting the expiry must not extend the absolute timeout
+	m.Set(id, testEnvelope(t, s.Policy, r, "hello", time.Minute*59, time.Minute))
+	if err = s.ResetExpiry(w, r); err != nil {
+		t.Error(err)
+	}
+	stored, _ := m.Get(id)
+	env, err := s.Policy.open(r, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(time.UnixMilli(env.Created)) < time.Minute*58 {
+		t.Error("expected reset expiry to keep the creation time")
+	}
+	if time.Since(time.UnixMilli(env.Seen)) > time.Second*10 {
+		t.Error("expected reset expiry to update the last seen time")
+	}
+
+	m.Set(id, testEnvelope(t, s.Policy, r, "hello", time.Minute*61, time.Minute))
+	if _, err = s.Get(w, r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if _, err = m.Get(id); !IsNoSessionError(err) {
+		t.Error("expected the expired session to be deleted")
+	}
+
+	// Setting a value after the session expired creates a new session
+	if err = s.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if newID, _ := s.SessionID(w, r); newID == id {
+		t.Error("expected a new session id")
+	}
+}
+
+func TestCookieOverseerPolicy(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	c.Policy = Policy{Fingerprint: UserAgentFingerprint}
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.Header.Set("User-Agent", "firefox")
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	if err := c.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := c.Get(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "hello" {
+		t.Errorf("expected %q, got %q", "hello", val)
+	}
+
+	r.Header.Set("User-Agent", "curl")
+	if _, err = c.Get(w, r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if cookie := w.GetCookie(c.options.Name); cookie == nil || cookie.MaxAge >= 0 {
+		t.Error("expected the session cookie to be deleted")
+	}
+}
+
+// racingStorer is a memory storer that changes the session with value right
+// after it is read with GetVersioned, like a concurrent request would
+type racingStorer struct {
+	*MemoryStorer
+	value string
+}
+
+func (r *racingStorer) GetVersioned(ctx context.Context, key string) (string, string, error) {
+	val, version, err := r.MemoryStorer.GetVersioned(ctx, key)
+	if err == nil {
+		err = r.MemoryStorer.Set(key, r.value)
+	}
+	return val, version, err
+}
+
+func TestStorageOverseerPolicyTouchConcurrent(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	storer := &racingStorer{MemoryStorer: m}
+	s := NewStorageOverseer(NewCookieOptions(), storer)
+	s.Policy = Policy{IdleTimeout: time.Minute * 10}
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	if err := s.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := s.SessionID(w, r)
+
+	// Resetting the expiry keeps the value stored in the meantime
+	storer.value = testEnvelope(t, s.Policy, r, "changed", time.Minute, 0)
+	if err := s.ResetExpiry(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _ := m.Get(id)
+	if stored != storer.value {
+		t.Errorf("expected the concurrent change to be kept, got %q", stored)
+	}
+}
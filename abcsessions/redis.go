@@ -1,18 +1,98 @@
 package abcsessions
 
 import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/friendsofgo/errors"
 	redis "gopkg.in/redis.v5"
 )
 
+const (
+	// redisIndexPrefix is the prefix (after the storer's prefix) of all
+	// keys that are not sessions
+	redisIndexPrefix = "abcsessions:"
+	// redisOwnerPrefix is the prefix of the sets of session ids of each owner
+	redisOwnerPrefix = redisIndexPrefix + "owner:"
+	// redisSessionOwnerPrefix is the prefix of the keys holding the owner
+	// of a session. They expire along with the session.
+	redisSessionOwnerPrefix = redisIndexPrefix + "session-owner:"
+)
+
+// redisSetOwner attaches a session to an owner, removing it from the set
+// of its previous owner. The owner key expires along with the session.
+//
+// KEYS[1]: session, KEYS[2]: session owner, KEYS[3]: owner set
+// ARGV[1]: owner, ARGV[2]: owner prefix, ARGV[3]: session id
+var redisSetOwner = redis.NewScript(`
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl == -2 then
+	return 0
+end
+local old = redis.call('GET', KEYS[2])
+if old then
+	redis.call('SREM', ARGV[2] .. old, ARGV[3])
+end
+redis.call('SADD', KEYS[3], ARGV[3])
+if ttl > 0 then
+	redis.call('SET', KEYS[2], ARGV[1], 'PX', ttl)
+else
+	redis.call('SET', KEYS[2], ARGV[1])
+end
+return 1
+`)
+
+// redisDelOwner deletes all sessions of an owner
+//
+// KEYS[1]: owner set
+// ARGV[1]: session prefix, ARGV[2]: session owner prefix
+var redisDelOwner = redis.NewScript(`
+local ids = redis.call('SMEMBERS', KEYS[1])
+for _, id in ipairs(ids) do
+	redis.call('DEL', ARGV[1] .. id, ARGV[2] .. id)
+end
+redis.call('DEL', KEYS[1])
+return #ids
+`)
+
+// redisCompareAndSet sets a session if its value still has the version
+// it was read at, see valueVersion. An empty version means the session
+// must not exist.
+//
+// KEYS[1]: session
+// ARGV[1]: value, ARGV[2]: version, ARGV[3]: max age in milliseconds or 0
+var redisCompareAndSet = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current then
+	if redis.sha1hex(current) ~= ARGV[2] then
+		return 0
+	end
+elseif ARGV[2] ~= '' then
+	return 0
+end
+if ARGV[3] == '0' then
+	redis.call('SET', KEYS[1], ARGV[1])
+else
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+end
+return 1
+`)
+
 // RedisStorer is a session storer implementation for saving sessions
 // to a Redis database.
+//
+// Session keys are the session ID prefixed with the storer's prefix, so
+// that sessions don't collide with other data in the same database. The
+// owner index (see OwnerStorer) is kept under prefix + "abcsessions:".
 type RedisStorer struct {
 	// How long sessions take to expire in Redis
 	maxAge time.Duration
-	client *redis.Client
+	// prefix of all keys written by the storer
+	prefix string
+	client redis.Cmdable
 }
 
 // NewDefaultRedisStorer takes a bind address of the Redis server host:port and
@@ -22,6 +102,7 @@ type RedisStorer struct {
 // Password: no password
 // DB: First database (0) to be selected after connecting to Redis
 // maxAge: 2 days (clear session stored in Redis after 2 days)
+// prefix: none
 func NewDefaultRedisStorer(addr, password string, db int) (*RedisStorer, error) {
 	if addr == "" {
 		addr = "localhost:6379"
@@ -36,12 +117,41 @@ func NewDefaultRedisStorer(addr, password string, db int) (*RedisStorer, error)
 
 // NewRedisStorer initializes and returns a new RedisStorer object.
 // It takes a bind address of the Redis server host:port and the maxAge of how
-// long each session should live in the Redis server.
+// long each session should live in the Redis server. Session keys are not
+// prefixed, use NewRedisStorerClient to set a prefix.
 // Persistent storage can be attained by setting maxAge to zero.
 func NewRedisStorer(opts redis.Options, maxAge time.Duration) (*RedisStorer, error) {
+	return NewRedisStorerClient(redis.NewClient(&opts), "", maxAge)
+}
+
+// NewFailoverRedisStorer returns a RedisStorer that uses Redis Sentinel
+// for automatic failover. Session keys are prefixed with prefix.
+func NewFailoverRedisStorer(opts redis.FailoverOptions, prefix string, maxAge time.Duration) (*RedisStorer, error) {
+	return NewRedisStorerClient(redis.NewFailoverClient(&opts), prefix, maxAge)
+}
+
+// NewClusterRedisStorer returns a RedisStorer that uses a Redis Cluster.
+// Session keys are prefixed with prefix.
+//
+// Sessions are spread across the cluster, so the owner index operations
+// (SetOwner and DelOwner) can't run in a single script and are not atomic.
+func NewClusterRedisStorer(opts redis.ClusterOptions, prefix string, maxAge time.Duration) (*RedisStorer, error) {
+	return NewRedisStorerClient(redis.NewClusterClient(&opts), prefix, maxAge)
+}
+
+// NewRedisStorerClient returns a RedisStorer using an existing client, which
+// can be a *redis.Client, a failover client or a *redis.ClusterClient.
+// Session keys are prefixed with prefix, for example "session:".
+// Persistent storage can be attained by setting maxAge to zero.
+func NewRedisStorerClient(client redis.Cmdable, prefix string, maxAge time.Duration) (*RedisStorer, error) {
+	if client == nil {
+		return nil, errors.New("redis client must be provided")
+	}
+
 	r := &RedisStorer{
 		maxAge: maxAge,
-		client: redis.NewClient(&opts),
+		prefix: prefix,
+		client: client,
 	}
 
 	return r, nil
@@ -49,20 +159,67 @@ func NewRedisStorer(opts redis.Options, maxAge time.Duration) (*RedisStorer, err
 
 // All keys in the redis store
 func (r *RedisStorer) All() ([]string, error) {
+	return r.AllContext(context.Background())
+}
+
+// AllContext is All that is abandoned once ctx is done
+func (r *RedisStorer) AllContext(ctx context.Context) ([]string, error) {
+	client := r.withContext(ctx)
 	var sessions []string
 
-	iter := r.client.Scan(0, "", 0).Iterator()
-	for iter.Next() {
-		sessions = append(sessions, iter.Val())
+	err := redisDo(ctx, func() error {
+		// Every node of a cluster holds part of the keys, the nodes
+		// are scanned concurrently
+		if cluster, ok := r.client.(*redis.ClusterClient); ok {
+			var mut sync.Mutex
+			return cluster.ForEachMaster(func(node *redis.Client) error {
+				keys, err := r.scan(node.WithContext(ctx))
+				mut.Lock()
+				sessions = append(sessions, keys...)
+				mut.Unlock()
+				return err
+			})
+		}
+
+		var err error
+		sessions, err = r.scan(client)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to iterate redis store")
 	}
-	err := iter.Err()
-	return sessions, errors.Wrap(err, "unable to iterate redis store")
+
+	return sessions, nil
 }
 
 // Get returns the value string saved in the session pointed to by the
 // session id key.
 func (r *RedisStorer) Get(key string) (value string, err error) {
-	val, err := r.client.Get(key).Result()
+	return r.GetContext(context.Background(), key)
+}
+
+// redisWrite runs fn unless ctx is already done, and then waits for fn to
+// finish even if ctx is done in the meantime. Unlike reads, writes are never
+// abandoned by redisDo: the command would still be applied by redis while
+// the caller is told it failed, and retry or report a conflict for it.
+func redisWrite(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return fn()
+}
+
+// GetContext is Get that is abandoned once ctx is done
+func (r *RedisStorer) GetContext(ctx context.Context, key string) (value string, err error) {
+	client := r.withContext(ctx)
+	var val string
+
+	err = redisDo(ctx, func() error {
+		var err error
+		val, err = client.Get(r.prefix + key).Result()
+		return err
+	})
 	if err == redis.Nil {
 		return "", errNoSession{}
 	} else if err != nil {
@@ -74,15 +231,346 @@ func (r *RedisStorer) Get(key string) (value string, err error) {
 
 // Set saves the value string to the session pointed to by the session id key.
 func (r *RedisStorer) Set(key, value string) error {
-	return r.client.Set(key, value, r.maxAge).Err()
+	return r.SetContext(context.Background(), key, value)
+}
+
+// SetContext is Set that is not started once ctx is done, see redisWrite
+func (r *RedisStorer) SetContext(ctx context.Context, key, value string) error {
+	client := r.withContext(ctx)
+	return redisWrite(ctx, func() error {
+		_, err := client.Pipelined(func(pipe *redis.Pipeline) error {
+			pipe.Set(r.prefix+key, value, r.maxAge)
+			if r.maxAge != 0 {
+				pipe.Expire(r.sessionOwnerKey(key), r.maxAge)
+			}
+			return nil
+		})
+		return err
+	})
 }
 
 // Del the session pointed to by the session id key and remove it.
 func (r *RedisStorer) Del(key string) error {
-	return r.client.Del(key).Err()
+	return r.DelContext(context.Background(), key)
+}
+
+// DelContext is Del that is not started once ctx is done, see redisWrite
+func (r *RedisStorer) DelContext(ctx context.Context, key string) error {
+	client := r.withContext(ctx)
+	return redisWrite(ctx, func() error {
+		// The keys are deleted separately because they can be on
+		// different cluster nodes
+		_, err := client.Pipelined(func(pipe *redis.Pipeline) error {
+			pipe.Del(r.prefix + key)
+			pipe.Del(r.sessionOwnerKey(key))
+			return nil
+		})
+		return err
+	})
 }
 
 // ResetExpiry resets the expiry of the key
 func (r *RedisStorer) ResetExpiry(key string) error {
-	return r.client.Expire(key, r.maxAge).Err()
+	return r.ResetExpiryContext(context.Background(), key)
+}
+
+// ResetExpiryContext is ResetExpiry that is not started once ctx is done, see redisWrite
+func (r *RedisStorer) ResetExpiryContext(ctx context.Context, key string) error {
+	client := r.withContext(ctx)
+	return redisWrite(ctx, func() error {
+		_, err := client.Pipelined(func(pipe *redis.Pipeline) error {
+			pipe.Expire(r.prefix+key, r.maxAge)
+			if r.maxAge != 0 {
+				pipe.Expire(r.sessionOwnerKey(key), r.maxAge)
+			}
+			return nil
+		})
+		return err
+	})
+}
+
+// GetVersioned returns the value of the session pointed to by the session
+// id key along with its version
+func (r *RedisStorer) GetVersioned(ctx context.Context, key string) (string, string, error) {
+	value, err := r.GetContext(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	return value, valueVersion(value), nil
+}
+
+// CompareAndSet saves the value string to the session pointed to by the
+// session id key if it is still at version, see VersionedStorer. The
+// version is checked and the value set by a script, so that no other
+// client can change the session in between. Like the other writes it is
+// not started once ctx is done, see redisWrite.
+func (r *RedisStorer) CompareAndSet(ctx context.Context, key, value, version string) error {
+	client := r.withContext(ctx)
+	var ok interface{}
+
+	err := redisWrite(ctx, func() error {
+		var err error
+		ok, err = redisCompareAndSet.Run(client, []string{r.prefix + key},
+			value, version, strconv.FormatInt(int64(r.maxAge/time.Millisecond), 10),
+		).Result()
+		if err != nil || ok == int64(0) || r.maxAge == 0 {
+			return err
+		}
+
+		// The owner key can be on another cluster node
+		return client.Expire(r.sessionOwnerKey(key), r.maxAge).Err()
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to set session value")
+	}
+	if ok == int64(0) {
+		return errVersionConflict{}
+	}
+
+	return nil
+}
+
+// TTL returns the time left before the session pointed to by the session
+// id key expires, see TTLStorer
+func (r *RedisStorer) TTL(ctx context.Context, key string) (time.Duration, time.Duration, error) {
+	client := r.withContext(ctx)
+	var ttl time.Duration
+
+	err := redisDo(ctx, func() error {
+		var err error
+		ttl, err = client.PTTL(r.prefix + key).Result()
+		return err
+	})
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "unable to get session ttl")
+	}
+
+	// PTTL returns -2 if the key does not exist and -1 if it has no expiry
+	if ttl == -2*time.Millisecond {
+		return 0, 0, errNoSession{}
+	}
+	if r.maxAge == 0 || ttl < 0 {
+		return 0, 0, nil
+	}
+
+	return ttl, r.maxAge, nil
+}
+
+// SetOwner attaches the session pointed to by the session id key to owner
+func (r *RedisStorer) SetOwner(key, owner string) error {
+	if _, ok := r.client.(*redis.ClusterClient); ok {
+		return r.setOwnerCluster(key, owner)
+	}
+
+	keys := []string{r.prefix + key, r.sessionOwnerKey(key), r.ownerKey(owner)}
+
+	ok, err := redisSetOwner.Run(r.client, keys, owner, r.prefix+redisOwnerPrefix, key).Result()
+	if err != nil {
+		return errors.Wrap(err, "unable to set session owner")
+	}
+	if ok == int64(0) {
+		return errNoSession{}
+	}
+
+	return nil
+}
+
+// Owner returns the owner of the session pointed to by the session id key
+func (r *RedisStorer) Owner(key string) (string, error) {
+	owner, err := r.client.Get(r.sessionOwnerKey(key)).Result()
+	if err == redis.Nil {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrap(err, "unable to get session owner")
+	}
+
+	return owner, nil
+}
+
+// OwnerSessions returns the session ids of all sessions of owner.
+// Sessions that expired are removed from the owner's set.
+func (r *RedisStorer) OwnerSessions(owner string) ([]string, error) {
+	ownerKey := r.ownerKey(owner)
+
+	ids, err := r.client.SMembers(ownerKey).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get owner sessions")
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	exists := make([]*redis.BoolCmd, len(ids))
+	_, err = r.client.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, id := range ids {
+			exists[i] = pipe.Exists(r.prefix + id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to check owner sessions")
+	}
+
+	var sessions []string
+	var expired []interface{}
+	for i, id := range ids {
+		if exists[i].Val() {
+			sessions = append(sessions, id)
+		} else {
+			expired = append(expired, id)
+		}
+	}
+
+	if len(expired) != 0 {
+		if err = r.client.SRem(ownerKey, expired...).Err(); err != nil {
+			return nil, errors.Wrap(err, "unable to remove expired owner sessions")
+		}
+	}
+
+	return sessions, nil
+}
+
+// DelOwner deletes all sessions of owner
+func (r *RedisStorer) DelOwner(owner string) error {
+	if _, ok := r.client.(*redis.ClusterClient); ok {
+		return r.delOwnerCluster(owner)
+	}
+
+	keys := []string{r.ownerKey(owner)}
+	err := redisDelOwner.Run(r.client, keys, r.prefix, r.prefix+redisSessionOwnerPrefix).Err()
+	return errors.Wrap(err, "unable to delete owner sessions")
+}
+
+// setOwnerCluster is SetOwner for clusters, where the keys involved can
+// be on different nodes so the script can't be used
+func (r *RedisStorer) setOwnerCluster(key, owner string) error {
+	ttl, err := r.client.PTTL(r.prefix + key).Result()
+	if err != nil {
+		return errors.Wrap(err, "unable to get session ttl")
+	}
+	// PTTL returns -2 (as a duration) if the key does not exist
+	if ttl == -2*time.Millisecond {
+		return errNoSession{}
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	old, err := r.Owner(key)
+	if err != nil {
+		return err
+	}
+	if len(old) != 0 {
+		if err = r.client.SRem(r.ownerKey(old), key).Err(); err != nil {
+			return errors.Wrap(err, "unable to remove session from previous owner")
+		}
+	}
+
+	if err = r.client.SAdd(r.ownerKey(owner), key).Err(); err != nil {
+		return errors.Wrap(err, "unable to add session to owner")
+	}
+
+	err = r.client.Set(r.sessionOwnerKey(key), owner, ttl).Err()
+	return errors.Wrap(err, "unable to set session owner")
+}
+
+// delOwnerCluster is DelOwner for clusters, where the keys involved can
+// be on different nodes so the script can't be used
+func (r *RedisStorer) delOwnerCluster(owner string) error {
+	ownerKey := r.ownerKey(owner)
+
+	ids, err := r.client.SMembers(ownerKey).Result()
+	if err != nil {
+		return errors.Wrap(err, "unable to get owner sessions")
+	}
+
+	_, err = r.client.Pipelined(func(pipe *redis.Pipeline) error {
+		for _, id := range ids {
+			pipe.Del(r.prefix + id)
+			pipe.Del(r.sessionOwnerKey(id))
+		}
+		pipe.Del(ownerKey)
+		return nil
+	})
+	return errors.Wrap(err, "unable to delete owner sessions")
+}
+
+// scan returns the session ids of all session keys of a single redis node
+func (r *RedisStorer) scan(client redis.Cmdable) ([]string, error) {
+	var sessions []string
+
+	iter := client.Scan(0, redisEscapeGlob(r.prefix)+"*", 0).Iterator()
+	for iter.Next() {
+		key := iter.Val()
+		// Skip the owner index keys
+		if strings.HasPrefix(key, r.prefix+redisIndexPrefix) {
+			continue
+		}
+		sessions = append(sessions, strings.TrimPrefix(key, r.prefix))
+	}
+
+	return sessions, iter.Err()
+}
+
+// ownerKey returns the key of the set of session ids of owner
+func (r *RedisStorer) ownerKey(owner string) string {
+	return r.prefix + redisOwnerPrefix + owner
+}
+
+// sessionOwnerKey returns the key holding the owner of the session id key
+func (r *RedisStorer) sessionOwnerKey(key string) string {
+	return r.prefix + redisSessionOwnerPrefix + key
+}
+
+// redisEscapeGlob escapes the characters of s that have a special
+// meaning in a redis glob pattern
+func redisEscapeGlob(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+// withContext returns the client bound to ctx. Only *redis.Client, which
+// includes the failover client, takes a context, the cluster client is
+// returned as is and commands sent with it are only abandoned by redisDo.
+func (r *RedisStorer) withContext(ctx context.Context) redis.Cmdable {
+	if client, ok := r.client.(*redis.Client); ok {
+		return client.WithContext(ctx)
+	}
+
+	return r.client
+}
+
+// redisDo runs fn and waits for it to finish or for ctx to be done,
+// whichever happens first. The redis client does not support cancellation,
+// so an abandoned fn keeps running in the background until the command
+// completes or hits the client's read/write timeouts. It is only used for
+// reads, see redisWrite.
+func redisDo(ctx context.Context, fn func() error) error {
+	if ctx.Done() == nil {
+		return fn()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
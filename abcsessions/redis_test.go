@@ -1,14 +1,31 @@
 package abcsessions
 
 import (
+	"context"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	uuid "github.com/satori/go.uuid"
 
 	redis "gopkg.in/redis.v5"
 )
 
+// newTestRedisStorer returns a RedisStorer backed by an in-process
+// redis server that is closed when the test ends
+func newTestRedisStorer(t *testing.T, prefix string) (*RedisStorer, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+
+	s, err := NewRedisStorerClient(redis.NewClient(&redis.Options{Addr: mr.Addr()}), prefix, time.Hour*24*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, mr
+}
+
 func TestRedisStorerNew(t *testing.T) {
 	t.Parallel()
 
@@ -57,10 +74,7 @@ func TestRedisStorerNewDefault(t *testing.T) {
 func TestRedisStorerAll(t *testing.T) {
 	t.Parallel()
 
-	s, err := NewDefaultRedisStorer("", "", 13)
-	if err != nil {
-		t.Error(err)
-	}
+	s, _ := newTestRedisStorer(t, "")
 
 	list, err := s.All()
 	if err != nil {
@@ -97,10 +111,7 @@ func TestRedisStorerGet(t *testing.T) {
 		t.Skip("skipping long test")
 	}
 
-	storer, err := NewDefaultRedisStorer("", "", 13)
-	if err != nil {
-		t.Error(err)
-	}
+	storer, _ := newTestRedisStorer(t, "")
 
 	testid1 := uuid.NewV4().String()
 
@@ -128,10 +139,7 @@ func TestRedisStorerSet(t *testing.T) {
 		t.Skip("skipping long test")
 	}
 
-	storer, err := NewDefaultRedisStorer("", "", 13)
-	if err != nil {
-		t.Error(err)
-	}
+	storer, _ := newTestRedisStorer(t, "")
 
 	testid1 := uuid.NewV4().String()
 	testid2 := uuid.NewV4().String()
@@ -166,16 +174,13 @@ func TestRedisStorerDel(t *testing.T) {
 		t.Skip("skipping long test")
 	}
 
-	storer, err := NewDefaultRedisStorer("", "", 13)
-	if err != nil {
-		t.Error(err)
-	}
+	storer, _ := newTestRedisStorer(t, "")
 
 	storer.Set("hi", "hello")
 	storer.Set("hi", "whatsup")
 	storer.Set("yo", "friend")
 
-	err = storer.Del("hi")
+	err := storer.Del("hi")
 	if err != nil {
 		t.Error(err)
 	}
@@ -195,14 +200,11 @@ func TestRedisStorerResetExpiry(t *testing.T) {
 		t.Skip("skipping long test")
 	}
 
-	storer, err := NewDefaultRedisStorer("", "", 13)
-	if err != nil {
-		t.Error(err)
-	}
+	storer, _ := newTestRedisStorer(t, "")
 	// Set maxage duration to 1 hour
 	storer.maxAge = time.Hour * 1
 
-	err = storer.Set("test", "test1")
+	err := storer.Set("test", "test1")
 	if err != nil {
 		t.Error(err)
 	}
@@ -238,3 +240,99 @@ func TestRedisStorerResetExpiry(t *testing.T) {
 	// Cleanup
 	storer.Del("test")
 }
+
+func TestRedisStorerOwner(t *testing.T) {
+	t.Parallel()
+
+	s, _ := newTestRedisStorer(t, "")
+
+	testOwnerStorer(t, s)
+}
+
+func TestRedisStorerPrefix(t *testing.T) {
+	t.Parallel()
+
+	s, mr := newTestRedisStorer(t, "sess*:")
+
+	// Keys of other applications sharing the database
+	mr.Set("other", "value")
+	mr.Set("sessx:other", "value")
+
+	if err := s.Set("hi", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetOwner("hi", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if val, err := mr.Get("sess*:hi"); err != nil || val != "hello" {
+		t.Errorf("expected the session key to be prefixed, got %q: %v", val, err)
+	}
+
+	list, err := s.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0] != "hi" {
+		t.Errorf("expected [hi], got %v", list)
+	}
+
+	if err = s.Del("hi"); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("sess*:hi") || !mr.Exists("other") {
+		t.Error("expected only the session to be deleted")
+	}
+}
+
+func TestRedisEscapeGlob(t *testing.T) {
+	t.Parallel()
+
+	if got := redisEscapeGlob(`a*b?c[d]e\f`); got != `a\*b\?c\[d\]e\\f` {
+		t.Errorf("wrong escape: %s", got)
+	}
+}
+
+func TestRedisStorerNewFailoverCluster(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewFailoverRedisStorer(redis.FailoverOptions{MasterName: "master", SentinelAddrs: []string{"localhost:26379"}}, "sess:", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.client.(*redis.Client); !ok || s.prefix != "sess:" {
+		t.Errorf("expected a failover client with a prefix, got %T %q", s.client, s.prefix)
+	}
+
+	s, err = NewClusterRedisStorer(redis.ClusterOptions{Addrs: []string{"localhost:7000"}}, "sess:", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.client.(*redis.ClusterClient); !ok {
+		t.Errorf("expected a cluster client, got %T", s.client)
+	}
+
+	if _, err = NewRedisStorerClient(nil, "", 0); err == nil {
+		t.Error("expected an error on a nil client")
+	}
+}
+
+func TestRedisStorerWithContext(t *testing.T) {
+	t.Parallel()
+
+	s, _ := newTestRedisStorer(t, "")
+
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+
+	client, ok := s.withContext(ctx).(*redis.Client)
+	if !ok {
+		t.Fatalf("expected a *redis.Client, got %T", s.withContext(ctx))
+	}
+	if client.Context() != ctx {
+		t.Error("expected the client to be bound to the context")
+	}
+	if s.client.(*redis.Client).Context() == ctx {
+		t.Error("expected the storer client to be left unbound")
+	}
+}
@@ -0,0 +1,284 @@
+package abcsessions
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/friendsofgo/errors"
+)
+
+// ctxKey is the type of the keys this package stores in request contexts
+type ctxKey int
+
+const (
+	ctxKeyRequestSession ctxKey = iota
+)
+
+// requestSession is the session of a single request. The sessions
+// middleware stores it in the request context, and the JSON helpers
+// (Set, Get, AddFlash, Value.Set, ...) use it instead of going to the
+// overseer on every call: the session is loaded from the overseer the first
+// time it is used, changed in memory, and stored once when the response
+// header is written, but only if it was changed.
+//
+// The first overseer used with the requestSession is bound to it. Helpers
+// called with a different overseer talk to that overseer directly.
+//
+// If the overseer implements UpdateOverseer the changes are merged into
+// the stored session instead of replacing it, so that concurrent requests
+// changing different keys of the same session keep each other's changes.
+//
+// Changes the overseer can tell it will refuse, like values that are too
+// large for the CookieOverseer, are refused by the helpers right away.
+// Changes made after the response header was written are refused as well.
+// Errors storing the session when the header is written are handled by the
+// StoreErrorHandler of the overseer.
+type requestSession struct {
+	mut sync.Mutex
+
+	w        *sessionsResponseWriter
+	r        *http.Request
+	overseer Overseer
+
+	// loaded is true once the session was loaded from the overseer or set
+	loaded bool
+	// exists is false if the overseer had no session
+	exists bool
+	// stored is true if the overseer had the session when it was loaded,
+	// unlike exists it is not changed by set
+	stored bool
+	// dirty is true if the session must be stored
+	dirty bool
+	// flushed is true once the response header is being written, the
+	// session can no longer be changed then
+	flushed bool
+	sess    session
+	// base is the session as it was loaded, to find the changes to merge
+	base session
+	// storeErrorHandler is the StoreErrorHandler of the bound overseer
+	storeErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// valueChecker is implemented by overseers that can tell if a value can be
+// stored before it is stored, so that the JSON helpers return the error
+// instead of it happening when the response header is written
+type valueChecker interface {
+	// checkValue returns an error if value can not be stored
+	checkValue(r *http.Request, value string) error
+}
+
+// newRequestSession creates a sessionsResponseWriter from w along with a
+// requestSession that is attached to both the writer and the returned
+// request's context.
+func newRequestSession(w http.ResponseWriter, r *http.Request) (*sessionsResponseWriter, *http.Request) {
+	sw := newSessionsResponseWriter(w)
+	rs := &requestSession{w: sw}
+
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeyRequestSession, rs))
+	rs.r = r
+	sw.session = rs
+
+	return sw, r
+}
+
+// getRequestSession returns the requestSession of r if it is bound to
+// overseer, binding it if it is not bound yet. It returns nil if the request
+// did not go through the sessions middleware or if the requestSession is
+// bound to another overseer.
+func getRequestSession(r *http.Request, overseer Overseer) *requestSession {
+	rs, ok := r.Context().Value(ctxKeyRequestSession).(*requestSession)
+	if !ok {
+		return nil
+	}
+
+	rs.mut.Lock()
+	defer rs.mut.Unlock()
+
+	if rs.overseer == nil {
+		rs.overseer = overseer
+		if h, ok := overseer.(storeErrorReporter); ok {
+			rs.storeErrorHandler = h.storeErrorHandler()
+		}
+	} else if rs.overseer != overseer {
+		return nil
+	}
+
+	return rs
+}
+
+// resetRequestSession discards the session cached for r along with any
+// unsaved changes, so that it is loaded from the overseer again on next use.
+// The overseers call it when the stored session is changed directly.
+func resetRequestSession(r *http.Request) {
+	rs, ok := r.Context().Value(ctxKeyRequestSession).(*requestSession)
+	if !ok {
+		return
+	}
+
+	rs.mut.Lock()
+	defer rs.mut.Unlock()
+
+	rs.loaded = false
+	rs.exists = false
+	rs.stored = false
+	rs.dirty = false
+	rs.sess = session{}
+	rs.base = session{}
+}
+
+// storedRequestSession returns whether overseer had the session of r when
+// the requestSession loaded it. known is false if the requestSession did not
+// load it from overseer since it was last reset.
+func storedRequestSession(r *http.Request, overseer Overseer) (stored, known bool) {
+	rs, ok := r.Context().Value(ctxKeyRequestSession).(*requestSession)
+	if !ok {
+		return false, false
+	}
+
+	rs.mut.Lock()
+	defer rs.mut.Unlock()
+
+	if rs.overseer != overseer || !rs.loaded {
+		return false, false
+	}
+
+	return rs.stored, true
+}
+
+// get returns a copy of the session, loading it from the overseer on
+// first use. If there is no session it returns an empty session along
+// with the errNoSession error.
+func (rs *requestSession) get(w http.ResponseWriter, r *http.Request) (session, error) {
+	rs.mut.Lock()
+	defer rs.mut.Unlock()
+
+	if !rs.loaded {
+		sess, err := loadSession(rs.overseer, w, r)
+		if err != nil && !IsNoSessionError(err) {
+			return session{}, err
+		}
+
+		rs.loaded = true
+		rs.exists = err == nil
+		rs.stored = err == nil
+		rs.sess = sess
+		// Only clones of sess are handed out, so it is never changed
+		rs.base = sess
+	}
+
+	if !rs.exists {
+		return session{}, errors.Wrap(errNoSession{}, "unable to get session")
+	}
+
+	return rs.sess.clone(), nil
+}
+
+// set replaces the session and marks it to be stored. It returns an error
+// if the session can't be stored by the overseer, or if the response header
+// was already written since the session could no longer be stored.
+func (rs *requestSession) set(sess session) error {
+	rs.mut.Lock()
+	defer rs.mut.Unlock()
+
+	if rs.flushed {
+		return errors.New("unable to change the session after the response header was written")
+	}
+
+	if checker, ok := rs.overseer.(valueChecker); ok {
+		ret, err := json.Marshal(sess)
+		if err != nil {
+			return errors.Wrap(err, "unable to marshal session object")
+		}
+		if err = checker.checkValue(rs.r, string(ret)); err != nil {
+			return err
+		}
+	}
+
+	rs.loaded = true
+	rs.exists = true
+	rs.dirty = true
+	rs.sess = sess
+
+	return nil
+}
+
+// isDirty returns true if the session has changes that were not stored yet
+func (rs *requestSession) isDirty() bool {
+	rs.mut.Lock()
+	defer rs.mut.Unlock()
+
+	return rs.dirty
+}
+
+// errorHandler returns the StoreErrorHandler of the bound overseer
+func (rs *requestSession) errorHandler() func(w http.ResponseWriter, r *http.Request, err error) {
+	rs.mut.Lock()
+	defer rs.mut.Unlock()
+
+	return rs.storeErrorHandler
+}
+
+// flush stores the session in the overseer if it was changed. It is called
+// when the response header is written, and set refuses changes from then on
+// so that changes made concurrently are either stored or refused.
+func (rs *requestSession) flush() error {
+	rs.mut.Lock()
+	rs.flushed = true
+	if !rs.dirty {
+		rs.mut.Unlock()
+		return nil
+	}
+	rs.dirty = false
+	sess := rs.sess
+	base := rs.base
+	overseer := rs.overseer
+	// Storing resets the requestSession, so the lock can't be held
+	rs.mut.Unlock()
+
+	updater, ok := overseer.(UpdateOverseer)
+	if !ok {
+		return storeSession(overseer, rs.w, rs.r, sess)
+	}
+
+	return updater.Update(rs.w, rs.r, func(value string) (string, error) {
+		var theirs session
+		if len(value) != 0 {
+			if err := json.Unmarshal([]byte(value), &theirs); err != nil {
+				return "", errors.Wrap(err, "unable to unmarshal session object")
+			}
+		}
+
+		ret, err := json.Marshal(mergeSessions(base, sess, theirs))
+		if err != nil {
+			return "", errors.Wrap(err, "unable to marshal session object")
+		}
+
+		return string(ret), nil
+	})
+}
+
+// clone returns a copy of the session that does not share its maps
+// or its flash queue
+func (s session) clone() session {
+	s.Flash = cloneRawMap(s.Flash)
+	s.Values = cloneRawMap(s.Values)
+	if s.Flashes != nil {
+		s.Flashes = append([]Flash(nil), s.Flashes...)
+	}
+	return s
+}
+
+func cloneRawMap(m map[string]*json.RawMessage) map[string]*json.RawMessage {
+	if m == nil {
+		return nil
+	}
+
+	c := make(map[string]*json.RawMessage, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+
+	return c
+}
@@ -1,7 +1,9 @@
 package abcsessions
 
 import (
+	"context"
 	"encoding/json"
+	"log"
 	"net/http"
 	"time"
 
@@ -16,6 +18,11 @@ type session struct {
 	// you're calling Get/SetFlash or Get/SetFlashObj it will either store
 	// a json string or a json object.
 	Flash map[string]*json.RawMessage
+	// values is the key/value storage for the typed Value[T] API, each value
+	// is stored as json.
+	Values map[string]*json.RawMessage `json:",omitempty"`
+	// flashes is the queue of leveled flash messages, see AddFlashMessage
+	Flashes []Flash `json:",omitempty"`
 }
 
 // Storer provides methods to retrieve, add and delete sessions.
@@ -28,6 +35,106 @@ type Storer interface {
 	ResetExpiry(key string) error
 }
 
+// ContextStorer is the context-aware variant of Storer. Implementations
+// should abandon the operation and return ctx.Err() once the context is
+// done, so that slow backends can be cancelled along with the request.
+//
+// All of the storers in this package implement both Storer and ContextStorer,
+// use NewContextStorer and NewBackgroundStorer to adapt between the two.
+type ContextStorer interface {
+	// AllContext returns all keys in the store
+	AllContext(ctx context.Context) (keys []string, err error)
+	GetContext(ctx context.Context, key string) (value string, err error)
+	SetContext(ctx context.Context, key, value string) error
+	DelContext(ctx context.Context, key string) error
+	ResetExpiryContext(ctx context.Context, key string) error
+}
+
+// OwnerStorer is implemented by storers that keep a secondary index of
+// sessions by owner (typically a user ID), so that every session of a user
+// can be found and revoked, for example after a password change.
+//
+// The memory, disk and redis storers implement OwnerStorer.
+type OwnerStorer interface {
+	// SetOwner attaches the session to owner, replacing its previous
+	// owner if it had one. It returns an errNoSession error if the
+	// session does not exist.
+	SetOwner(key, owner string) error
+	// Owner returns the owner of the session, or an empty string if
+	// the session has no owner.
+	Owner(key string) (owner string, err error)
+	// OwnerSessions returns the keys of all sessions of owner
+	OwnerSessions(owner string) (keys []string, err error)
+	// DelOwner deletes all sessions of owner in a single operation,
+	// so that no session can be added or kept alive halfway through.
+	DelOwner(owner string) error
+}
+
+// TTLStorer is implemented by storers that can tell how long a session has
+// left before it expires. Overseers with a ResetThreshold use it to skip
+// resetting the expiry of sessions that were reset recently.
+//
+// The memory, disk, redis and sql storers implement TTLStorer.
+type TTLStorer interface {
+	// TTL returns the time left before the session expires, and the max age
+	// the session is given back when its expiry is reset. A zero max age
+	// means sessions never expire. It returns an errNoSession error if the
+	// session does not exist.
+	TTL(ctx context.Context, key string) (ttl, maxAge time.Duration, err error)
+}
+
+// storerWrapper is implemented by storers that wrap another storer, like
+// the EncryptedStorer. They implement the optional storer interfaces but
+// only support them if the storer they wrap does.
+type storerWrapper interface {
+	Unwrap() Storer
+}
+
+// asStorer returns storer as the optional storer interface T, if storer
+// implements it and so does every storer it wraps
+func asStorer[T any](storer Storer) (T, bool) {
+	ret, ok := storer.(T)
+	if !ok {
+		return ret, false
+	}
+
+	for {
+		wrapper, ok := storer.(storerWrapper)
+		if !ok {
+			return ret, true
+		}
+
+		storer = wrapper.Unwrap()
+		if _, ok = storer.(T); !ok {
+			var zero T
+			return zero, false
+		}
+	}
+}
+
+// OwnerOverseer is implemented by overseers that can index sessions
+// by owner. The StorageOverseer implements it if its Storer implements
+// OwnerStorer.
+type OwnerOverseer interface {
+	// SetOwner attaches the current session to owner
+	SetOwner(w http.ResponseWriter, r *http.Request, owner string) error
+	// OwnerSessions returns the IDs of all sessions of owner
+	OwnerSessions(owner string) (ids []string, err error)
+	// DelOwner deletes all sessions of owner
+	DelOwner(owner string) error
+}
+
+// UpdateOverseer is implemented by overseers that can change a session
+// without losing the changes concurrent requests make to it. The
+// StorageOverseer implements it, and retries on conflicts if its Storer
+// implements VersionedStorer.
+type UpdateOverseer interface {
+	// Update calls fn with the value of the session, or an empty string if
+	// there is none, and stores the value it returns. fn is called again
+	// with the new value if the session was changed in the meantime.
+	Update(w http.ResponseWriter, r *http.Request, fn func(value string) (string, error)) error
+}
+
 // Overseer of session cookies
 type Overseer interface {
 	Resetter
@@ -43,6 +150,24 @@ type Overseer interface {
 	SessionID(w http.ResponseWriter, r *http.Request) (id string, err error)
 }
 
+// ContextOverseer is the context-aware variant of Overseer. The plain
+// Overseer methods of a ContextOverseer use the request's context.
+//
+// Use NewContextOverseer to adapt an Overseer that is not context-aware.
+type ContextOverseer interface {
+	Overseer
+	// GetContext gets the value stored in a session
+	GetContext(ctx context.Context, w http.ResponseWriter, r *http.Request) (value string, err error)
+	// SetContext creates or updates a session with value
+	SetContext(ctx context.Context, w http.ResponseWriter, r *http.Request, value string) error
+	// DelContext deletes a session
+	DelContext(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	// RegenerateContext regenerates a new session id for your session
+	RegenerateContext(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	// ResetExpiryContext resets the age of the session to time.Now()
+	ResetExpiryContext(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+}
+
 // Resetter has reset functions
 type Resetter interface {
 	// ResetExpiry resets the age of the session to time.Now(), so that
@@ -111,66 +236,66 @@ var timerTestHarness = func(d time.Duration) (timer, <-chan time.Time) {
 	return t, t.C
 }
 
-// validKey returns true if the session key is a valid UUIDv4 format:
-// 8chars-4chars-4chars-4chars-12chars (chars are a-f 0-9)
-// Example: a668b3bb-0cf1-4627-8cd4-7f62d09ebad6
-func validKey(key string) bool {
-	// UUIDv4's are 36 chars (16 bytes not including dashes)
-	if len(key) != 36 {
-		return false
-	}
-
-	// 0 indexed dash positions
-	dashPos := []int{8, 13, 18, 23}
-	for i := 0; i < len(key); i++ {
-		atDashPos := false
-		for _, pos := range dashPos {
-			if i == pos {
-				atDashPos = true
-				break
-			}
-		}
+// getSession returns the unmarshalled session. If there is no session
+// it returns an empty session along with the errNoSession error.
+//
+// If the request went through the sessions Middleware the session is only
+// loaded from the overseer once per request, see requestSession.
+func getSession(overseer Overseer, w http.ResponseWriter, r *http.Request) (session, error) {
+	if rs := getRequestSession(r, overseer); rs != nil {
+		return rs.get(w, r)
+	}
 
-		if atDashPos == true {
-			if key[i] != '-' {
-				return false
-			}
-			// continue the loop if dash is found
-			continue
-		}
+	return loadSession(overseer, w, r)
+}
 
-		// if not a dash, make sure char is a-f or 0-9
-		// 48 == '0', 57 == '9', 97 == 'a', 102 == 'f'
-		if key[i] < 48 || (key[i] > 57 && key[i] < 97) || key[i] > 102 {
-			return false
-		}
+// setSession marshals the session and stores it. If the request went
+// through the sessions Middleware the session is only marked as changed
+// and is stored once when the response header is written, see requestSession.
+func setSession(overseer Overseer, w http.ResponseWriter, r *http.Request, sess session) error {
+	if rs := getRequestSession(r, overseer); rs != nil {
+		return rs.set(sess)
 	}
 
-	return true
+	return storeSession(overseer, w, r, sess)
 }
 
-// Set is a JSON helper used for storing key-value session values.
-// Set modifies the marshalled map stored in the session to include the key value pair passed in.
-func Set(overseer Overseer, w http.ResponseWriter, r *http.Request, key string, value string) error {
+// loadSession gets and unmarshals the session from the overseer
+func loadSession(overseer Overseer, w http.ResponseWriter, r *http.Request) (session, error) {
 	var sess session
-	sessMap := make(map[string]string)
 
 	val, err := overseer.Get(w, r)
+	if err != nil {
+		return sess, errors.Wrap(err, "unable to get session")
+	}
+
+	err = json.Unmarshal([]byte(val), &sess)
+	return sess, errors.Wrap(err, "unable to unmarshal session object")
+}
+
+// storeSession marshals the session and sets it on the overseer
+func storeSession(overseer Overseer, w http.ResponseWriter, r *http.Request, sess session) error {
+	ret, err := json.Marshal(sess)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal session object")
+	}
+
+	return overseer.Set(w, r, string(ret))
+}
+
+// Set is a JSON helper used for storing key-value session values.
+// Set modifies the marshalled map stored in the session to include the key value pair passed in.
+func Set(overseer Overseer, w http.ResponseWriter, r *http.Request, key string, value string) error {
+	sess, err := getSession(overseer, w, r)
 	if err != nil && !IsNoSessionError(err) {
-		return errors.Wrap(err, "unable to get session")
+		return err
 	}
 
-	if !IsNoSessionError(err) {
-		err = json.Unmarshal([]byte(val), &sess)
+	sessMap := make(map[string]string)
+	if sess.Value != nil {
+		err = json.Unmarshal(*sess.Value, &sessMap)
 		if err != nil {
-			return errors.Wrap(err, "unable to unmarshal session object")
-		}
-
-		if sess.Value != nil {
-			err = json.Unmarshal(*sess.Value, &sessMap)
-			if err != nil {
-				return errors.Wrap(err, "unable to unmarshal session map value")
-			}
+			return errors.Wrap(err, "unable to unmarshal session map value")
 		}
 	}
 
@@ -182,26 +307,20 @@ func Set(overseer Overseer, w http.ResponseWriter, r *http.Request, key string,
 	}
 	sess.Value = (*json.RawMessage)(&mv)
 
-	ret, err := json.Marshal(sess)
-	if err != nil {
-		return errors.Wrap(err, "unable to marshal session object")
-	}
-
-	return overseer.Set(w, r, string(ret))
+	return setSession(overseer, w, r, sess)
 }
 
 // Get is a JSON helper used for retrieving key-value session values.
 // Get returns the value pointed to by the key of the marshalled map stored in the session.
 func Get(overseer Overseer, w http.ResponseWriter, r *http.Request, key string) (string, error) {
-	val, err := overseer.Get(w, r)
+	sess, err := getSession(overseer, w, r)
 	if err != nil {
-		return "", errors.Wrap(err, "unable to get session")
+		return "", err
 	}
 
-	var sess session
-	err = json.Unmarshal([]byte(val), &sess)
-	if err != nil {
-		return "", errors.Wrap(err, "unable to unmarshal session object")
+	// The session may only hold flash messages or typed values
+	if sess.Value == nil {
+		return "", errNoMapKey{}
 	}
 
 	var sessMap map[string]string
@@ -221,15 +340,14 @@ func Get(overseer Overseer, w http.ResponseWriter, r *http.Request, key string)
 // Del is a JSON helper used for deleting keys from a key-value session values store.
 // Del is a noop on nonexistent keys, but will error if the session does not exist.
 func Del(overseer Overseer, w http.ResponseWriter, r *http.Request, key string) error {
-	val, err := overseer.Get(w, r)
+	sess, err := getSession(overseer, w, r)
 	if err != nil {
-		return errors.Wrap(err, "unable to get session")
+		return err
 	}
 
-	var sess session
-	err = json.Unmarshal([]byte(val), &sess)
-	if err != nil {
-		return errors.Wrap(err, "unable to unmarshal session object")
+	// Nothing to delete if the session only holds flash messages or typed values
+	if sess.Value == nil {
+		return nil
 	}
 
 	var sessMap map[string]string
@@ -246,35 +364,18 @@ func Del(overseer Overseer, w http.ResponseWriter, r *http.Request, key string)
 	}
 	sess.Value = (*json.RawMessage)(&mv)
 
-	ret, err := json.Marshal(sess)
-	if err != nil {
-		return errors.Wrap(err, "unable to marshal session object")
-	}
-
-	return overseer.Set(w, r, string(ret))
+	return setSession(overseer, w, r, sess)
 }
 
 // SetObj is a JSON helper used for storing object or variable session values.
 // Set stores in the session a marshaled version of the passed in value pointed to by value.
 func SetObj(overseer Overseer, w http.ResponseWriter, r *http.Request, value interface{}) error {
-	val, err := overseer.Get(w, r)
 	// If it's a no session error because a session hasn't been created yet
-	// then we can skip this return statement and create a fresh map
+	// then we can skip this return statement and create a fresh session,
+	// otherwise the flash messages of the existing session are kept
+	sess, err := getSession(overseer, w, r)
 	if err != nil && !IsNoSessionError(err) {
-		return errors.Wrap(err, "unable to get session")
-	}
-
-	var sess session
-
-	// If there's an existing session then unmarshal it so we can copy over
-	// the flash messages to the new marshalled session
-	if !IsNoSessionError(err) {
-		// json unmarshal the outter session struct
-		err = json.Unmarshal([]byte(val), &sess)
-		if err != nil {
-			return errors.Wrap(err, "unable to unmarshal session object")
-		}
-
+		return err
 	}
 
 	mv, err := json.Marshal(value)
@@ -283,27 +384,20 @@ func SetObj(overseer Overseer, w http.ResponseWriter, r *http.Request, value int
 	}
 	sess.Value = (*json.RawMessage)(&mv)
 
-	ret, err := json.Marshal(sess)
-	if err != nil {
-		return errors.Wrap(err, "unable to marshal session object")
-	}
-
-	return overseer.Set(w, r, string(ret))
+	return setSession(overseer, w, r, sess)
 }
 
 // GetObj is a JSON helper used for retrieving object or variable session values.
 // GetObj unmarshals the session value into the pointer pointed to by pointer.
 func GetObj(overseer Overseer, w http.ResponseWriter, r *http.Request, pointer interface{}) error {
-	val, err := overseer.Get(w, r)
+	sess, err := getSession(overseer, w, r)
 	if err != nil {
-		return errors.Wrap(err, "unable to get session")
+		return err
 	}
 
-	var sess session
-	// json unmarshal the outter session struct
-	err = json.Unmarshal([]byte(val), &sess)
-	if err != nil {
-		return errors.Wrap(err, "unable to unmarshal session object")
+	// The session may only hold flash messages or typed values
+	if sess.Value == nil {
+		return errNoMapKey{}
 	}
 
 	// json unmarshal the RawMessage value into the users pointer
@@ -313,16 +407,9 @@ func GetObj(overseer Overseer, w http.ResponseWriter, r *http.Request, pointer i
 
 // AddFlash adds a flash message to the session that will be deleted when it is retrieved with GetFlash
 func AddFlash(overseer Overseer, w http.ResponseWriter, r *http.Request, key string, value string) error {
-	var sess session
-
-	val, err := overseer.Get(w, r)
+	sess, err := getSession(overseer, w, r)
 	if err != nil && !IsNoSessionError(err) {
-		return errors.Wrap(err, "unable to get session")
-	} else if !IsNoSessionError(err) {
-		err = json.Unmarshal([]byte(val), &sess)
-		if err != nil {
-			return errors.Wrap(err, "unable to unmarshal session object")
-		}
+		return err
 	}
 
 	if sess.Flash == nil {
@@ -335,26 +422,14 @@ func AddFlash(overseer Overseer, w http.ResponseWriter, r *http.Request, key str
 	}
 	sess.Flash[key] = (*json.RawMessage)(&mv)
 
-	ret, err := json.Marshal(sess)
-	if err != nil {
-		return errors.Wrap(err, "unable to marshal session object")
-	}
-
-	return overseer.Set(w, r, string(ret))
+	return setSession(overseer, w, r, sess)
 }
 
 // GetFlash retrieves a flash message from the session then deletes it
 func GetFlash(overseer Overseer, w http.ResponseWriter, r *http.Request, key string) (string, error) {
-	var sess session
-
-	val, err := overseer.Get(w, r)
+	sess, err := getSession(overseer, w, r)
 	if err != nil {
-		return "", errors.Wrap(err, "unable to get session")
-	}
-
-	err = json.Unmarshal([]byte(val), &sess)
-	if err != nil {
-		return "", errors.Wrap(err, "unable to unmarshal session object")
+		return "", err
 	}
 
 	fv, ok := sess.Flash[key]
@@ -370,12 +445,7 @@ func GetFlash(overseer Overseer, w http.ResponseWriter, r *http.Request, key str
 
 	delete(sess.Flash, key)
 
-	mv, err := json.Marshal(sess)
-	if err != nil {
-		return ret, errors.Wrap(err, "unable to marshal session object")
-	}
-
-	err = overseer.Set(w, r, string(mv))
+	err = setSession(overseer, w, r, sess)
 	return ret, errors.Wrap(err, "unable to set flash session object")
 }
 
@@ -399,3 +469,24 @@ func GetFlashObj(overseer Overseer, w http.ResponseWriter, r *http.Request, key
 
 	return json.Unmarshal([]byte(val), pointer)
 }
+
+// remainingTTL returns the time left until expires, or zero if it passed
+func remainingTTL(expires time.Time) time.Duration {
+	ttl := time.Until(expires)
+	if ttl < 0 {
+		return 0
+	}
+
+	return ttl
+}
+
+// logCleanError writes an error of a storer cleaner to logger, or to the
+// standard logger of the log package if it is nil
+func logCleanError(logger *log.Logger, err error) {
+	if logger == nil {
+		log.Printf("abcsessions: %v", err)
+		return
+	}
+
+	logger.Printf("abcsessions: %v", err)
+}
@@ -1,9 +1,15 @@
 package abcsessions
 
 import (
+	"bytes"
+	"html/template"
+	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"sort"
 	"testing"
+
+	uuid "github.com/satori/go.uuid"
 )
 
 func TestSetAndGet(t *testing.T) {
@@ -442,35 +448,170 @@ func TestAddFlashAndSetCombined(t *testing.T) {
 	}
 }
 
-func TestValidKey(t *testing.T) {
+// testOwnerStorer runs the OwnerStorer tests against s
+func testOwnerStorer(t *testing.T, s interface {
+	Storer
+	OwnerStorer
+}) {
+	t.Helper()
+
+	id1, id2, id3 := uuid.NewV4().String(), uuid.NewV4().String(), uuid.NewV4().String()
+	alice, bob := "alice-"+id1, "bob-"+id1
+
+	if err := s.SetOwner(id1, alice); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+
+	for _, id := range []string{id1, id2, id3} {
+		if err := s.Set(id, "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.SetOwner(id1, alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetOwner(id2, alice); err != nil {
+		t.Fatal(err)
+	}
+	// id3 changes owner
+	if err := s.SetOwner(id3, alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetOwner(id3, bob); err != nil {
+		t.Fatal(err)
+	}
+
+	if owner, err := s.Owner(id3); err != nil || owner != bob {
+		t.Errorf("expected owner %q, got %q: %v", bob, owner, err)
+	}
+
+	ids, err := s.OwnerSessions(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	want := []string{id1, id2}
+	sort.Strings(want)
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("expected %v, got %v", want, ids)
+	}
+
+	// Deleted sessions leave the index
+	if err = s.Del(id2); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ = s.OwnerSessions(alice); len(ids) != 1 || ids[0] != id1 {
+		t.Errorf("expected [%s], got %v", id1, ids)
+	}
+
+	if err = s.DelOwner(alice); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get(id1); err == nil {
+		t.Error("expected the owner's sessions to be deleted")
+	}
+	if ids, _ = s.OwnerSessions(alice); len(ids) != 0 {
+		t.Errorf("expected no sessions, got %v", ids)
+	}
+	if owner, _ := s.Owner(id1); owner != "" {
+		t.Errorf("expected no owner, got %q", owner)
+	}
+
+	// Other owners are untouched
+	if _, err = s.Get(id3); err != nil {
+		t.Error(err)
+	}
+	if ids, _ = s.OwnerSessions(bob); len(ids) != 1 || ids[0] != id3 {
+		t.Errorf("expected [%s], got %v", id3, ids)
+	}
+}
+
+func TestFlashMessages(t *testing.T) {
 	t.Parallel()
 
-	// Example:
-	keys := map[string]bool{
-		"a668b3bb-0cf1-4627-8cd4-7f62d09ebad6": true,
-		"a668b3bf-0cf9-a629-fcd0-7aaaaaaaaaaa": true,
-		// too short
-		"668b3bf-0cf9-a629-fcd0-7aaaaaaaaaaa": false,
-		// too long
-		"668b3bf-0cf9-a629-fcd0-7aaaaaaaaaaaaa": false,
-		// invalid chars and positions
-		"/668b3bf-0cf9-a629-fcd0-7aaaaaaaaaaa": false,
-		"a668b3bf-0cf9-a6:9-fcd0-7aaaaaaaaaaa": false,
-		"a668b3bf-0cf9-a6z9-fcd0-7a`aaaaaaaaa": false,
-		"a668b3bf-0cf9-a6z9-fcd0-7aaaaaaaaaag": false,
-		"a668b3bfa0cf9aa6z9afcd0a7aaaaaaaaaaa": false,
-		"a668b3b-f0cf9-a6z9-fcd0-7aaaaaaaaaaa": false,
-		"a668b3bf-0cf-9a6z9-fcd0-7aaaaaaaaaaa": false,
-		"a668b3bf-0cf9-a6z-9fcd0-7aaaaaaaaaaa": false,
-		"a668b3bf-0cf9-a6z9-fcd-07aaaaaaaaaaa": false,
-		"a668b3b-f0cf-fa6z-ffcf-07aaaaaaaaaaa": false,
-	}
-
-	for key, valid := range keys {
-		v := validKey(key)
-
-		if valid != v {
-			t.Errorf("key %s, expected validity to be: %t, got %t", key, valid, v)
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), m)
+
+	// No session means no messages
+	flashes, err := Flashes(s, w, r)
+	if err != nil || len(flashes) != 0 {
+		t.Errorf("expected no flashes, got %v: %v", flashes, err)
+	}
+
+	AddFlashMessage(s, w, r, FlashError, "first error")
+	AddFlashMessage(s, w, r, FlashSuccess, "saved")
+	AddFlashMessage(s, w, r, FlashError, "second error")
+	AddFlashMessage(s, w, r, FlashInfo, "fyi")
+
+	errs, err := LevelFlashes(s, w, r, FlashError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(errs, []string{"first error", "second error"}) {
+		t.Errorf("expected both errors in order, got %v", errs)
+	}
+	if errs, _ = LevelFlashes(s, w, r, FlashError); len(errs) != 0 {
+		t.Errorf("expected the error queue to be drained, got %v", errs)
+	}
+
+	flashes, err = Flashes(s, w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Flash{{Level: FlashSuccess, Message: "saved"}, {Level: FlashInfo, Message: "fyi"}}
+	if !reflect.DeepEqual(flashes, want) {
+		t.Errorf("expected %v, got %v", want, flashes)
+	}
+	if flashes, _ = Flashes(s, w, r); len(flashes) != 0 {
+		t.Errorf("expected the queue to be drained, got %v", flashes)
+	}
+}
+
+func TestFlashHelpers(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	o := NewStorageOverseer(NewCookieOptions(), m)
+	tpl := template.Must(template.New("flashes").Funcs(FlashHelpers()).Parse(
+		`{{range flashes .}}{{.Level}}: {{.Message}}; {{end}}`,
+	))
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := FromContext(r.Context())
+		if err := sess.AddFlashMessage(FlashError, "<b>bad</b>"); err != nil {
+			t.Error(err)
+		}
+		if err := sess.AddFlashMessage(FlashSuccess, "saved"); err != nil {
+			t.Error(err)
 		}
+
+		buf := &bytes.Buffer{}
+		if err := tpl.Execute(buf, r); err != nil {
+			t.Fatal(err)
+		}
+		if want := "error: &lt;b&gt;bad&lt;/b&gt;; success: saved; "; buf.String() != want {
+			t.Errorf("expected %q, got %q", want, buf.String())
+		}
+
+		// The helper drained the messages
+		buf.Reset()
+		if err := tpl.Execute(buf, r); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("expected no output without flashes, got: %s", buf.String())
+		}
+	}
+
+	o.Middleware(http.HandlerFunc(fn)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	// Pages rendered without the sessions middleware have no flashes
+	buf := &bytes.Buffer{}
+	if err := tpl.Execute(buf, httptest.NewRequest("GET", "/", nil)); err != nil || buf.Len() != 0 {
+		t.Errorf("expected no output without the sessions middleware, got %q: %v", buf.String(), err)
 	}
 }
@@ -0,0 +1,463 @@
+package abcsessions
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/friendsofgo/errors"
+)
+
+// SQLPlaceholder is the bind parameter style used by a database/sql driver.
+type SQLPlaceholder int
+
+// Bind parameter styles supported by the SQLStorer
+const (
+	// SQLPlaceholderQuestion uses ? for every parameter (SQLite, MySQL)
+	SQLPlaceholderQuestion SQLPlaceholder = iota
+	// SQLPlaceholderDollar uses $1, $2, ... for parameters (Postgres)
+	SQLPlaceholderDollar
+)
+
+// SQLStorer is a session storer implementation for saving sessions
+// to a SQL database through database/sql. It works with any driver, the
+// only requirement is a table with the following schema
+// (adjust the types for your database):
+//
+//	CREATE TABLE sessions (
+//		id      VARCHAR(255) NOT NULL PRIMARY KEY,
+//		value   TEXT         NOT NULL,
+//		expires BIGINT       NOT NULL
+//	);
+//	CREATE INDEX sessions_expires_idx ON sessions (expires);
+//
+// expires holds the unix time (in seconds) the session expires at, or 0
+// if the session never expires.
+//
+// Rows are never assumed to be missing because an UPDATE changed none of
+// them, since MySQL only counts the rows whose values actually changed.
+type SQLStorer struct {
+	db          *sql.DB
+	placeholder SQLPlaceholder
+	// table is the name of the sessions table
+	table string
+	// How long sessions take to expire in the database
+	maxAge time.Duration
+	// How often the table should be polled for maxAge expired sessions
+	cleanInterval time.Duration
+	// wg is used to manage the cleaner loop
+	wg sync.WaitGroup
+	// quit channel for exiting the cleaner loop
+	quit chan struct{}
+
+	// ErrorLog is the logger for the errors of Clean, which are retried on
+	// the next clean interval. The standard logger of the log package is
+	// used when nil.
+	ErrorLog *log.Logger
+}
+
+// NewDefaultSQLStorer returns a SQLStorer object with default values.
+// The default values are:
+// table: sessions
+// maxAge: 2 days (clear session stored in the database after 2 days)
+// cleanInterval: 1 hour (delete sessions older than maxAge every 1 hour)
+func NewDefaultSQLStorer(db *sql.DB, placeholder SQLPlaceholder) (*SQLStorer, error) {
+	return NewSQLStorer(db, placeholder, "sessions", time.Hour*24*2, time.Hour)
+}
+
+// NewSQLStorer initializes and returns a new SQLStorer object.
+// It takes the database handle, the bind parameter style of its driver, the
+// name of the sessions table, the maxAge of how long each session should live
+// in the database, and a cleanInterval duration which defines how often the
+// clean task should check for maxAge expired sessions to be removed from
+// the table. Persistent storage can be attained by setting maxAge and
+// cleanInterval to zero.
+func NewSQLStorer(db *sql.DB, placeholder SQLPlaceholder, table string, maxAge, cleanInterval time.Duration) (*SQLStorer, error) {
+	if (maxAge != 0 && cleanInterval == 0) || (cleanInterval != 0 && maxAge == 0) {
+		panic("if max age or clean interval is set, the other must also be set")
+	}
+
+	if db == nil {
+		return nil, errors.New("db handle must be provided")
+	}
+	if len(table) == 0 {
+		return nil, errors.New("table name must be provided")
+	}
+
+	s := &SQLStorer{
+		db:            db,
+		placeholder:   placeholder,
+		table:         table,
+		maxAge:        maxAge,
+		cleanInterval: cleanInterval,
+	}
+
+	return s, nil
+}
+
+// All keys in the sql store that have not expired
+func (s *SQLStorer) All() ([]string, error) {
+	return s.AllContext(context.Background())
+}
+
+// AllContext is All with a context for the query
+func (s *SQLStorer) AllContext(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx,
+		s.query("SELECT id FROM %s WHERE expires = 0 OR expires > ?"),
+		time.Now().UTC().Unix(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query sessions")
+	}
+	defer rows.Close()
+
+	var sessions []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, errors.Wrap(err, "unable to scan session id")
+		}
+		sessions = append(sessions, id)
+	}
+
+	return sessions, errors.Wrap(rows.Err(), "unable to iterate sessions")
+}
+
+// Get returns the value string saved in the session pointed to by the
+// session id key. Sessions that have expired but have not been cleaned
+// yet are treated as if they do not exist.
+func (s *SQLStorer) Get(key string) (value string, err error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext is Get with a context for the query
+func (s *SQLStorer) GetContext(ctx context.Context, key string) (value string, err error) {
+	err = s.db.QueryRowContext(ctx,
+		s.query("SELECT value FROM %s WHERE id = ? AND (expires = 0 OR expires > ?)"),
+		key, time.Now().UTC().Unix(),
+	).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", errNoSession{}
+	} else if err != nil {
+		return "", errors.Wrap(err, "unable to get session")
+	}
+
+	return value, nil
+}
+
+// Set saves the value string to the session pointed to by the session id key.
+func (s *SQLStorer) Set(key, value string) error {
+	return s.SetContext(context.Background(), key, value)
+}
+
+// SetContext is Set with a context for the queries
+func (s *SQLStorer) SetContext(ctx context.Context, key, value string) error {
+	expires := s.expires()
+
+	// An upsert is not portable across databases, so update first and
+	// fall back to an insert when the session does not exist yet.
+	updated, err := s.update(ctx, key, value, expires)
+	if err != nil {
+		return err
+	}
+	if updated {
+		return nil
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		s.query("INSERT INTO %s (id, value, expires) VALUES (?, ?, ?)"),
+		key, value, expires,
+	)
+	if err == nil {
+		return nil
+	}
+
+	// A concurrent Set may have inserted the row in between our update
+	// and insert, in which case the primary key constraint fails and
+	// updating again will succeed.
+	updated, uerr := s.update(ctx, key, value, expires)
+	if uerr != nil || !updated {
+		return errors.Wrap(err, "unable to insert session")
+	}
+
+	return nil
+}
+
+// Del the session pointed to by the session id key and remove it.
+func (s *SQLStorer) Del(key string) error {
+	return s.DelContext(context.Background(), key)
+}
+
+// DelContext is Del with a context for the query
+func (s *SQLStorer) DelContext(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, s.query("DELETE FROM %s WHERE id = ?"), key)
+	return errors.Wrap(err, "unable to delete session")
+}
+
+// ResetExpiry resets the expiry of the key
+func (s *SQLStorer) ResetExpiry(key string) error {
+	return s.ResetExpiryContext(context.Background(), key)
+}
+
+// ResetExpiryContext is ResetExpiry with a context for the query
+func (s *SQLStorer) ResetExpiryContext(ctx context.Context, key string) error {
+	res, err := s.db.ExecContext(ctx,
+		s.query("UPDATE %s SET expires = ? WHERE id = ? AND (expires = 0 OR expires > ?)"),
+		s.expires(), key, time.Now().UTC().Unix(),
+	)
+	if err != nil {
+		return errors.Wrap(err, "unable to reset session expiry")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "unable to get affected rows")
+	}
+	if n != 0 {
+		return nil
+	}
+
+	// MySQL does not count the row if its expiry was already the same
+	exists, err := s.exists(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errNoSession{}
+	}
+
+	return nil
+}
+
+// TTL returns the time left before the session pointed to by the session
+// id key expires, see TTLStorer
+func (s *SQLStorer) TTL(ctx context.Context, key string) (time.Duration, time.Duration, error) {
+	var expires int64
+	err := s.db.QueryRowContext(ctx,
+		s.query("SELECT expires FROM %s WHERE id = ? AND (expires = 0 OR expires > ?)"),
+		key, time.Now().UTC().Unix(),
+	).Scan(&expires)
+	if err == sql.ErrNoRows {
+		return 0, 0, errNoSession{}
+	} else if err != nil {
+		return 0, 0, errors.Wrap(err, "unable to get session expiry")
+	}
+
+	if s.maxAge == 0 || expires == 0 {
+		return 0, 0, nil
+	}
+
+	return remainingTTL(time.Unix(expires, 0)), s.maxAge, nil
+}
+
+// Clean deletes all sessions in the table that have expired. Errors are
+// written to the ErrorLog, so that the cleaner tries again on its next
+// interval instead of taking down the app.
+func (s *SQLStorer) Clean() {
+	_, err := s.db.Exec(
+		s.query("DELETE FROM %s WHERE expires <> 0 AND expires <= ?"),
+		time.Now().UTC().Unix(),
+	)
+	if err != nil {
+		logCleanError(s.ErrorLog, errors.Wrap(err, "unable to delete expired sessions"))
+	}
+}
+
+// StartCleaner starts the sql session cleaner go routine. This go routine
+// will delete expired sessions from the table on the cleanInterval interval.
+func (s *SQLStorer) StartCleaner() {
+	if s.maxAge == 0 || s.cleanInterval == 0 {
+		panic("both max age and clean interval must be set to non-zero")
+	}
+
+	// init quit chan
+	s.quit = make(chan struct{})
+
+	s.wg.Add(1)
+
+	// Start the cleaner infinite loop go routine.
+	// StopCleaner() can be used to kill this go routine.
+	go s.cleanerLoop()
+}
+
+// StopCleaner stops the cleaner go routine
+func (s *SQLStorer) StopCleaner() {
+	close(s.quit)
+	s.wg.Wait()
+}
+
+// cleanerLoop executes the Clean() method every time cleanInterval elapses.
+// StopCleaner() can be used to kill this go routine loop.
+func (s *SQLStorer) cleanerLoop() {
+	defer s.wg.Done()
+
+	t, c := timerTestHarness(s.cleanInterval)
+
+	for {
+		select {
+		case <-c:
+			s.Clean()
+			t.Reset(s.cleanInterval)
+		case <-s.quit:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// GetVersioned returns the value of the session pointed to by the session
+// id key along with its version
+func (s *SQLStorer) GetVersioned(ctx context.Context, key string) (string, string, error) {
+	value, err := s.GetContext(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	return value, valueVersion(value), nil
+}
+
+// CompareAndSet saves the value string to the session pointed to by the
+// session id key if it is still at version, see VersionedStorer. The update
+// only matches the row if it still holds the value that was checked, so no
+// locking or transaction is needed.
+func (s *SQLStorer) CompareAndSet(ctx context.Context, key, value, version string) error {
+	now := time.Now().UTC().Unix()
+
+	if len(version) == 0 {
+		// An expired session that was not cleaned yet does not exist
+		_, err := s.db.ExecContext(ctx,
+			s.query("DELETE FROM %s WHERE id = ? AND expires <> 0 AND expires <= ?"),
+			key, now,
+		)
+		if err != nil {
+			return errors.Wrap(err, "unable to delete expired session")
+		}
+
+		_, err = s.db.ExecContext(ctx,
+			s.query("INSERT INTO %s (id, value, expires) VALUES (?, ?, ?)"),
+			key, value, s.expires(),
+		)
+		if err == nil {
+			return nil
+		}
+
+		// The primary key constraint fails if the session was created since
+		if _, gerr := s.GetContext(ctx, key); gerr == nil {
+			return errVersionConflict{}
+		}
+		return errors.Wrap(err, "unable to insert session")
+	}
+
+	current, err := s.GetContext(ctx, key)
+	if IsNoSessionError(err) {
+		return errVersionConflict{}
+	} else if err != nil {
+		return err
+	}
+	if valueVersion(current) != version {
+		return errVersionConflict{}
+	}
+
+	res, err := s.db.ExecContext(ctx,
+		s.query("UPDATE %s SET value = ?, expires = ? WHERE id = ? AND value = ? AND (expires = 0 OR expires > ?)"),
+		value, s.expires(), key, current, now,
+	)
+	if err != nil {
+		return errors.Wrap(err, "unable to update session")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "unable to get affected rows")
+	}
+	if n != 0 {
+		return nil
+	}
+
+	// MySQL does not count the row if the value and expiry were already
+	// the ones being set, which only conflicts if the row is gone
+	if current, err = s.GetContext(ctx, key); err == nil && current == value {
+		return nil
+	}
+
+	return errVersionConflict{}
+}
+
+// update sets the value and expiry of an existing session and reports
+// whether the session existed.
+func (s *SQLStorer) update(ctx context.Context, key, value string, expires int64) (bool, error) {
+	res, err := s.db.ExecContext(ctx,
+		s.query("UPDATE %s SET value = ?, expires = ? WHERE id = ?"),
+		value, expires, key,
+	)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to update session")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "unable to get affected rows")
+	}
+	if n != 0 {
+		return true, nil
+	}
+
+	// MySQL does not count the row if the value and expiry were already
+	// the ones being set
+	return s.exists(ctx, key)
+}
+
+// exists reports whether the session pointed to by the session id key
+// exists and has not expired
+func (s *SQLStorer) exists(ctx context.Context, key string) (bool, error) {
+	var one int
+	err := s.db.QueryRowContext(ctx,
+		s.query("SELECT 1 FROM %s WHERE id = ? AND (expires = 0 OR expires > ?)"),
+		key, time.Now().UTC().Unix(),
+	).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "unable to check session")
+	}
+
+	return true, nil
+}
+
+// expires returns the unix time a session written now expires at,
+// or 0 if sessions never expire.
+func (s *SQLStorer) expires() int64 {
+	if s.maxAge == 0 {
+		return 0
+	}
+
+	return time.Now().UTC().Add(s.maxAge).Unix()
+}
+
+// query inserts the table name into q and rewrites its ? bind parameters
+// into the placeholder style of the driver.
+func (s *SQLStorer) query(q string) string {
+	q = fmt.Sprintf(q, s.table)
+	if s.placeholder != SQLPlaceholderDollar {
+		return q
+	}
+
+	buf := strings.Builder{}
+	n := 0
+	for i := 0; i < len(q); i++ {
+		if q[i] != '?' {
+			buf.WriteByte(q[i])
+			continue
+		}
+		n++
+		buf.WriteByte('$')
+		buf.WriteString(strconv.Itoa(n))
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,340 @@
+package abcsessions
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const testSQLSchema = `CREATE TABLE sessions (
+	id      VARCHAR(255) NOT NULL PRIMARY KEY,
+	value   TEXT         NOT NULL,
+	expires BIGINT       NOT NULL
+)`
+
+// newTestSQLStorer returns a SQLStorer backed by a fresh in-memory
+// sqlite database
+func newTestSQLStorer(t *testing.T, maxAge, cleanInterval time.Duration) *SQLStorer {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a different database
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.Exec(testSQLSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSQLStorer(db, SQLPlaceholderQuestion, "sessions", maxAge, cleanInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestSQLStorerNew(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewSQLStorer(nil, SQLPlaceholderQuestion, "sessions", 0, 0)
+	if err == nil {
+		t.Error("expected error on nil db")
+	}
+
+	s := newTestSQLStorer(t, time.Hour*11, time.Hour*12)
+	if s.maxAge != time.Hour*11 {
+		t.Errorf("expected max age to be %d", time.Hour*11)
+	}
+	if s.table != "sessions" {
+		t.Errorf("expected table to be %q, got %q", "sessions", s.table)
+	}
+}
+
+func TestSQLStorerQuery(t *testing.T) {
+	t.Parallel()
+
+	s := &SQLStorer{table: "sess", placeholder: SQLPlaceholderQuestion}
+	if q := s.query("SELECT id FROM %s WHERE id = ? AND expires > ?"); q != "SELECT id FROM sess WHERE id = ? AND expires > ?" {
+		t.Errorf("wrong query: %s", q)
+	}
+
+	s.placeholder = SQLPlaceholderDollar
+	if q := s.query("SELECT id FROM %s WHERE id = ? AND expires > ?"); q != "SELECT id FROM sess WHERE id = $1 AND expires > $2" {
+		t.Errorf("wrong query: %s", q)
+	}
+}
+
+func TestSQLStorerAll(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSQLStorer(t, 0, 0)
+
+	list, err := s.All()
+	if err != nil {
+		t.Error("expected no error on empty list")
+	}
+	if len(list) > 0 {
+		t.Error("Expected len 0")
+	}
+
+	s.Set("hi", "hello")
+	s.Set("yo", "friend")
+
+	list, err = s.All()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("Expected len 2, got %d", len(list))
+	}
+	if (list[0] != "hi" && list[0] != "yo") || list[0] == list[1] {
+		t.Errorf("Expected list[0] to be %q or %q, got %q", "yo", "hi", list[0])
+	}
+	if (list[1] != "yo" && list[1] != "hi") || list[1] == list[0] {
+		t.Errorf("Expected list[1] to be %q or %q, got %q", "hi", "yo", list[1])
+	}
+}
+
+func TestSQLStorerGet(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSQLStorer(t, time.Hour, time.Hour)
+
+	_, err := s.Get("lol")
+	if !IsNoSessionError(err) {
+		t.Errorf("Expected ErrNoSession, got: %v", err)
+	}
+
+	s.Set("hi", "hello")
+
+	val, err := s.Get("hi")
+	if err != nil {
+		t.Error(err)
+	}
+	if val != "hello" {
+		t.Errorf("Expected %q, got %s", "hello", val)
+	}
+
+	// Expired sessions must not be returned even if they were not cleaned yet
+	_, err = s.db.Exec("UPDATE sessions SET expires = ? WHERE id = ?", time.Now().Add(-time.Minute).Unix(), "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Get("hi")
+	if !IsNoSessionError(err) {
+		t.Errorf("Expected ErrNoSession, got: %v", err)
+	}
+}
+
+func TestSQLStorerSet(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSQLStorer(t, 0, 0)
+
+	s.Set("hi", "hello")
+	s.Set("hi", "whatsup")
+	s.Set("yo", "friend")
+
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Expected len 2, got %d", count)
+	}
+
+	val, err := s.Get("hi")
+	if err != nil {
+		t.Error(err)
+	}
+	if val != "whatsup" {
+		t.Errorf("Expected %q, got %s", "whatsup", val)
+	}
+
+	val, err = s.Get("yo")
+	if err != nil {
+		t.Error(err)
+	}
+	if val != "friend" {
+		t.Errorf("Expected %q, got %s", "friend", val)
+	}
+}
+
+func TestSQLStorerDel(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSQLStorer(t, 0, 0)
+
+	s.Set("hi", "hello")
+	s.Set("yo", "friend")
+
+	err := s.Del("hi")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = s.Get("hi")
+	if !IsNoSessionError(err) {
+		t.Errorf("Expected ErrNoSession, got: %v", err)
+	}
+
+	// Deleting a nonexistent session is a noop
+	if err = s.Del("hi"); err != nil {
+		t.Error(err)
+	}
+
+	list, err := s.All()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 1 {
+		t.Errorf("Expected len 1, got %d", len(list))
+	}
+}
+
+func TestSQLStorerResetExpiry(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSQLStorer(t, time.Hour, time.Hour)
+
+	err := s.ResetExpiry("hi")
+	if !IsNoSessionError(err) {
+		t.Errorf("Expected ErrNoSession, got: %v", err)
+	}
+
+	if err = s.Set("hi", "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	oldExpires := time.Now().Add(time.Minute).Unix()
+	_, err = s.db.Exec("UPDATE sessions SET expires = ? WHERE id = ?", oldExpires, "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.ResetExpiry("hi"); err != nil {
+		t.Error(err)
+	}
+
+	var newExpires int64
+	if err = s.db.QueryRow("SELECT expires FROM sessions WHERE id = ?", "hi").Scan(&newExpires); err != nil {
+		t.Fatal(err)
+	}
+	if newExpires <= oldExpires {
+		t.Errorf("Expected newexpires to be newer than old expires, got: %d, %d", oldExpires, newExpires)
+	}
+}
+
+func TestSQLStorerCleaner(t *testing.T) {
+	s := newTestSQLStorer(t, time.Hour, time.Hour)
+
+	tm := memoryTestTimer{}
+	ch := make(chan time.Time)
+	timerTestHarness = func(d time.Duration) (timer, <-chan time.Time) {
+		return tm, ch
+	}
+
+	s.Set("testid1", "test1")
+	s.Set("testid2", "test2")
+
+	_, err := s.db.Exec("UPDATE sessions SET expires = ? WHERE id = ?", time.Now().AddDate(0, 0, -1).Unix(), "testid2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start the cleaner go routine
+	s.StartCleaner()
+
+	// Signal the timer channel to execute the clean
+	ch <- time.Time{}
+
+	// Stop the cleaner, this will block until the cleaner has finished its operations
+	s.StopCleaner()
+
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected len 1, got %d", count)
+	}
+
+	_, err = s.Get("testid1")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSQLStorerUnchangedRows(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSQLStorer(t, time.Hour, time.Hour)
+
+	// Like MySQL, do not count the rows an update leaves as they are
+	_, err := s.db.Exec(`CREATE TRIGGER sessions_unchanged BEFORE UPDATE ON sessions
+		WHEN NEW.value = OLD.value AND NEW.expires = OLD.expires
+		BEGIN SELECT RAISE(IGNORE); END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Set("hi", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	expires := s.expires()
+	if _, err = s.db.Exec("UPDATE sessions SET expires = ? WHERE id = ?", expires, "hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The expiries of these are the same as the stored one unless the
+	// second changes in between, which only makes the test pass trivially
+	if err = s.Set("hi", "hello"); err != nil {
+		t.Error(err)
+	}
+	if err = s.ResetExpiry("hi"); err != nil {
+		t.Error(err)
+	}
+	_, version, err := s.GetVersioned(context.Background(), "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CompareAndSet(context.Background(), "hi", "hello", version); err != nil {
+		t.Error(err)
+	}
+
+	if val, err := s.Get("hi"); err != nil || val != "hello" {
+		t.Errorf("expected %q, got %q: %v", "hello", val, err)
+	}
+	if err = s.ResetExpiry("missing"); !IsNoSessionError(err) {
+		t.Errorf("expected a no session error, got: %v", err)
+	}
+}
+
+func TestSQLStorerCleanError(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSQLStorer(t, time.Hour, time.Hour)
+	buf := &bytes.Buffer{}
+	s.ErrorLog = log.New(buf, "", 0)
+
+	if _, err := s.db.Exec("DROP TABLE sessions"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failing clean is logged instead of taking down the app
+	s.Clean()
+
+	if !strings.Contains(buf.String(), "unable to delete expired sessions") {
+		t.Errorf("expected the error to be logged, got: %q", buf.String())
+	}
+}
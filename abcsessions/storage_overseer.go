@@ -1,142 +1,669 @@
 package abcsessions
 
 import (
+	"context"
 	"net/http"
+	"time"
 
 	"github.com/friendsofgo/errors"
-	uuid "github.com/satori/go.uuid"
 )
 
-// StorageOverseer holds cookie related variables and a session storer
+// defaultUpdateRetries is the default of StorageOverseer.UpdateRetries
+const defaultUpdateRetries = 10
+
+// idTransport carries the session ID between the client and the
+// StorageOverseer. CookieOptions carries it in a cookie and HeaderOptions
+// in request and response headers.
+type idTransport interface {
+	// getID returns the session ID of the request, or an errNoSession
+	// error if it has none
+	getID(w http.ResponseWriter, r *http.Request) (string, error)
+	// setID sends the session ID to the client
+	setID(w http.ResponseWriter, id string)
+	// refreshID sends the session ID again when its expiry is reset
+	refreshID(w http.ResponseWriter, id string)
+	// deleteID tells the client to forget its session ID
+	deleteID(w http.ResponseWriter)
+}
+
+// StorageOverseer holds the session ID transport options and a session
+// storer. Use NewStorageOverseer to carry the session ID in a cookie, or
+// NewHeaderOverseer to carry it in headers.
 type StorageOverseer struct {
-	Storer  Storer
-	options CookieOptions
+	Storer Storer
+	// Policy limits the lifetime of sessions and binds them to clients.
+	// The zero value enforces nothing.
+	Policy Policy
+	// Hooks are called with the lifecycle events of the sessions, see Event.
+	// Sessions removed by the cleaner of the Storer are reported if it
+	// implements ExpiryNotifier.
+	Hooks []Hook
+	// UpdateRetries is how many times Update calls its function again when
+	// the session was changed by a concurrent request in the meantime.
+	// Defaults to 10 when zero.
+	UpdateRetries int
+	// IDGenerator creates the session IDs, requests with an ID it does not
+	// recognize have no session. Defaults to RandomIDGenerator when nil.
+	IDGenerator IDGenerator
+	// SigningKey, when set, signs the session IDs sent to the clients with
+	// HMAC-SHA256, so that forged IDs are rejected before they reach the
+	// Storer. It should be 32 random bytes. Changing it ends the sessions
+	// of all clients.
+	SigningKey []byte
+	transport  idTransport
+	// unregister removes the overseer from the ExpiryNotifier of the Storer
+	unregister func()
 	resetExpiryMiddleware
 }
 
-// NewStorageOverseer returns a new storage overseer
+// NewStorageOverseer returns a new storage overseer. It panics if the cookie
+// options break the rules checked by CookieOptions.Validate.
 func NewStorageOverseer(opts CookieOptions, storer Storer) *StorageOverseer {
-	if len(opts.Name) == 0 {
-		panic("cookie name must be provided")
+	if err := opts.Validate(); err != nil {
+		panic(err)
+	}
+
+	return newStorageOverseer(opts, storer)
+}
+
+// NewHeaderOverseer returns a new storage overseer that reads the session ID
+// from a request header instead of a cookie, for API clients that can not
+// use cookies. New session IDs, including the ones made by Regenerate, are
+// returned in the response header of the options, and Del returns it empty.
+// The sessions are kept in storer exactly like with NewStorageOverseer.
+// It panics if the header options break the rules checked by
+// HeaderOptions.Validate.
+//
+// Using the sessions Middleware is not required, but it is still needed for
+// the session to be loaded and stored once per request.
+func NewHeaderOverseer(opts HeaderOptions, storer Storer) *StorageOverseer {
+	if err := opts.Validate(); err != nil {
+		panic(err)
 	}
 
+	return newStorageOverseer(opts, storer)
+}
+
+// newStorageOverseer returns a new storage overseer carrying the session ID
+// with transport
+func newStorageOverseer(transport idTransport, storer Storer) *StorageOverseer {
 	o := &StorageOverseer{
-		Storer:  storer,
-		options: opts,
+		Storer:    storer,
+		transport: transport,
 	}
 
 	o.resetExpiryMiddleware.resetter = o
 
+	if notifier, ok := asStorer[ExpiryNotifier](storer); ok {
+		o.unregister = notifier.NotifyExpired(o.expired)
+	}
+
 	return o
 }
 
-// Get looks in the cookie for the session ID and retrieves the value string stored in the session.
+// Close stops reporting the sessions removed by the cleaner of the Storer
+// to the Hooks. Overseers that are dropped while their Storer is still in
+// use must be closed, otherwise the Storer keeps them alive. Close does not
+// close the Storer.
+func (s *StorageOverseer) Close() {
+	if s.unregister != nil {
+		s.unregister()
+	}
+}
+
+// Get looks up the session ID of the request and retrieves the value string stored in the session.
 func (s *StorageOverseer) Get(w http.ResponseWriter, r *http.Request) (value string, err error) {
-	sessID, err := s.options.getCookieValue(w, r)
+	return s.GetContext(r.Context(), w, r)
+}
+
+// GetContext is Get with an explicit context for the storer calls.
+func (s *StorageOverseer) GetContext(ctx context.Context, w http.ResponseWriter, r *http.Request) (value string, err error) {
+	sessID, err := s.getID(w, r)
 	if err != nil {
-		return "", errors.Wrap(err, "unable to get session id from cookie")
+		return "", errors.Wrap(err, "unable to get session id")
 	}
 
-	val, err := s.Storer.Get(sessID)
+	val, err := s.storer().GetContext(ctx, sessID)
 	if err != nil {
 		return "", errors.Wrap(err, "unable to get session value")
 	}
 
-	return val, nil
+	env, err := s.open(ctx, w, r, sessID, val)
+	if err != nil {
+		return "", err
+	}
+
+	return env.Value, nil
 }
 
-// Set looks in the cookie for the session ID and modifies the session with the new value.
+// Set looks up the session ID of the request and modifies the session with the new value.
 // If the session does not exist it creates a new one.
 func (s *StorageOverseer) Set(w http.ResponseWriter, r *http.Request, value string) error {
-	// Reuse the existing cookie ID if it exists
-	sessID, _ := s.options.getCookieValue(w, r)
+	return s.SetContext(r.Context(), w, r, value)
+}
+
+// SetContext is Set with an explicit context for the storer calls.
+func (s *StorageOverseer) SetContext(ctx context.Context, w http.ResponseWriter, r *http.Request, value string) error {
+	stored, known := storedRequestSession(r, s)
+	return s.set(ctx, w, r, value, stored, known)
+}
+
+// set stores value like SetContext. If known is true, stored tells if the
+// session exists, so that it is not looked up only to raise EventCreate.
+func (s *StorageOverseer) set(ctx context.Context, w http.ResponseWriter, r *http.Request, value string, stored, known bool) error {
+	resetRequestSession(r)
+
+	storer := s.storer()
+	env := policyEnvelope{Value: value}
+
+	// Reuse the existing session ID if it exists
+	sessID, _ := s.getID(w, r)
+
+	// Keep the creation time of the existing session so that Set does not
+	// extend its absolute timeout. A session that violates the policy is
+	// deleted by open and its ID is not reused. Without a policy the session
+	// is only looked up to tell if it is created for the hooks, when that
+	// is not known already.
+	created := known && !stored
+	if len(sessID) != 0 && (s.Policy.enabled() || (len(s.Hooks) != 0 && !known)) {
+		old, err := storer.GetContext(ctx, sessID)
+		created = IsNoSessionError(err)
+		if err != nil && !created {
+			return errors.Wrap(err, "unable to get session value")
+		} else if err == nil && s.Policy.enabled() {
+			prev, err := s.open(ctx, w, r, sessID, old)
+			if IsNoSessionError(err) {
+				sessID = ""
+			} else if err != nil {
+				return err
+			} else {
+				env.Created = prev.Created
+			}
+		}
+	}
 
 	if len(sessID) == 0 {
-		sessID = uuid.NewV4().String()
+		var err error
+		if sessID, err = s.ids().NewID(); err != nil {
+			return err
+		}
+		created = true
 	}
 
-	err := s.Storer.Set(sessID, value)
+	value, err := s.Policy.seal(r, env)
+	if err != nil {
+		return err
+	}
+
+	err = storer.SetContext(ctx, sessID, value)
 	if err != nil {
 		return errors.Wrap(err, "unable to set session value")
 	}
 
-	w.(cookieWriter).SetCookie(s.options.makeCookie(sessID))
+	s.setID(w, sessID)
+
+	if created {
+		fireHooks(s.Hooks, Event{Type: EventCreate, SessionID: sessID, Request: r})
+	}
 
 	return nil
 }
 
-// Del deletes the session if it exists and sets the session cookie to expire instantly.
+// Update calls fn with the value of the session, or an empty string if
+// there is none, and stores the value fn returns, creating the session if
+// needed. If the Storer implements VersionedStorer the value is only stored
+// if the session was not changed since it was read, otherwise fn is called
+// again with the new value, up to UpdateRetries times. fn must not have side
+// effects since it can be called more than once. Storers that do not
+// implement VersionedStorer store the value unconditionally.
+func (s *StorageOverseer) Update(w http.ResponseWriter, r *http.Request, fn func(value string) (string, error)) error {
+	return s.UpdateContext(r.Context(), w, r, fn)
+}
+
+// UpdateContext is Update with an explicit context for the storer calls.
+func (s *StorageOverseer) UpdateContext(ctx context.Context, w http.ResponseWriter, r *http.Request, fn func(value string) (string, error)) error {
+	storer, ok := asStorer[VersionedStorer](s.Storer)
+	if !ok {
+		value, err := s.GetContext(ctx, w, r)
+		if err != nil && !IsNoSessionError(err) {
+			return err
+		}
+		stored := err == nil
+		if value, err = fn(value); err != nil {
+			return err
+		}
+		return s.set(ctx, w, r, value, stored, true)
+	}
+
+	resetRequestSession(r)
+
+	retries := s.UpdateRetries
+	if retries == 0 {
+		retries = defaultUpdateRetries
+	}
+
+	for i := 0; ; i++ {
+		err := s.update(ctx, w, r, storer, fn)
+		if !IsVersionConflictError(err) || i >= retries {
+			return err
+		}
+	}
+}
+
+// update makes a single compare-and-set attempt of UpdateContext
+func (s *StorageOverseer) update(ctx context.Context, w http.ResponseWriter, r *http.Request, storer VersionedStorer, fn func(value string) (string, error)) error {
+	var env policyEnvelope
+	var value, version string
+
+	// Like Set, the existing ID is reused unless the session violates
+	// the policy
+	sessID, err := s.getID(w, r)
+	if err == nil {
+		var stored string
+		stored, version, err = storer.GetVersioned(ctx, sessID)
+		if err != nil && !IsNoSessionError(err) {
+			return errors.Wrap(err, "unable to get session value")
+		} else if err == nil {
+			prev, err := s.open(ctx, w, r, sessID, stored)
+			if IsNoSessionError(err) {
+				sessID, version = "", ""
+			} else if err != nil {
+				return err
+			} else {
+				env.Created = prev.Created
+				value = prev.Value
+			}
+		}
+	}
+
+	created := len(version) == 0
+	if len(sessID) == 0 {
+		if sessID, err = s.ids().NewID(); err != nil {
+			return err
+		}
+	}
+
+	if env.Value, err = fn(value); err != nil {
+		return err
+	}
+
+	sealed, err := s.Policy.seal(r, env)
+	if err != nil {
+		return err
+	}
+
+	if err = storer.CompareAndSet(ctx, sessID, sealed, version); err != nil {
+		return errors.Wrap(err, "unable to set session value")
+	}
+
+	s.setID(w, sessID)
+
+	if created {
+		fireHooks(s.Hooks, Event{Type: EventCreate, SessionID: sessID, Request: r})
+	}
+
+	return nil
+}
+
+// Del deletes the session if it exists and tells the client to forget its
+// session ID: the session cookie is set to expire instantly, or the response
+// header is returned empty.
 func (s *StorageOverseer) Del(w http.ResponseWriter, r *http.Request) error {
-	sessID, err := s.options.getCookieValue(w, r)
+	return s.DelContext(r.Context(), w, r)
+}
+
+// DelContext is Del with an explicit context for the storer calls.
+func (s *StorageOverseer) DelContext(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	resetRequestSession(r)
+
+	token, err := s.transport.getID(w, r)
 	if err != nil {
 		return nil
 	}
 
-	s.options.deleteCookie(w)
+	s.transport.deleteID(w)
+
+	// Forged IDs have no session to delete
+	sessID, err := s.parseID(token)
+	if err != nil {
+		return nil
+	}
 
-	err = s.Storer.Del(sessID)
+	err = s.storer().DelContext(ctx, sessID)
 	if IsNoSessionError(err) {
 		return nil
 	} else if err != nil {
 		return errors.Wrap(err, "unable to delete server-side session")
 	}
 
+	fireHooks(s.Hooks, Event{Type: EventDelete, SessionID: sessID, Request: r})
+
 	return nil
 }
 
 // Regenerate a new session ID for your current session
 func (s *StorageOverseer) Regenerate(w http.ResponseWriter, r *http.Request) error {
-	id, err := s.options.getCookieValue(w, r)
+	return s.RegenerateContext(r.Context(), w, r)
+}
+
+// RegenerateContext is Regenerate with an explicit context for the storer calls.
+func (s *StorageOverseer) RegenerateContext(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	storer := s.storer()
+
+	id, err := s.getID(w, r)
 	if err != nil {
-		return errors.Wrap(err, "unable to get session id from cookie")
+		return errors.Wrap(err, "unable to get session id")
 	}
 
-	val, err := s.Storer.Get(id)
+	val, err := storer.GetContext(ctx, id)
 	if err != nil {
 		return errors.Wrap(err, "unable to get session value")
 	}
 
+	if _, err = s.open(ctx, w, r, id, val); err != nil {
+		return err
+	}
+
+	// Keep the owner of the session
+	var owner string
+	ownerStorer, hasOwners := asStorer[OwnerStorer](s.Storer)
+	if hasOwners {
+		if owner, err = ownerStorer.Owner(id); err != nil {
+			return errors.Wrap(err, "unable to get session owner")
+		}
+	}
+
 	// Delete the old session
-	_ = s.Storer.Del(id)
+	_ = storer.DelContext(ctx, id)
 
 	// Generate a new ID
-	id = uuid.NewV4().String()
+	prevID := id
+	if id, err = s.ids().NewID(); err != nil {
+		return err
+	}
 
 	// Create a new session with the old value
-	if err = s.Storer.Set(id, val); err != nil {
+	if err = storer.SetContext(ctx, id, val); err != nil {
 		return errors.Wrap(err, "unable to set session value")
 	}
 
-	// Override the old cookie with the new cookie
-	w.(cookieWriter).SetCookie(s.options.makeCookie(id))
+	if len(owner) != 0 {
+		if err = ownerStorer.SetOwner(id, owner); err != nil {
+			return errors.Wrap(err, "unable to set session owner")
+		}
+	}
+
+	// Override the old session ID with the new one
+	s.setID(w, id)
+
+	fireHooks(s.Hooks, Event{Type: EventRegenerate, SessionID: id, PreviousID: prevID, Request: r})
 
 	return nil
 }
 
-// SessionID returns the session ID stored in the cookie's value field.
+// SessionID returns the session ID of the request.
 // It will return a errNoSession error if no session exists.
 func (s *StorageOverseer) SessionID(w http.ResponseWriter, r *http.Request) (string, error) {
-	return s.options.getCookieValue(w, r)
+	return s.getID(w, r)
 }
 
 // ResetExpiry resets the age of the session to time.Now(), so that
 // MaxAge calculations are renewed
 func (s *StorageOverseer) ResetExpiry(w http.ResponseWriter, r *http.Request) error {
-	sessID, err := s.options.getCookieValue(w, r)
+	return s.ResetExpiryContext(r.Context(), w, r)
+}
+
+// ResetExpiryContext is ResetExpiry with an explicit context for the storer calls.
+func (s *StorageOverseer) ResetExpiryContext(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	sessID, err := s.getID(w, r)
 	if err != nil {
-		return errors.Wrap(err, "unable to get session id from cookie")
+		return errors.Wrap(err, "unable to get session id")
 	}
 
-	// Reset the expiry of the server-side session
-	err = s.Storer.ResetExpiry(sessID)
+	if s.Policy.enabled() {
+		err = s.touch(ctx, w, r, sessID)
+	} else {
+		// Reset the expiry of the server-side session
+		err = s.storer().ResetExpiryContext(ctx, sessID)
+	}
 	if err != nil {
 		return errors.Wrap(err, "unable to reset expiry of server side session")
 	}
 
-	// Reset the expiry in the client-side cookie
-	if s.options.MaxAge != 0 {
-		w.(cookieWriter).SetCookie(s.options.makeCookie(sessID))
+	// Reset the expiry in the client-side cookie, if the ID is in one
+	s.refreshID(w, sessID)
+
+	return nil
+}
+
+// resetDue returns true if the session has used at least threshold of its
+// lifetime, or if the Storer does not implement TTLStorer
+func (s *StorageOverseer) resetDue(w http.ResponseWriter, r *http.Request, threshold float64) (bool, error) {
+	ttlStorer, ok := asStorer[TTLStorer](s.Storer)
+	if !ok {
+		return true, nil
+	}
+
+	sessID, err := s.getID(w, r)
+	if err != nil {
+		return false, err
+	}
+
+	ttl, maxAge, err := ttlStorer.TTL(r.Context(), sessID)
+	if err != nil || maxAge == 0 {
+		return true, err
+	}
+
+	var cookieMaxAge time.Duration
+	if opts, ok := s.transport.(CookieOptions); ok {
+		cookieMaxAge = opts.MaxAge
+	}
+
+	lifetime := shortestLifetime(maxAge, cookieMaxAge, s.Policy.IdleTimeout)
+	return resetIsDue(maxAge-ttl, lifetime, threshold), nil
+}
+
+// SetOwner attaches the current session to owner, so that it can be
+// found with OwnerSessions and deleted with DelOwner. Changes made to the
+// session during the request are stored first, so that a session created
+// by this request can be given an owner. The Storer must implement OwnerStorer.
+func (s *StorageOverseer) SetOwner(w http.ResponseWriter, r *http.Request, owner string) error {
+	ownerStorer, err := s.ownerStorer()
+	if err != nil {
+		return err
+	}
+
+	if rs := getRequestSession(r, s); rs != nil {
+		if err = rs.flush(); err != nil {
+			return errors.Wrap(err, "unable to store session")
+		}
+	}
+
+	sessID, err := s.getID(w, r)
+	if err != nil {
+		return errors.Wrap(err, "unable to get session id")
+	}
+
+	err = ownerStorer.SetOwner(sessID, owner)
+	return errors.Wrap(err, "unable to set session owner")
+}
+
+// OwnerSessions returns the IDs of all sessions of owner.
+// The Storer must implement OwnerStorer.
+func (s *StorageOverseer) OwnerSessions(owner string) ([]string, error) {
+	ownerStorer, err := s.ownerStorer()
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := ownerStorer.OwnerSessions(owner)
+	return ids, errors.Wrap(err, "unable to get owner sessions")
+}
+
+// DelOwner deletes all sessions of owner, logging them out everywhere.
+// The session IDs held by the clients of the deleted sessions are left as
+// they are, they simply point to sessions that no longer exist.
+// The Storer must implement OwnerStorer.
+func (s *StorageOverseer) DelOwner(owner string) error {
+	ownerStorer, err := s.ownerStorer()
+	if err != nil {
+		return err
+	}
+
+	// Only look the sessions up if they have to be reported
+	var ids []string
+	if len(s.Hooks) != 0 {
+		if ids, err = ownerStorer.OwnerSessions(owner); err != nil {
+			return errors.Wrap(err, "unable to get owner sessions")
+		}
+	}
+
+	if err = ownerStorer.DelOwner(owner); err != nil {
+		return errors.Wrap(err, "unable to delete owner sessions")
+	}
+
+	for _, id := range ids {
+		fireHooks(s.Hooks, Event{Type: EventDelete, SessionID: id})
 	}
 
 	return nil
 }
+
+// ownerStorer returns the Storer as an OwnerStorer
+func (s *StorageOverseer) ownerStorer() (OwnerStorer, error) {
+	ownerStorer, ok := asStorer[OwnerStorer](s.Storer)
+	if !ok {
+		return nil, errors.Errorf("storer %T does not implement OwnerStorer", s.Storer)
+	}
+
+	return ownerStorer, nil
+}
+
+// touch checks the session against the Policy and resets the expiry of
+// the server-side session. If the policy has an idle timeout the session
+// is also marked as used now, which means the session is stored again. If
+// the Storer implements VersionedStorer it is only stored if it was not
+// changed in the meantime, so that the changes of concurrent requests are
+// not overwritten.
+func (s *StorageOverseer) touch(ctx context.Context, w http.ResponseWriter, r *http.Request, sessID string) error {
+	storer := s.storer()
+	versioned, isVersioned := asStorer[VersionedStorer](s.Storer)
+
+	var val, version string
+	var err error
+	if isVersioned && s.Policy.IdleTimeout != 0 {
+		val, version, err = versioned.GetVersioned(ctx, sessID)
+	} else {
+		val, err = storer.GetContext(ctx, sessID)
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to get session value")
+	}
+
+	env, err := s.open(ctx, w, r, sessID, val)
+	if err != nil {
+		return err
+	}
+
+	if s.Policy.IdleTimeout == 0 {
+		return storer.ResetExpiryContext(ctx, sessID)
+	}
+
+	if val, err = s.Policy.seal(r, env); err != nil {
+		return err
+	}
+
+	// Set resets the expiry as well
+	if !isVersioned {
+		return storer.SetContext(ctx, sessID, val)
+	}
+
+	err = versioned.CompareAndSet(ctx, sessID, val, version)
+	if IsVersionConflictError(err) {
+		// The session was stored by a concurrent request, which marked
+		// it as used as well, or deleted
+		return nil
+	}
+
+	return err
+}
+
+// open unwraps the stored session value and checks it against the Policy.
+// Sessions that violate the policy are deleted along with their client-side ID.
+func (s *StorageOverseer) open(ctx context.Context, w http.ResponseWriter, r *http.Request, sessID, val string) (policyEnvelope, error) {
+	env, err := s.Policy.open(r, val)
+	if IsNoSessionError(err) {
+		s.transport.deleteID(w)
+		// The session can't be used anymore even if this fails
+		_ = s.storer().DelContext(ctx, sessID)
+		fireHooks(s.Hooks, Event{Type: EventInvalidate, SessionID: sessID, Request: r, Err: err})
+	}
+
+	return env, err
+}
+
+// expired raises EventExpire for sessions removed by the cleaner of the Storer
+func (s *StorageOverseer) expired(key string) {
+	fireHooks(s.Hooks, Event{Type: EventExpire, SessionID: key})
+}
+
+// getID returns the session ID of the request. IDs that are not signed
+// with the SigningKey or not recognized by the IDGenerator are rejected
+// with an errNoSession error.
+func (s *StorageOverseer) getID(w http.ResponseWriter, r *http.Request) (string, error) {
+	token, err := s.transport.getID(w, r)
+	if err != nil {
+		return "", err
+	}
+
+	return s.parseID(token)
+}
+
+// parseID returns the session ID held by the token the client sent
+func (s *StorageOverseer) parseID(id string) (string, error) {
+	if len(s.SigningKey) != 0 {
+		var ok bool
+		if id, ok = verifyID(s.SigningKey, id); !ok {
+			return "", errors.Wrap(errNoSession{}, "session id signature is invalid")
+		}
+	}
+
+	if !s.ids().ValidID(id) {
+		return "", errors.Wrap(errNoSession{}, "session id is invalid")
+	}
+
+	return id, nil
+}
+
+// setID sends the session ID to the client, signed if there is a SigningKey
+func (s *StorageOverseer) setID(w http.ResponseWriter, id string) {
+	s.transport.setID(w, s.signID(id))
+}
+
+// refreshID sends the session ID again when its expiry is reset
+func (s *StorageOverseer) refreshID(w http.ResponseWriter, id string) {
+	s.transport.refreshID(w, s.signID(id))
+}
+
+// signID signs the session ID if there is a SigningKey
+func (s *StorageOverseer) signID(id string) string {
+	if len(s.SigningKey) == 0 {
+		return id
+	}
+
+	return signID(s.SigningKey, id)
+}
+
+// ids returns the IDGenerator or the default one
+func (s *StorageOverseer) ids() IDGenerator {
+	if s.IDGenerator == nil {
+		return RandomIDGenerator{}
+	}
+
+	return s.IDGenerator
+}
+
+// storer returns the context-aware version of the Storer
+func (s *StorageOverseer) storer() ContextStorer {
+	return NewContextStorer(s.Storer)
+}
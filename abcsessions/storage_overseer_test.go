@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"regexp"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -39,15 +40,15 @@ func TestStorageOverseerNew(t *testing.T) {
 		t.Error(err)
 	}
 
-	if s.options.MaxAge != 2 {
+	if s.transport.(CookieOptions).MaxAge != 2 {
 		t.Error("expected client expiry to be 2")
 	}
 
-	if s.options.Secure != true {
+	if s.transport.(CookieOptions).Secure != true {
 		t.Error("expected secure to be true")
 	}
 
-	if s.options.HTTPOnly != true {
+	if s.transport.(CookieOptions).HTTPOnly != true {
 		t.Error("expected httpOnly to be true")
 	}
 }
@@ -70,9 +71,10 @@ func TestStorageOverseerGet(t *testing.T) {
 		t.Errorf("Expected ErrNoSession, got: %v", err)
 	}
 
+	sessID, _ := RandomIDGenerator{}.NewID()
 	cookieOne := &http.Cookie{
-		Name:  s.options.Name,
-		Value: "sessionid",
+		Name:  s.transport.(CookieOptions).Name,
+		Value: sessID,
 	}
 	r.AddCookie(cookieOne)
 
@@ -80,7 +82,7 @@ func TestStorageOverseerGet(t *testing.T) {
 	if !IsNoSessionError(err) {
 		t.Errorf("Expected ErrNoSession, got: %v", err)
 	}
-	m.sessions["sessionid"] = memorySession{
+	m.sessions[sessID] = memorySession{
 		value: "whatever",
 	}
 	val, err = s.Get(w, r)
@@ -171,12 +173,13 @@ func TestStorageOverseerDel(t *testing.T) {
 	}
 	m.mut.RUnlock()
 
+	sessID, _ := RandomIDGenerator{}.NewID()
 	cookieOne := &http.Cookie{
-		Name:  s.options.Name,
-		Value: "sessionid",
+		Name:  s.transport.(CookieOptions).Name,
+		Value: sessID,
 	}
 	r.AddCookie(cookieOne)
-	m.sessions["sessionid"] = memorySession{
+	m.sessions[sessID] = memorySession{
 		value: "whatever",
 	}
 
@@ -210,16 +213,16 @@ func TestStorageOverseerMakeCookie(t *testing.T) {
 
 	m, _ := NewDefaultMemoryStorer()
 	s := NewStorageOverseer(NewCookieOptions(), m)
-	c := s.options.makeCookie("hello")
+	c := s.transport.(CookieOptions).makeCookie("hello")
 
-	if c.Name != s.options.Name {
+	if c.Name != s.transport.(CookieOptions).Name {
 		t.Errorf("expected name to be session key, got: %v", c.Name)
 	}
 	if c.Value == "" {
 		t.Errorf("expected value to be a uuid")
 	}
-	if c.MaxAge != int(s.options.MaxAge.Seconds()) {
-		t.Errorf("mismatch between %d and %d", c.MaxAge, int(s.options.MaxAge.Seconds()))
+	if c.MaxAge != int(s.transport.(CookieOptions).MaxAge.Seconds()) {
+		t.Errorf("mismatch between %d and %d", c.MaxAge, int(s.transport.(CookieOptions).MaxAge.Seconds()))
 	}
 	if c.HttpOnly != true {
 		t.Error("expected httponly true")
@@ -393,3 +396,105 @@ func TestStorageOverseerResetExpiry(t *testing.T) {
 		t.Errorf("expected paths to match, got %v and %v", newCookie.Path, oldCookie.Path)
 	}
 }
+
+func TestStorageOverseerOwner(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), m)
+
+	var id string
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		// The session only exists in the request session until it's stored
+		if err := Set(s, w, r, "user", "alice"); err != nil {
+			t.Error(err)
+		}
+		if err := s.SetOwner(w, r, "alice"); err != nil {
+			t.Error(err)
+		}
+		if err := s.Regenerate(w, r); err != nil {
+			t.Error(err)
+		}
+		id, _ = s.SessionID(w, r)
+	}
+	Middleware(http.HandlerFunc(fn)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	ids, err := s.OwnerSessions("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != id {
+		t.Errorf("expected the regenerated session %q, got %v", id, ids)
+	}
+
+	if err = s.DelOwner("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Get(id); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+
+	s = NewStorageOverseer(NewCookieOptions(), legacyStorer{Storer: m})
+	if _, err = s.OwnerSessions("alice"); err == nil {
+		t.Error("expected an error for storers that do not implement OwnerStorer")
+	}
+}
+
+func TestStorageOverseerUpdate(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), m)
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	err := s.Update(w, r, func(value string) (string, error) {
+		if len(value) != 0 {
+			t.Errorf("expected no value for a new session, got %q", value)
+		}
+		return "hello", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.SessionID(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A concurrent change makes fn run again with the new value
+	var calls []string
+	err = s.Update(w, r, func(value string) (string, error) {
+		calls = append(calls, value)
+		if len(calls) == 1 {
+			m.Set(id, "changed")
+		}
+		return value + "!", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 2 || calls[0] != "hello" || calls[1] != "changed" {
+		t.Errorf("expected to be called with the old and the new value, got %q", calls)
+	}
+	if val, _ := m.Get(id); val != "changed!" {
+		t.Errorf("expected %q, got %q", "changed!", val)
+	}
+
+	// Giving up after the retries
+	s.UpdateRetries = 2
+	n := 0
+	err = s.Update(w, r, func(value string) (string, error) {
+		n++
+		m.Set(id, strconv.Itoa(n))
+		return "lost", nil
+	})
+	if !IsVersionConflictError(err) {
+		t.Errorf("expected a version conflict error, got: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 calls, got %d", n)
+	}
+}
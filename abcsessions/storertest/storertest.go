@@ -0,0 +1,584 @@
+// Package storertest is a conformance test suite for abcsessions.Storer
+// implementations. Run it from a test of your own storer:
+//
+//	func TestMyStorer(t *testing.T) {
+//		storertest.Run(t, storertest.Suite{
+//			New: func(t *testing.T, maxAge time.Duration) abcsessions.Storer {
+//				return NewMyStorer(maxAge)
+//			},
+//		})
+//	}
+package storertest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+)
+
+// DefaultMaxAge is the maxAge passed to Suite.New when Suite.MaxAge is zero
+const DefaultMaxAge = time.Second
+
+// Suite describes the storer under test
+type Suite struct {
+	// New returns a new, empty storer whose sessions expire maxAge after they
+	// were last Set or had their expiry reset. Every call must return a
+	// storer that does not share sessions with the storers of other calls,
+	// because the tests run in parallel.
+	New func(t *testing.T, maxAge time.Duration) abcsessions.Storer
+	// Wait lets d pass for the storer and removes the expired sessions.
+	// Storers that expire sessions on their own clock can fast-forward it
+	// (miniredis.FastForward for example). Defaults to sleeping for d and
+	// calling the Clean method of the storer if it has one.
+	Wait func(t *testing.T, s abcsessions.Storer, d time.Duration)
+	// MaxAge is the session lifetime used by the expiry tests. It must be
+	// larger than the resolution of the expiry of the storer (one second
+	// for storers that keep unix timestamps). Defaults to DefaultMaxAge.
+	MaxAge time.Duration
+	// SkipExpiry skips the expiry and ResetExpiry tests, for storers that
+	// keep sessions until they are deleted
+	SkipExpiry bool
+}
+
+// Run runs the conformance suite against the storers created by suite.New
+func Run(t *testing.T, suite Suite) {
+	if suite.New == nil {
+		t.Fatal("storertest: Suite.New must be set")
+	}
+	if suite.Wait == nil {
+		suite.Wait = sleepAndClean
+	}
+	if suite.MaxAge == 0 {
+		suite.MaxAge = DefaultMaxAge
+	}
+
+	tests := []struct {
+		name   string
+		fn     func(t *testing.T, suite Suite)
+		expiry bool
+	}{
+		{name: "GetMissing", fn: testGetMissing},
+		{name: "SetGet", fn: testSetGet},
+		{name: "Values", fn: testValues},
+		{name: "Del", fn: testDel},
+		{name: "All", fn: testAll},
+		{name: "Keys", fn: testKeys},
+		{name: "Concurrency", fn: testConcurrency},
+		{name: "Context", fn: testContext},
+		{name: "CompareAndSet", fn: testCompareAndSet},
+		{name: "Expiry", fn: testExpiry, expiry: true},
+		{name: "ResetExpiry", fn: testResetExpiry, expiry: true},
+		{name: "TTL", fn: testTTL, expiry: true},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if test.expiry && suite.SkipExpiry {
+				t.Skip("storer does not expire sessions")
+			}
+			t.Parallel()
+			test.fn(t, suite)
+		})
+	}
+}
+
+// sleepAndClean is the default Suite.Wait
+func sleepAndClean(t *testing.T, s abcsessions.Storer, d time.Duration) {
+	time.Sleep(d)
+
+	if cleaner, ok := s.(interface{ Clean() }); ok {
+		cleaner.Clean()
+	}
+}
+
+// newKey returns a new session id
+func newKey() string {
+	return uuid.NewV4().String()
+}
+
+// mustSet sets key to value and fails the test on errors
+func mustSet(t *testing.T, s abcsessions.Storer, key, value string) {
+	t.Helper()
+
+	if err := s.Set(key, value); err != nil {
+		t.Fatalf("Set(%q): %v", key, err)
+	}
+}
+
+// assertValue checks that key holds value
+func assertValue(t *testing.T, s abcsessions.Storer, key, value string) {
+	t.Helper()
+
+	got, err := s.Get(key)
+	if err != nil {
+		t.Errorf("Get(%q): %v", key, err)
+	} else if got != value {
+		t.Errorf("Get(%q): expected %q, got %q", key, value, got)
+	}
+}
+
+// assertNoSession checks that key does not exist
+func assertNoSession(t *testing.T, s abcsessions.Storer, key string) {
+	t.Helper()
+
+	if _, err := s.Get(key); !abcsessions.IsNoSessionError(err) {
+		t.Errorf("Get(%q): expected a no session error, got: %v", key, err)
+	}
+}
+
+// assertAll checks that All returns exactly keys
+func assertAll(t *testing.T, s abcsessions.Storer, keys ...string) {
+	t.Helper()
+
+	got, err := s.All()
+	if err != nil {
+		t.Fatalf("All: %v", err)
+	}
+
+	want := append([]string{}, keys...)
+	got = append([]string{}, got...)
+	sort.Strings(want)
+	sort.Strings(got)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("All: expected %v, got %v", want, got)
+	}
+}
+
+func testGetMissing(t *testing.T, suite Suite) {
+	s := suite.New(t, suite.MaxAge)
+
+	assertNoSession(t, s, newKey())
+
+	// Missing sessions can be deleted and reset without creating them
+	key := newKey()
+	if err := s.Del(key); err != nil && !abcsessions.IsNoSessionError(err) {
+		t.Errorf("Del of a missing session: expected nil or a no session error, got: %v", err)
+	}
+	if err := s.ResetExpiry(key); err != nil && !abcsessions.IsNoSessionError(err) {
+		t.Errorf("ResetExpiry of a missing session: expected nil or a no session error, got: %v", err)
+	}
+	assertNoSession(t, s, key)
+	assertAll(t, s)
+}
+
+func testSetGet(t *testing.T, suite Suite) {
+	s := suite.New(t, suite.MaxAge)
+
+	key1, key2 := newKey(), newKey()
+	mustSet(t, s, key1, "hello")
+	mustSet(t, s, key2, "friend")
+	assertValue(t, s, key1, "hello")
+	assertValue(t, s, key2, "friend")
+
+	mustSet(t, s, key1, "whatsup")
+	assertValue(t, s, key1, "whatsup")
+	assertValue(t, s, key2, "friend")
+}
+
+func testValues(t *testing.T, suite Suite) {
+	s := suite.New(t, suite.MaxAge)
+
+	values := []string{
+		"",
+		`{"Value":{"user":"alice"},"Flash":{"notice":"hi"}}`,
+		"line one\nline two\r\n\ttabbed",
+		"unicode: héllo wörld 日本語 🎉",
+		"quotes ' \" ` and glob chars * ? [a-z]",
+		strings.Repeat("0123456789abcdef", 4096),
+	}
+
+	for i, value := range values {
+		key := newKey()
+		mustSet(t, s, key, value)
+
+		got, err := s.Get(key)
+		if err != nil {
+			t.Errorf("%d) Get: %v", i, err)
+		} else if got != value {
+			t.Errorf("%d) expected the value to round trip unchanged, got %d bytes instead of %d", i, len(got), len(value))
+		}
+	}
+}
+
+func testDel(t *testing.T, suite Suite) {
+	s := suite.New(t, suite.MaxAge)
+
+	key1, key2 := newKey(), newKey()
+	mustSet(t, s, key1, "hello")
+	mustSet(t, s, key2, "friend")
+
+	if err := s.Del(key1); err != nil {
+		t.Fatalf("Del: %v", err)
+	}
+	assertNoSession(t, s, key1)
+	assertValue(t, s, key2, "friend")
+	assertAll(t, s, key2)
+
+	// Deleted sessions can be created again
+	mustSet(t, s, key1, "back")
+	assertValue(t, s, key1, "back")
+}
+
+func testAll(t *testing.T, suite Suite) {
+	s := suite.New(t, suite.MaxAge)
+
+	assertAll(t, s)
+
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = newKey()
+		mustSet(t, s, keys[i], fmt.Sprintf("value %d", i))
+	}
+	// Overwriting a session does not duplicate it
+	mustSet(t, s, keys[0], "again")
+
+	assertAll(t, s, keys...)
+}
+
+func testKeys(t *testing.T, suite Suite) {
+	s := suite.New(t, suite.MaxAge)
+
+	// Session ids come from the cookie, so they can be anything. A storer may
+	// refuse keys that are not session ids, but must never let them reach
+	// other sessions or outside of its storage.
+	victim := newKey()
+	mustSet(t, s, victim, "victim")
+
+	keys := []string{
+		"",
+		"not-a-uuid",
+		"../../../../etc/passwd",
+		"..",
+		"/",
+		"a/b",
+		"*",
+		victim[:8] + "*",
+		strings.ToUpper(victim),
+		victim + "\x00",
+		victim + " ",
+		strings.Repeat("a", 4096),
+	}
+
+	var stored []string
+	for _, key := range keys {
+		assertNoSession(t, s, key)
+
+		if err := s.Set(key, "attacker"); err != nil {
+			continue
+		}
+
+		got, err := s.Get(key)
+		if err != nil || got != "attacker" {
+			t.Errorf("Set(%q) succeeded but Get returned %q: %v", key, got, err)
+		}
+		stored = append(stored, key)
+	}
+
+	assertValue(t, s, victim, "victim")
+	assertAll(t, s, append(stored, victim)...)
+
+	for _, key := range stored {
+		if err := s.Del(key); err != nil {
+			t.Errorf("Del(%q): %v", key, err)
+		}
+	}
+	assertValue(t, s, victim, "victim")
+	assertAll(t, s, victim)
+}
+
+func testConcurrency(t *testing.T, suite Suite) {
+	s := suite.New(t, suite.MaxAge)
+
+	const workers = 8
+	const ops = 20
+
+	shared := newKey()
+	mustSet(t, s, shared, "initial")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*ops*4)
+	keys := make([][]string, workers)
+
+	for w := 0; w < workers; w++ {
+		keys[w] = make([]string, ops)
+		for i := range keys[w] {
+			keys[w][i] = newKey()
+		}
+
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i, key := range keys[w] {
+				value := fmt.Sprintf("%d-%d", w, i)
+				if err := s.Set(key, value); err != nil {
+					errs <- fmt.Errorf("Set: %w", err)
+					continue
+				}
+				if got, err := s.Get(key); err != nil || got != value {
+					errs <- fmt.Errorf("Get(%q): expected %q, got %q: %v", key, value, got, err)
+				}
+
+				if err := s.Set(shared, value); err != nil {
+					errs <- fmt.Errorf("Set shared: %w", err)
+				}
+				if got, err := s.Get(shared); err != nil || len(got) == 0 {
+					errs <- fmt.Errorf("Get shared: got %q: %v", got, err)
+				}
+
+				// Delete every other session
+				if i%2 == 1 {
+					if err := s.Del(key); err != nil {
+						errs <- fmt.Errorf("Del: %w", err)
+					}
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	want := []string{shared}
+	for w := range keys {
+		for i, key := range keys[w] {
+			if i%2 == 1 {
+				assertNoSession(t, s, key)
+				continue
+			}
+			assertValue(t, s, key, fmt.Sprintf("%d-%d", w, i))
+			want = append(want, key)
+		}
+	}
+	assertAll(t, s, want...)
+}
+
+func testContext(t *testing.T, suite Suite) {
+	s := suite.New(t, suite.MaxAge)
+
+	cs, ok := s.(abcsessions.ContextStorer)
+	if !ok {
+		t.Skip("storer does not implement ContextStorer")
+	}
+
+	key := newKey()
+	ctx := context.Background()
+	if err := cs.SetContext(ctx, key, "hello"); err != nil {
+		t.Fatalf("SetContext: %v", err)
+	}
+	if got, err := cs.GetContext(ctx, key); err != nil || got != "hello" {
+		t.Errorf("GetContext: expected %q, got %q: %v", "hello", got, err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err := cs.GetContext(canceled, key); err == nil {
+		t.Error("GetContext: expected an error with a canceled context")
+	}
+	if err := cs.SetContext(canceled, newKey(), "hello"); err == nil {
+		t.Error("SetContext: expected an error with a canceled context")
+	}
+	if err := cs.DelContext(canceled, key); err == nil {
+		t.Error("DelContext: expected an error with a canceled context")
+	}
+	assertValue(t, s, key, "hello")
+}
+
+func testCompareAndSet(t *testing.T, suite Suite) {
+	s := suite.New(t, suite.MaxAge)
+
+	vs, ok := s.(abcsessions.VersionedStorer)
+	if !ok {
+		t.Skip("storer does not implement VersionedStorer")
+	}
+
+	ctx := context.Background()
+	key := newKey()
+
+	if _, _, err := vs.GetVersioned(ctx, key); !abcsessions.IsNoSessionError(err) {
+		t.Errorf("GetVersioned of a missing session: expected a no session error, got: %v", err)
+	}
+	if err := vs.CompareAndSet(ctx, key, "hello", "bogus"); !abcsessions.IsVersionConflictError(err) {
+		t.Errorf("CompareAndSet of a missing session: expected a version conflict, got: %v", err)
+	}
+	assertNoSession(t, s, key)
+
+	// An empty version creates the session, once
+	if err := vs.CompareAndSet(ctx, key, "hello", ""); err != nil {
+		t.Fatalf("CompareAndSet: %v", err)
+	}
+	if err := vs.CompareAndSet(ctx, key, "again", ""); !abcsessions.IsVersionConflictError(err) {
+		t.Errorf("CompareAndSet of an existing session with no version: expected a version conflict, got: %v", err)
+	}
+	assertValue(t, s, key, "hello")
+
+	value, version, err := vs.GetVersioned(ctx, key)
+	if err != nil || value != "hello" {
+		t.Fatalf("GetVersioned: expected %q, got %q: %v", "hello", value, err)
+	}
+
+	// A change made since the version was read is not overwritten
+	mustSet(t, s, key, "changed")
+	if err = vs.CompareAndSet(ctx, key, "stale", version); !abcsessions.IsVersionConflictError(err) {
+		t.Errorf("CompareAndSet with a stale version: expected a version conflict, got: %v", err)
+	}
+	assertValue(t, s, key, "changed")
+
+	_, version, err = vs.GetVersioned(ctx, key)
+	if err != nil {
+		t.Fatalf("GetVersioned: %v", err)
+	}
+	if err = vs.CompareAndSet(ctx, key, "fresh", version); err != nil {
+		t.Errorf("CompareAndSet with the current version: %v", err)
+	}
+	assertValue(t, s, key, "fresh")
+
+	// Concurrent increments through compare-and-set loops are never lost
+	const workers = 8
+	const ops = 10
+
+	counter := newKey()
+	mustSet(t, s, counter, "0")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < ops; i++ {
+				for {
+					value, version, err := vs.GetVersioned(ctx, counter)
+					if err != nil {
+						errs <- fmt.Errorf("GetVersioned: %w", err)
+						return
+					}
+
+					var n int
+					fmt.Sscan(value, &n)
+
+					err = vs.CompareAndSet(ctx, counter, fmt.Sprint(n+1), version)
+					if err == nil {
+						break
+					} else if !abcsessions.IsVersionConflictError(err) {
+						errs <- fmt.Errorf("CompareAndSet: %w", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	assertValue(t, s, counter, fmt.Sprint(workers*ops))
+}
+
+func testExpiry(t *testing.T, suite Suite) {
+	s := suite.New(t, suite.MaxAge)
+
+	key := newKey()
+	mustSet(t, s, key, "hello")
+
+	suite.Wait(t, s, suite.MaxAge*2)
+
+	assertNoSession(t, s, key)
+	assertAll(t, s)
+
+	// A new session can be created under the expired id
+	mustSet(t, s, key, "again")
+	assertValue(t, s, key, "again")
+}
+
+func testResetExpiry(t *testing.T, suite Suite) {
+	s := suite.New(t, suite.MaxAge)
+
+	reset, expired := newKey(), newKey()
+	mustSet(t, s, reset, "reset")
+	mustSet(t, s, expired, "expired")
+
+	// Half way to expiry reset one of the sessions, the other one
+	// expires while the reset one lives on
+	suite.Wait(t, s, suite.MaxAge*3/5)
+	if err := s.ResetExpiry(reset); err != nil {
+		t.Fatalf("ResetExpiry: %v", err)
+	}
+	suite.Wait(t, s, suite.MaxAge*3/5)
+
+	assertValue(t, s, reset, "reset")
+	assertNoSession(t, s, expired)
+
+	suite.Wait(t, s, suite.MaxAge*2)
+	assertNoSession(t, s, reset)
+}
+
+func testTTL(t *testing.T, suite Suite) {
+	s := suite.New(t, suite.MaxAge)
+
+	ts, ok := s.(abcsessions.TTLStorer)
+	if !ok {
+		t.Skip("storer does not implement TTLStorer")
+	}
+
+	ctx := context.Background()
+	key := newKey()
+
+	if _, _, err := ts.TTL(ctx, key); !abcsessions.IsNoSessionError(err) {
+		t.Errorf("TTL of a missing session: expected a no session error, got: %v", err)
+	}
+
+	mustSet(t, s, key, "hello")
+	ttl, maxAge, err := ts.TTL(ctx, key)
+	if err != nil {
+		t.Fatalf("TTL: %v", err)
+	}
+	if maxAge != suite.MaxAge {
+		t.Errorf("TTL: expected a max age of %s, got %s", suite.MaxAge, maxAge)
+	}
+	if ttl <= 0 || ttl > suite.MaxAge {
+		t.Errorf("TTL: expected a ttl in (0, %s], got %s", suite.MaxAge, ttl)
+	}
+
+	// The ttl goes down with time and is back up after a reset
+	suite.Wait(t, s, suite.MaxAge/2)
+	before, _, err := ts.TTL(ctx, key)
+	if err != nil {
+		t.Fatalf("TTL: %v", err)
+	}
+	if before >= ttl {
+		t.Errorf("TTL: expected the ttl to go down from %s, got %s", ttl, before)
+	}
+
+	if err := s.ResetExpiry(key); err != nil {
+		t.Fatalf("ResetExpiry: %v", err)
+	}
+	after, _, err := ts.TTL(ctx, key)
+	if err != nil {
+		t.Fatalf("TTL: %v", err)
+	}
+	if after <= before {
+		t.Errorf("TTL: expected the ttl to go up from %s after a reset, got %s", before, after)
+	}
+
+	suite.Wait(t, s, suite.MaxAge*2)
+	if _, _, err := ts.TTL(ctx, key); !abcsessions.IsNoSessionError(err) {
+		t.Errorf("TTL of an expired session: expected a no session error, got: %v", err)
+	}
+}
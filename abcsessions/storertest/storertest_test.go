@@ -0,0 +1,138 @@
+package storertest_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+	"github.com/volatiletech/abcweb/v5/abcsessions/storertest"
+	redis "gopkg.in/redis.v5"
+)
+
+func TestMemoryStorer(t *testing.T) {
+	t.Parallel()
+
+	storertest.Run(t, storertest.Suite{
+		New: func(t *testing.T, maxAge time.Duration) abcsessions.Storer {
+			m, err := abcsessions.NewMemoryStorer(maxAge, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return m
+		},
+	})
+}
+
+func TestDiskStorer(t *testing.T) {
+	t.Parallel()
+
+	storertest.Run(t, storertest.Suite{
+		New: func(t *testing.T, maxAge time.Duration) abcsessions.Storer {
+			d, err := abcsessions.NewDiskStorer(t.TempDir(), maxAge, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return d
+		},
+	})
+}
+
+func TestLogStorer(t *testing.T) {
+	t.Parallel()
+
+	storertest.Run(t, storertest.Suite{
+		New: func(t *testing.T, maxAge time.Duration) abcsessions.Storer {
+			l, err := abcsessions.NewLogStorer(filepath.Join(t.TempDir(), "sessions.log"), maxAge, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { l.Close() })
+			return l
+		},
+	})
+}
+
+func TestRedisStorer(t *testing.T) {
+	t.Parallel()
+
+	// Each storer has its own server whose clock is fast-forwarded
+	var servers sync.Map
+
+	storertest.Run(t, storertest.Suite{
+		New: func(t *testing.T, maxAge time.Duration) abcsessions.Storer {
+			mr := miniredis.RunT(t)
+			r, err := abcsessions.NewRedisStorerClient(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "sessions:", maxAge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			servers.Store(r, mr)
+			return r
+		},
+		Wait: func(t *testing.T, s abcsessions.Storer, d time.Duration) {
+			mr, _ := servers.Load(s)
+			mr.(*miniredis.Miniredis).FastForward(d)
+		},
+	})
+}
+
+func TestSQLStorer(t *testing.T) {
+	t.Parallel()
+
+	storertest.Run(t, storertest.Suite{
+		New: func(t *testing.T, maxAge time.Duration) abcsessions.Storer {
+			db, err := sql.Open("sqlite3", ":memory:")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Every connection to :memory: is a different database
+			db.SetMaxOpenConns(1)
+			t.Cleanup(func() { db.Close() })
+
+			_, err = db.Exec(`CREATE TABLE sessions (
+				id      VARCHAR(255) NOT NULL PRIMARY KEY,
+				value   TEXT         NOT NULL,
+				expires BIGINT       NOT NULL
+			)`)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := abcsessions.NewSQLStorer(db, abcsessions.SQLPlaceholderQuestion, "sessions", maxAge, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+		// Expiry is stored in unix seconds
+		MaxAge: 3 * time.Second,
+	})
+}
+
+func TestEncryptedStorer(t *testing.T) {
+	t.Parallel()
+
+	// The wrapped storers are cleaned when time passes
+	var storers sync.Map
+
+	storertest.Run(t, storertest.Suite{
+		New: func(t *testing.T, maxAge time.Duration) abcsessions.Storer {
+			m, err := abcsessions.NewMemoryStorer(maxAge, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := abcsessions.NewEncryptedStorer(m, []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+			storers.Store(e, m)
+			return e
+		},
+		Wait: func(t *testing.T, s abcsessions.Storer, d time.Duration) {
+			time.Sleep(d)
+			m, _ := storers.Load(s)
+			m.(*abcsessions.MemoryStorer).Clean()
+		},
+	})
+}
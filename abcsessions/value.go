@@ -0,0 +1,82 @@
+package abcsessions
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/friendsofgo/errors"
+)
+
+// Value is a typed accessor for a single key of the session. Unlike the
+// key-value string API it can store any type that can be marshalled to
+// JSON, and unlike the object API every key is stored separately, so
+// setting one key leaves the other keys and the flash messages alone.
+//
+// Values are stored in their own map of the session, so a Value[string]
+// does not see keys set with the key-value string API and vice versa.
+//
+//	var cart = abcsessions.Value[Cart]{Key: "cart"}
+//
+//	err := cart.Set(overseer, w, r, Cart{Items: items})
+//	c, err := cart.Get(overseer, w, r)
+type Value[T any] struct {
+	Key string
+}
+
+// NewValue returns a Value accessor for key
+func NewValue[T any](key string) Value[T] {
+	return Value[T]{Key: key}
+}
+
+// Get returns the value stored under the key. It returns an errNoSession
+// error if there is no session, and an errNoMapKey error if the key does
+// not exist.
+func (v Value[T]) Get(overseer Overseer, w http.ResponseWriter, r *http.Request) (T, error) {
+	var ret T
+
+	sess, err := getSession(overseer, w, r)
+	if err != nil {
+		return ret, err
+	}
+
+	raw, ok := sess.Values[v.Key]
+	if !ok || raw == nil {
+		return ret, errNoMapKey{}
+	}
+
+	err = json.Unmarshal(*raw, &ret)
+	return ret, errors.Wrap(err, "unable to unmarshal session value")
+}
+
+// Set stores value under the key, creating the session if it does not exist
+func (v Value[T]) Set(overseer Overseer, w http.ResponseWriter, r *http.Request, value T) error {
+	sess, err := getSession(overseer, w, r)
+	if err != nil && !IsNoSessionError(err) {
+		return err
+	}
+
+	mv, err := json.Marshal(value)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal session value")
+	}
+
+	if sess.Values == nil {
+		sess.Values = make(map[string]*json.RawMessage)
+	}
+	sess.Values[v.Key] = (*json.RawMessage)(&mv)
+
+	return setSession(overseer, w, r, sess)
+}
+
+// Del deletes the key from the session. Del is a noop on nonexistent keys,
+// but will error if the session does not exist.
+func (v Value[T]) Del(overseer Overseer, w http.ResponseWriter, r *http.Request) error {
+	sess, err := getSession(overseer, w, r)
+	if err != nil {
+		return err
+	}
+
+	delete(sess.Values, v.Key)
+
+	return setSession(overseer, w, r, sess)
+}
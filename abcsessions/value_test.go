@@ -0,0 +1,130 @@
+package abcsessions
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testCart struct {
+	Items   []string
+	Total   int64
+	Updated time.Time
+	Coupon  *string
+}
+
+func TestValue(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	o := NewStorageOverseer(NewCookieOptions(), m)
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	cart := NewValue[testCart]("cart")
+	count := Value[int]{Key: "count"}
+
+	_, err := cart.Get(o, w, r)
+	if !IsNoSessionError(err) {
+		t.Errorf("Expected ErrNoSession, got: %v", err)
+	}
+
+	coupon := "SAVE10"
+	want := testCart{
+		Items:   []string{"a", "b"},
+		Total:   1 << 40,
+		Updated: time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+		Coupon:  &coupon,
+	}
+
+	if err = cart.Set(o, w, r, want); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = count.Get(o, w, r)
+	if !IsNoMapKeyError(err) {
+		t.Errorf("Expected ErrNoMapKey, got: %v", err)
+	}
+
+	if err = count.Set(o, w, r, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cart.Get(o, w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %#v, got %#v", want, got)
+	}
+
+	n, err := count.Get(o, w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("Expected 5, got %d", n)
+	}
+
+	if err = cart.Del(o, w, r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cart.Get(o, w, r); !IsNoMapKeyError(err) {
+		t.Errorf("Expected ErrNoMapKey, got: %v", err)
+	}
+	if n, err = count.Get(o, w, r); err != nil || n != 5 {
+		t.Errorf("Expected other keys to be left alone, got %d %v", n, err)
+	}
+}
+
+func TestValueWithOtherHelpers(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	o := NewStorageOverseer(NewCookieOptions(), m)
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	user := Value[int64]{Key: "user"}
+
+	if err := AddFlash(o, w, r, "notice", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := user.Set(o, w, r, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key-value and object APIs have no value yet
+	if _, err := Get(o, w, r, "user"); !IsNoMapKeyError(err) {
+		t.Errorf("Expected ErrNoMapKey, got: %v", err)
+	}
+	if err := Del(o, w, r, "user"); err != nil {
+		t.Error(err)
+	}
+
+	if err := Set(o, w, r, "user", "string"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetObj(o, w, r, testCart{Total: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	flash, err := GetFlash(o, w, r, "notice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flash != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", flash)
+	}
+
+	id, err := user.Get(o, w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 42 {
+		t.Errorf("Expected 42, got %d", id)
+	}
+}
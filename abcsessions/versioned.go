@@ -0,0 +1,60 @@
+package abcsessions
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+
+	"github.com/friendsofgo/errors"
+)
+
+// VersionedStorer is implemented by storers that can compare-and-swap a
+// session, so that two requests changing the same session at the same time
+// do not silently overwrite each other's changes. The StorageOverseer uses it
+// in Update to retry and merge conflicting changes.
+//
+// The memory, disk, redis and sql storers implement VersionedStorer.
+type VersionedStorer interface {
+	// GetVersioned returns the value of the session along with its version.
+	// The version is opaque and changes every time the value changes.
+	GetVersioned(ctx context.Context, key string) (value, version string, err error)
+	// CompareAndSet saves value to the session only if the session is still
+	// at version, and resets its expiry like Set. An empty version means the
+	// session must not exist. It returns a version conflict error, see
+	// IsVersionConflictError, if the session was changed or created since.
+	CompareAndSet(ctx context.Context, key, value, version string) error
+}
+
+type versionConflictInterface interface {
+	VersionConflict()
+}
+
+type errVersionConflict struct{}
+
+func (errVersionConflict) VersionConflict() {}
+
+func (errVersionConflict) Error() string {
+	return "session was changed concurrently"
+}
+
+// IsVersionConflictError checks an error to see if it means that the
+// session was changed by someone else since it was read
+func IsVersionConflictError(err error) bool {
+	_, ok := err.(versionConflictInterface)
+	if ok {
+		return ok
+	}
+
+	_, ok = errors.Cause(err).(versionConflictInterface)
+	return ok
+}
+
+// valueVersion returns the version of a stored session value for the
+// storers that do not keep a version next to the value. Values only
+// compare equal to themselves, so a session that was changed back to
+// a value it had before is treated as unchanged, which is what merging
+// the changes of concurrent requests needs.
+func valueVersion(value string) string {
+	sum := sha1.Sum([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
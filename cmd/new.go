@@ -39,8 +39,8 @@ abcweb new gopkg.in/yaml                         -> generates app inside a ./yam
 }
 
 func init() {
-	newCmd.Flags().StringP("sessions-prod-storer", "p", "disk", "Session storer to use in production mode (cookie|memory|disk|redis)")
-	newCmd.Flags().StringP("sessions-dev-storer", "d", "cookie", "Session storer to use in development mode (cookie|memory|disk|redis)")
+	newCmd.Flags().StringP("sessions-prod-storer", "p", "disk", "Session storer to use in production mode (cookie|memory|disk|log|redis)")
+	newCmd.Flags().StringP("sessions-dev-storer", "d", "cookie", "Session storer to use in development mode (cookie|memory|disk|log|redis)")
 	newCmd.Flags().StringP("tls-common-name", "", "localhost", "Common Name for generated TLS certificate")
 	newCmd.Flags().StringP("default-env", "", "prod", "Default $APP_ENV to use when starting server")
 	newCmd.Flags().StringP("bootstrap", "b", "regular", "Include Twitter Bootstrap 4 (none|regular|gridonly|rebootonly|gridandrebootonly)")
@@ -410,8 +410,9 @@ func processSkips(cfg newConfig, basePath string, path string, info os.FileInfo)
 		}
 	}
 
-	// Skip sessions configuration if requested
-	if cfg.NoSessions && strings.HasSuffix(path, "/templates/app/sessions.go.tmpl") {
+	// Skip sessions configuration and the flashes partial if requested
+	if cfg.NoSessions && (strings.HasSuffix(path, "/templates/app/sessions.go.tmpl") ||
+		strings.HasSuffix(path, "/templates/templates/partials/flashes.html")) {
 		return true, nil
 	}
 
@@ -0,0 +1,372 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/friendsofgo/errors"
+	"github.com/spf13/cobra"
+	"github.com/volatiletech/abcweb/v5/abcconfig"
+	"github.com/volatiletech/abcweb/v5/abcdatabase"
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+	"github.com/volatiletech/abcweb/v5/config"
+
+	// The sql sessions storer uses the Postgres database of the app
+	_ "github.com/lib/pq"
+)
+
+// sessionsCmdConfig holds the app config of the active environment,
+// loaded by the sessions command before running its subcommands
+var sessionsCmdConfig abcconfig.AppConfig
+
+// sessionsCmd represents the "sessions" command
+var sessionsCmd = &cobra.Command{
+	Use:   "sessions",
+	Short: "Inspect and manage stored sessions (list, show, delete, purge-expired, migrate)",
+	Long: `Inspect and manage the sessions of your app stored on the server.
+
+The sessions storer is built from the [sessions] section of the active
+config.toml environment, so the disk, log, redis and sql storers are supported.
+The log storer file can only be opened by one process, stop the app first.
+The memory and cookie storers keep their sessions inside the app process
+or the client and can not be managed from the command line.
+`,
+	Example: "abcweb sessions list\nabcweb sessions show <id>\nabcweb sessions migrate --to-storer redis --to-redis-addr localhost:6379",
+}
+
+var sessionsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the IDs of the stored sessions",
+	Args:  cobra.NoArgs,
+	RunE:  sessionsListExec,
+}
+
+var sessionsShowCmd = &cobra.Command{
+	Use:   "show <id>",
+	Short: "Print the value of a session",
+	Args:  cobra.ExactArgs(1),
+	RunE:  sessionsShowExec,
+}
+
+var sessionsDeleteCmd = &cobra.Command{
+	Use:   "delete [id...]",
+	Short: "Delete sessions by ID, or all sessions of an owner",
+	RunE:  sessionsDeleteExec,
+}
+
+var sessionsPurgeExpiredCmd = &cobra.Command{
+	Use:   "purge-expired",
+	Short: "Remove the expired sessions from the storer",
+	Args:  cobra.NoArgs,
+	RunE:  sessionsPurgeExpiredExec,
+}
+
+var sessionsMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Copy the sessions to another storer",
+	Long: `Copy all sessions from the configured storer to another storer.
+
+The target storer uses the configuration of the [sessions] section, with the
+values overridden by the --to-* flags. Copied sessions get the full max age
+of the target storer.
+`,
+	Example: "abcweb sessions migrate --to-storer redis --to-redis-addr localhost:6379 --delete",
+	Args:    cobra.NoArgs,
+	RunE:    sessionsMigrateExec,
+}
+
+func init() {
+	// sessions flags
+	sessionsCmd.PersistentFlags().StringP("env", "e", "dev", "The config.toml file environment to load")
+	sessionsCmd.PersistentFlags().AddFlagSet(abcconfig.NewSessionsFlagSet())
+	sessionsCmd.PersistentFlags().AddFlagSet(abcconfig.NewDBFlagSet())
+
+	sessionsListCmd.Flags().StringP("owner", "o", "", "Only list the sessions of this owner")
+	sessionsDeleteCmd.Flags().StringP("owner", "o", "", "Delete all sessions of this owner")
+
+	sessionsMigrateCmd.Flags().StringP("to-storer", "", "", "The target sessions storer (disk|log|redis|sql)")
+	sessionsMigrateCmd.Flags().StringP("to-disk-folder", "", "", "The target disk storer folder, relative to the OS temp directory")
+	sessionsMigrateCmd.Flags().StringP("to-log-file", "", "", "The target log storer file, relative to the OS temp directory")
+	sessionsMigrateCmd.Flags().StringP("to-redis-addr", "", "", "The target Redis server address")
+	sessionsMigrateCmd.Flags().StringP("to-redis-password", "", "", "The target Redis server password")
+	sessionsMigrateCmd.Flags().IntP("to-redis-db", "", 0, "The target Redis database index")
+	sessionsMigrateCmd.Flags().StringP("to-redis-prefix", "", "", "The prefix of the session keys in the target Redis")
+	sessionsMigrateCmd.Flags().StringP("to-sql-table", "", "", "The sessions table of the target sql storer")
+	sessionsMigrateCmd.Flags().BoolP("delete", "", false, "Delete the sessions from the configured storer once copied")
+	sessionsMigrateCmd.MarkFlagRequired("to-storer")
+
+	RootCmd.AddCommand(sessionsCmd)
+	sessionsCmd.AddCommand(sessionsListCmd)
+	sessionsCmd.AddCommand(sessionsShowCmd)
+	sessionsCmd.AddCommand(sessionsDeleteCmd)
+	sessionsCmd.AddCommand(sessionsPurgeExpiredCmd)
+	sessionsCmd.AddCommand(sessionsMigrateCmd)
+
+	sessionsCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		// Like the migrate command, override the RootCmd persistent pre-run
+		// to load the config of the environment chosen by the env flag.
+		var err error
+		cnf, err = config.Initialize(cmd.Flags().Lookup("env"))
+		if err != nil {
+			return err
+		}
+		if err := cnf.CheckEnv(); err != nil {
+			return err
+		}
+
+		c := abcconfig.NewConfig(cnf.AppEnvName)
+		c.File = filepath.Join(cnf.AppPath, config.AppConfigFilename)
+		c.LoadEnv = cnf.ActiveEnv
+
+		sessionsCmdConfig = abcconfig.AppConfig{}
+		v, err := c.NewSubViper(sessionsCmd.PersistentFlags(), &sessionsCmdConfig)
+		if err != nil {
+			return err
+		}
+
+		return abcconfig.UnmarshalAppConfig(&sessionsCmdConfig, v)
+	}
+}
+
+func sessionsListExec(cmd *cobra.Command, args []string) error {
+	storer, err := openSessionsStorer(sessionsCmdConfig.Sessions, sessionsCmdConfig.DB)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	if owner, _ := cmd.Flags().GetString("owner"); len(owner) != 0 {
+		ownerStorer, ok := storer.(abcsessions.OwnerStorer)
+		if !ok {
+			return errors.Errorf("the %s storer does not track session owners", sessionsCmdConfig.Sessions.Storer)
+		}
+		keys, err = ownerStorer.OwnerSessions(owner)
+	} else {
+		keys, err = storer.All()
+	}
+	if err != nil {
+		return errors.Wrap(err, "cannot list sessions")
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Println(key)
+	}
+
+	return nil
+}
+
+func sessionsShowExec(cmd *cobra.Command, args []string) error {
+	storer, err := openSessionsStorer(sessionsCmdConfig.Sessions, sessionsCmdConfig.DB)
+	if err != nil {
+		return err
+	}
+
+	value, err := storer.Get(args[0])
+	if err != nil {
+		return errors.Wrapf(err, "cannot get session %s", args[0])
+	}
+
+	fmt.Println(indentSessionValue(value))
+	return nil
+}
+
+func sessionsDeleteExec(cmd *cobra.Command, args []string) error {
+	owner, _ := cmd.Flags().GetString("owner")
+	if len(args) == 0 && len(owner) == 0 {
+		return errors.New("no session ids or owner supplied")
+	}
+
+	storer, err := openSessionsStorer(sessionsCmdConfig.Sessions, sessionsCmdConfig.DB)
+	if err != nil {
+		return err
+	}
+
+	if len(owner) != 0 {
+		ownerStorer, ok := storer.(abcsessions.OwnerStorer)
+		if !ok {
+			return errors.Errorf("the %s storer does not track session owners", sessionsCmdConfig.Sessions.Storer)
+		}
+		if err := ownerStorer.DelOwner(owner); err != nil {
+			return errors.Wrapf(err, "cannot delete sessions of owner %s", owner)
+		}
+	}
+
+	for _, key := range args {
+		if err := storer.Del(key); err != nil {
+			return errors.Wrapf(err, "cannot delete session %s", key)
+		}
+	}
+
+	return nil
+}
+
+func sessionsPurgeExpiredExec(cmd *cobra.Command, args []string) error {
+	storer, err := openSessionsStorer(sessionsCmdConfig.Sessions, sessionsCmdConfig.DB)
+	if err != nil {
+		return err
+	}
+
+	cleaner, ok := storer.(interface{ Clean() })
+	if !ok {
+		fmt.Printf("The %s storer removes expired sessions by itself\n", sessionsCmdConfig.Sessions.Storer)
+		return nil
+	}
+
+	cleaner.Clean()
+	return nil
+}
+
+func sessionsMigrateExec(cmd *cobra.Command, args []string) error {
+	from, err := openSessionsStorer(sessionsCmdConfig.Sessions, sessionsCmdConfig.DB)
+	if err != nil {
+		return err
+	}
+
+	toCfg := sessionsCmdConfig.Sessions
+	flags := cmd.Flags()
+	toCfg.Storer, _ = flags.GetString("to-storer")
+	if flags.Changed("to-disk-folder") {
+		toCfg.DiskFolder, _ = flags.GetString("to-disk-folder")
+	}
+	if flags.Changed("to-log-file") {
+		toCfg.LogFile, _ = flags.GetString("to-log-file")
+	}
+	if flags.Changed("to-redis-addr") {
+		toCfg.RedisAddr, _ = flags.GetString("to-redis-addr")
+	}
+	if flags.Changed("to-redis-password") {
+		toCfg.RedisPassword, _ = flags.GetString("to-redis-password")
+	}
+	if flags.Changed("to-redis-db") {
+		toCfg.RedisDB, _ = flags.GetInt("to-redis-db")
+	}
+	if flags.Changed("to-redis-prefix") {
+		toCfg.RedisPrefix, _ = flags.GetString("to-redis-prefix")
+	}
+	if flags.Changed("to-sql-table") {
+		toCfg.SQLTable, _ = flags.GetString("to-sql-table")
+	}
+	if toCfg == sessionsCmdConfig.Sessions {
+		return errors.New("the target storer is the configured storer")
+	}
+
+	to, err := openSessionsStorer(toCfg, sessionsCmdConfig.DB)
+	if err != nil {
+		return err
+	}
+
+	del, _ := flags.GetBool("delete")
+	n, err := migrateSessions(from, to, del)
+	fmt.Printf("Migrated %d sessions\n", n)
+	return err
+}
+
+// migrateSessions copies all sessions and their owners from one storer to
+// another, deleting them from the first storer if del is true. It returns
+// the number of sessions copied. Expired sessions are not copied, since the
+// target storer would give them a new max age.
+func migrateSessions(from, to abcsessions.Storer, del bool) (int, error) {
+	// Remove the expired sessions the cleaner of the source did not get to yet
+	if cleaner, ok := from.(interface{ Clean() }); ok {
+		cleaner.Clean()
+	}
+
+	keys, err := from.All()
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot list sessions")
+	}
+
+	fromOwners, _ := from.(abcsessions.OwnerStorer)
+	toOwners, _ := to.(abcsessions.OwnerStorer)
+	fromTTLs, _ := from.(abcsessions.TTLStorer)
+
+	n := 0
+	for _, key := range keys {
+		value, err := from.Get(key)
+		if abcsessions.IsNoSessionError(err) {
+			// Expired or deleted since it was listed
+			continue
+		} else if err != nil {
+			return n, errors.Wrapf(err, "cannot get session %s", key)
+		}
+
+		if fromTTLs != nil {
+			ttl, maxAge, err := fromTTLs.TTL(context.Background(), key)
+			if abcsessions.IsNoSessionError(err) || (err == nil && maxAge != 0 && ttl <= 0) {
+				// Expired since the source was cleaned
+				continue
+			} else if err != nil {
+				return n, errors.Wrapf(err, "cannot get ttl of session %s", key)
+			}
+		}
+
+		if err := to.Set(key, value); err != nil {
+			return n, errors.Wrapf(err, "cannot set session %s", key)
+		}
+
+		if fromOwners != nil && toOwners != nil {
+			owner, err := fromOwners.Owner(key)
+			if err != nil {
+				return n, errors.Wrapf(err, "cannot get owner of session %s", key)
+			}
+			if len(owner) != 0 {
+				if err := toOwners.SetOwner(key, owner); err != nil {
+					return n, errors.Wrapf(err, "cannot set owner of session %s", key)
+				}
+			}
+		}
+
+		if del {
+			if err := from.Del(key); err != nil {
+				return n, errors.Wrapf(err, "cannot delete session %s", key)
+			}
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// openSessionsStorer builds the sessions storer configured by cfg,
+// connecting to the database of the app for the sql storer
+func openSessionsStorer(cfg abcconfig.SessionsConfig, dbCfg abcconfig.DBConfig) (abcsessions.Storer, error) {
+	switch cfg.Storer {
+	case "memory", "cookie":
+		return nil, errors.Errorf("the %s storer does not keep sessions outside of the app and can not be managed", cfg.Storer)
+	}
+
+	var db *sql.DB
+	if cfg.Storer == "sql" {
+		if err := abcconfig.ValidateDBConfig(dbCfg); err != nil {
+			return nil, errors.Wrap(err, "invalid database config for the sql storer")
+		}
+
+		connStr, err := abcdatabase.GetConnStr(dbCfg)
+		if err != nil {
+			return nil, err
+		}
+		db, err = sql.Open("postgres", connStr)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot open database")
+		}
+	}
+
+	return abcconfig.NewSessionsStorer(cfg, db)
+}
+
+// indentSessionValue indents session values holding JSON, like the values
+// of the StorageOverseer, and returns other values unchanged
+func indentSessionValue(value string) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(value), "", "  "); err != nil {
+		return value
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+)
+
+func TestMigrateSessions(t *testing.T) {
+	t.Parallel()
+
+	from, _ := abcsessions.NewDefaultMemoryStorer()
+	to, _ := abcsessions.NewDefaultMemoryStorer()
+
+	keys := []string{
+		"2a1f6b4a-8f1e-4a55-9c3c-1b0e6b1d6f01",
+		"2a1f6b4a-8f1e-4a55-9c3c-1b0e6b1d6f02",
+	}
+	for _, key := range keys {
+		if err := from.Set(key, "value "+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := from.SetOwner(keys[0], "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := migrateSessions(from, to, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(keys) {
+		t.Errorf("expected %d sessions migrated, got %d", len(keys), n)
+	}
+
+	for _, key := range keys {
+		if val, err := to.Get(key); err != nil || val != "value "+key {
+			t.Errorf("expected %q, got %q: %v", "value "+key, val, err)
+		}
+		if _, err := from.Get(key); !abcsessions.IsNoSessionError(err) {
+			t.Errorf("expected session to be deleted from the source, got: %v", err)
+		}
+	}
+
+	if owner, err := to.Owner(keys[0]); err != nil || owner != "bob" {
+		t.Errorf("expected owner %q, got %q: %v", "bob", owner, err)
+	}
+}
+
+func TestIndentSessionValue(t *testing.T) {
+	t.Parallel()
+
+	if got := indentSessionValue(`{"a":1}`); got != "{\n  \"a\": 1\n}" {
+		t.Errorf("unexpected indented value: %q", got)
+	}
+	if got := indentSessionValue("plain"); got != "plain" {
+		t.Errorf("expected the value unchanged, got %q", got)
+	}
+}
+
+// expiredStorer is a memory storer that reports one of its sessions
+// as expired, as if its cleaner had not run yet
+type expiredStorer struct {
+	*abcsessions.MemoryStorer
+	expired string
+}
+
+func (e expiredStorer) TTL(ctx context.Context, key string) (time.Duration, time.Duration, error) {
+	ttl, maxAge, err := e.MemoryStorer.TTL(ctx, key)
+	if key == e.expired {
+		ttl = 0
+	}
+	return ttl, maxAge, err
+}
+
+func TestMigrateSessionsExpired(t *testing.T) {
+	t.Parallel()
+
+	m, _ := abcsessions.NewDefaultMemoryStorer()
+	from := expiredStorer{MemoryStorer: m, expired: "2a1f6b4a-8f1e-4a55-9c3c-1b0e6b1d6f01"}
+	to, _ := abcsessions.NewDefaultMemoryStorer()
+
+	live := "2a1f6b4a-8f1e-4a55-9c3c-1b0e6b1d6f02"
+	for _, key := range []string{from.expired, live} {
+		if err := from.Set(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := migrateSessions(from, to, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 session migrated, got %d", n)
+	}
+	if _, err := to.Get(from.expired); !abcsessions.IsNoSessionError(err) {
+		t.Errorf("expected the expired session not to be migrated, got: %v", err)
+	}
+	if _, err := to.Get(live); err != nil {
+		t.Errorf("expected the live session to be migrated, got: %v", err)
+	}
+}